@@ -0,0 +1,174 @@
+package sbctl
+
+import (
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+)
+
+type EFIClass string
+
+const (
+	ClassBootloader EFIClass = "bootloader"
+	ClassUKI        EFIClass = "uki"
+	ClassDriver     EFIClass = "driver"
+	ClassFallback   EFIClass = "fallback"
+)
+
+var EFIClasses = []EFIClass{ClassBootloader, ClassUKI, ClassDriver, ClassFallback}
+
+var ErrNotEFIBinary = errors.New("not an EFI binary")
+
+// ClassifyEFIBinary looks at the PE headers and sections of a binary to
+// figure out what kind of EFI binary it is. path is relative to the ESP and
+// used to detect the removable media fallback path.
+func ClassifyEFIBinary(r io.ReaderAt, path string) (EFIClass, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrNotEFIBinary, err)
+	}
+	defer f.Close()
+
+	var subsystem uint16
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		subsystem = h.Subsystem
+	case *pe.OptionalHeader64:
+		subsystem = h.Subsystem
+	default:
+		return "", ErrNotEFIBinary
+	}
+
+	switch subsystem {
+	case pe.IMAGE_SUBSYSTEM_EFI_APPLICATION:
+	case pe.IMAGE_SUBSYSTEM_EFI_BOOT_SERVICE_DRIVER, pe.IMAGE_SUBSYSTEM_EFI_RUNTIME_DRIVER:
+		return ClassDriver, nil
+	default:
+		return "", ErrNotEFIBinary
+	}
+
+	// Unified kernel images carry the kernel in a .linux section
+	if f.Section(".linux") != nil {
+		return ClassUKI, nil
+	}
+
+	// EFI/BOOT/BOOT{X64,IA32,AA64,...}.EFI, matched case insensitive as the
+	// ESP is a FAT filesystem
+	p := strings.ToUpper(filepath.ToSlash(strings.TrimPrefix(path, "/")))
+	if strings.HasPrefix(p, "EFI/BOOT/BOOT") && strings.HasSuffix(p, ".EFI") && !strings.Contains(strings.TrimPrefix(p, "EFI/BOOT/"), "/") {
+		return ClassFallback, nil
+	}
+	return ClassBootloader, nil
+}
+
+type EFIBinary struct {
+	Path  string   `json:"path"`
+	Class EFIClass `json:"class"`
+	// Signed by our signature database key
+	Signed bool `json:"signed"`
+	// Carries signatures, but none of them are ours. These are usually vendor
+	// signed binaries like shim or the Windows boot manager.
+	ThirdPartySigned bool `json:"third_party_signed"`
+	// Already part of the file database
+	Tracked bool `json:"tracked"`
+}
+
+// Proposed reports whether the binary should be added to the file database.
+// Binaries signed by third parties are left alone so they keep their
+// original signatures.
+func (b *EFIBinary) Proposed() bool {
+	return !b.Tracked && !b.ThirdPartySigned
+}
+
+// FindEFIBinaries walks the ESP and returns all EFI binaries found together
+// with their class and signing state.
+func FindEFIBinaries(state *config.State, kh *backend.KeyHierarchy, esp string) ([]*EFIBinary, error) {
+	tracked := map[string]bool{}
+	if err := SigningEntryIter(state, func(s *SigningEntry) error {
+		tracked[s.File] = true
+		tracked[s.OutputFile] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var binaries []*EFIBinary
+	err := afero.Walk(state.Fs, esp, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(esp, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := state.Fs.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if ok, err := CheckMSDos(f); err != nil || !ok {
+			return nil
+		}
+		class, err := ClassifyEFIBinary(f, rel)
+		if errors.Is(err, ErrNotEFIBinary) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		binary := &EFIBinary{
+			Path:    path,
+			Class:   class,
+			Tracked: tracked[path],
+		}
+
+		// Broken binaries are skipped so the rest of the ESP is still found
+		peBinary, err := authenticode.Parse(f)
+		if err != nil {
+			logging.Warn("%s: %v, skipping it", path, err)
+			return nil
+		}
+		sigs, err := peBinary.Signatures()
+		if err != nil {
+			logging.Warn("%s: %v, skipping it", path, err)
+			return nil
+		}
+		if len(sigs) > 0 {
+			ok, err := kh.VerifyFile(hierarchy.Db, f)
+			if err != nil {
+				logging.Warn("%s: %v, skipping it", path, err)
+				return nil
+			}
+			binary.Signed = ok
+			binary.ThirdPartySigned = !ok
+		}
+
+		binaries = append(binaries, binary)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(binaries, func(a, b *EFIBinary) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return binaries, nil
+}
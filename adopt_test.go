@@ -0,0 +1,78 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestClassifyEFIBinary(t *testing.T) {
+	b, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path    string
+		data    []byte
+		class   EFIClass
+		wantErr error
+	}{
+		{path: "EFI/BOOT/BOOTX64.EFI", data: b, class: ClassFallback},
+		{path: "/EFI/boot/bootx64.efi", data: b, class: ClassFallback},
+		{path: "EFI/systemd/systemd-bootx64.efi", data: b, class: ClassBootloader},
+		{path: "EFI/BOOT/fbx64.efi", data: b, class: ClassBootloader},
+		{path: "loader/random-seed", data: []byte("MZ not really"), wantErr: ErrNotEFIBinary},
+	} {
+		class, err := ClassifyEFIBinary(bytes.NewReader(c.data), c.path)
+		if c.wantErr != nil {
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("%s: expected error %v, got %v", c.path, c.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		if class != c.class {
+			t.Fatalf("%s: expected class %s, got %s", c.path, c.class, class)
+		}
+	}
+}
+
+func TestFindEFIBinariesSkipsBroken(t *testing.T) {
+	b, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Point the certificate table at a signature which can't be parsed
+	broken := bytes.Clone(b)
+	dir := binary.LittleEndian.Uint32(broken[0x3c:]) + 24 + 112 + 4*8
+	binary.LittleEndian.PutUint32(broken[dir:], uint32(len(broken)))
+	binary.LittleEndian.PutUint32(broken[dir+4:], 16)
+	broken = append(broken, 16, 0, 0, 0, 0, 2, 2, 0, 1, 2, 3, 4, 5, 6, 7, 8)
+
+	state := &config.State{Fs: afero.NewMemMapFs(), Config: config.DefaultConfig()}
+	kh, err := backend.CreateKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/efi/EFI/BOOT/BOOTX64.EFI", b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/efi/EFI/Linux/broken.efi", broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+	binaries, err := FindEFIBinaries(state, kh, "/efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binaries) != 1 || binaries[0].Path != "/efi/EFI/BOOT/BOOTX64.EFI" {
+		t.Fatalf("unexpected binaries %+v", binaries)
+	}
+}
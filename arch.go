@@ -0,0 +1,90 @@
+package sbctl
+
+import (
+	"debug/pe"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrArchMismatch = errors.New("architecture mismatch")
+	ErrUnknownArch  = errors.New("unsupported architecture")
+)
+
+// EFIArch is an architecture EFI binaries are built for
+type EFIArch struct {
+	// Name is the name used by uname, except for ia32 which follows the
+	// naming of the EFI binaries
+	Name string
+	// Stub is the file name of the systemd-boot EFI stub
+	Stub    string
+	Machine uint16
+	// Aliases includes the name used by Go and the suffix of the EFI binaries
+	Aliases []string
+}
+
+var EFIArches = []EFIArch{
+	{"x86_64", "linuxx64.efi.stub", pe.IMAGE_FILE_MACHINE_AMD64, []string{"amd64", "x64"}},
+	{"aarch64", "linuxaa64.efi.stub", pe.IMAGE_FILE_MACHINE_ARM64, []string{"arm64", "aa64"}},
+	{"ia32", "linuxia32.efi.stub", pe.IMAGE_FILE_MACHINE_I386, []string{"386", "i386", "i686", "x86"}},
+	{"riscv64", "linuxriscv64.efi.stub", pe.IMAGE_FILE_MACHINE_RISCV64, nil},
+	{"loongarch64", "linuxloongarch64.efi.stub", pe.IMAGE_FILE_MACHINE_LOONGARCH64, []string{"loong64"}},
+}
+
+// ParseEFIArch returns the architecture by its name or one of the aliases
+func ParseEFIArch(name string) (*EFIArch, error) {
+	name = strings.ToLower(name)
+	for i, a := range EFIArches {
+		if a.Name == name || slices.Contains(a.Aliases, name) {
+			return &EFIArches[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownArch, name)
+}
+
+// HostEFIArch returns the architecture sbctl runs on
+func HostEFIArch() (*EFIArch, error) {
+	return ParseEFIArch(runtime.GOARCH)
+}
+
+// MachineName returns the architecture name of a PE machine type
+func MachineName(machine uint16) string {
+	for _, a := range EFIArches {
+		if a.Machine == machine {
+			return a.Name
+		}
+	}
+	return fmt.Sprintf("unknown (%#04x)", machine)
+}
+
+// PEMachine returns the machine type of the PE binary
+func PEMachine(vfs afero.Fs, path string) (uint16, error) {
+	f, err := vfs.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	p, err := pe.NewFile(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, ErrNotEFIBinary)
+	}
+	return p.Machine, nil
+}
+
+// CheckMachine returns ErrArchMismatch when the PE binary isn't built for the
+// architecture
+func CheckMachine(vfs afero.Fs, path string, arch *EFIArch) error {
+	machine, err := PEMachine(vfs, path)
+	if err != nil {
+		return err
+	}
+	if machine != arch.Machine {
+		return fmt.Errorf("%w: %s is built for %s, not %s", ErrArchMismatch, path, MachineName(machine), arch.Name)
+	}
+	return nil
+}
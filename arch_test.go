@@ -0,0 +1,70 @@
+package sbctl
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+func TestParseEFIArch(t *testing.T) {
+	for alias, name := range map[string]string{
+		"amd64": "x86_64", "x64": "x86_64", "arm64": "aarch64", "AA64": "aarch64",
+		"riscv64": "riscv64", "loong64": "loongarch64", "386": "ia32",
+	} {
+		arch, err := ParseEFIArch(alias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arch.Name != name {
+			t.Fatalf("%s: expected %s, got %s", alias, name, arch.Name)
+		}
+	}
+	if _, err := ParseEFIArch("sparc64"); !errors.Is(err, ErrUnknownArch) {
+		t.Fatalf("expected ErrUnknownArch, got %v", err)
+	}
+}
+
+func TestCheckMachine(t *testing.T) {
+	b, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs := afero.NewMemMapFs()
+	if err := fs.WriteFile(vfs, "/stub-x64.efi", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Change the machine type of the COFF header
+	riscv := bytes.Clone(b)
+	off := binary.LittleEndian.Uint32(riscv[0x3c:]) + 4
+	binary.LittleEndian.PutUint16(riscv[off:], pe.IMAGE_FILE_MACHINE_RISCV64)
+	if err := fs.WriteFile(vfs, "/stub-riscv64.efi", riscv, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(vfs, "/vmlinuz", []byte("not a PE binary"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	x64, _ := ParseEFIArch("x86_64")
+	riscv64, _ := ParseEFIArch("riscv64")
+	if err := CheckMachine(vfs, "/stub-x64.efi", x64); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMachine(vfs, "/stub-riscv64.efi", riscv64); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckMachine(vfs, "/stub-riscv64.efi", x64); !errors.Is(err, ErrArchMismatch) {
+		t.Fatalf("expected ErrArchMismatch, got %v", err)
+	}
+	if err := CheckMachine(vfs, "/vmlinuz", x64); !errors.Is(err, ErrNotEFIBinary) {
+		t.Fatalf("expected ErrNotEFIBinary, got %v", err)
+	}
+	if name := MachineName(0x1234); name != "unknown (0x1234)" {
+		t.Fatalf("unexpected name %s", name)
+	}
+}
@@ -0,0 +1,468 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+// Remote attestation of the Secure Boot state. The attestation key is a
+// primary key derived from the endorsement seed, so the TPM creates the same
+// key every time and a verifier can pin it.
+
+const AttestationVersion = 1
+
+var (
+	ErrAttestationSignature = errors.New("invalid quote signature")
+	ErrAttestationNonce     = errors.New("quote nonce does not match")
+	ErrAttestationPCRs      = errors.New("pcr values do not match the quote")
+	ErrAttestationKeys      = errors.New("enrolled keys differ from the keys measured at boot")
+	ErrAttestationPolicy    = errors.New("attestation does not satisfy the policy")
+	ErrAttestationKey       = errors.New("attestation key is not pinned")
+
+	// AttestationPCRs can be quoted. PCR 7 holds the Secure Boot state and is
+	// always quoted.
+	AttestationPCRs = []uint{4, 7, 11}
+)
+
+const evEFIVariableDriverConfig = "EV_EFI_VARIABLE_DRIVER_CONFIG"
+
+// akTemplate is a restricted ECC P-256 signing key, which can only sign data
+// generated by the TPM
+var akTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgECC,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		NoDA:                true,
+		Restricted:          true,
+		SignEncrypt:         true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(
+		tpm2.TPMAlgECC,
+		&tpm2.TPMSECCParms{
+			Symmetric: tpm2.TPMTSymDefObject{Algorithm: tpm2.TPMAlgNull},
+			Scheme: tpm2.TPMTECCScheme{
+				Scheme: tpm2.TPMAlgECDSA,
+				Details: tpm2.NewTPMUAsymScheme(
+					tpm2.TPMAlgECDSA,
+					&tpm2.TPMSSigSchemeECDSA{HashAlg: tpm2.TPMAlgSHA256},
+				),
+			},
+			CurveID: tpm2.TPMECCNistP256,
+			KDF:     tpm2.TPMTKDFScheme{Scheme: tpm2.TPMAlgNull},
+		},
+	),
+}
+
+// AttestationKeys are the SHA-256 fingerprints of the enrolled certificates
+type AttestationKeys struct {
+	PK  []string `json:"pk"`
+	KEK []string `json:"kek"`
+	Db  []string `json:"db"`
+}
+
+func (k AttestationKeys) Equal(o AttestationKeys) bool {
+	return slices.Equal(k.PK, o.PK) && slices.Equal(k.KEK, o.KEK) && slices.Equal(k.Db, o.Db)
+}
+
+// AttestationBundle is a quote with everything needed to verify it offline
+type AttestationBundle struct {
+	Version int `json:"version"`
+	// AK is the TPMT_PUBLIC of the attestation key
+	AK []byte `json:"ak"`
+	// Quote is the TPMS_ATTEST signed by the attestation key
+	Quote     []byte          `json:"quote"`
+	Signature []byte          `json:"signature"`
+	PCRs      map[uint]string `json:"pcrs"`
+	Eventlog  []byte          `json:"eventlog"`
+	Keys      AttestationKeys `json:"keys"`
+}
+
+// AttestationResult is the verified state of an attestation bundle
+type AttestationResult struct {
+	AK         string          `json:"ak"`
+	Nonce      string          `json:"nonce"`
+	PCRs       map[uint]string `json:"pcrs"`
+	SecureBoot bool            `json:"secure_boot"`
+	Keys       AttestationKeys `json:"keys"`
+}
+
+// Fingerprint normalizes a certificate fingerprint written with colons or in
+// upper case
+func Fingerprint(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, ":", ""))
+}
+
+func certFingerprints(sigdb *signature.SignatureDatabase) []string {
+	fingerprints := []string{}
+	for _, l := range *sigdb {
+		if l.SignatureType != signature.CERT_X509_GUID {
+			continue
+		}
+		for _, sig := range l.Signatures {
+			sum := sha256.Sum256(sig.Data)
+			fingerprints = append(fingerprints, hex.EncodeToString(sum[:]))
+		}
+	}
+	slices.Sort(fingerprints)
+	return fingerprints
+}
+
+// EnrolledKeys returns the fingerprints of the certificates in PK, KEK and db
+func EnrolledKeys(efistate *EFIVariables) AttestationKeys {
+	return AttestationKeys{
+		PK:  certFingerprints(efistate.PK),
+		KEK: certFingerprints(efistate.KEK),
+		Db:  certFingerprints(efistate.Db),
+	}
+}
+
+// eventlogKeys returns the Secure Boot state and keys measured into PCR 7
+func eventlogKeys(events []attest.Event) (bool, AttestationKeys, error) {
+	var secureBoot bool
+	keys := AttestationKeys{PK: []string{}, KEK: []string{}, Db: []string{}}
+	for _, event := range events {
+		if event.Index != 7 || event.Type.String() != evEFIVariableDriverConfig {
+			continue
+		}
+		name, value, err := parseVariableData(event.Data)
+		if err != nil {
+			return false, keys, err
+		}
+		var sigdb signature.SignatureDatabase
+		if name == "PK" || name == "KEK" || name == "db" {
+			if sigdb, err = signature.ReadSignatureDatabase(bytes.NewReader(value)); err != nil {
+				return false, keys, fmt.Errorf("failed parsing measured %s: %w", name, err)
+			}
+		}
+		switch name {
+		case "SecureBoot":
+			secureBoot = len(value) == 1 && value[0] == 1
+		case "PK":
+			keys.PK = certFingerprints(&sigdb)
+		case "KEK":
+			keys.KEK = certFingerprints(&sigdb)
+		case "db":
+			keys.Db = certFingerprints(&sigdb)
+		}
+	}
+	return secureBoot, keys, nil
+}
+
+func pcrSelection(pcrs []uint) tpm2.TPMLPCRSelection {
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{{
+			Hash:      tpm2.TPMAlgSHA256,
+			PCRSelect: tpm2.PCClientCompatible.PCRs(pcrs...),
+		}},
+	}
+}
+
+// Attest quotes the SHA-256 bank of the given PCRs, with the nonce supplied by
+// the verifier
+func Attest(tpm transport.TPM, nonce []byte, pcrs []uint, eventlog []byte, keys AttestationKeys) (*AttestationBundle, error) {
+	pcrs = append(slices.Clone(pcrs), 7)
+	slices.Sort(pcrs)
+	pcrs = slices.Compact(pcrs)
+	for _, pcr := range pcrs {
+		if !slices.Contains(AttestationPCRs, pcr) {
+			return nil, fmt.Errorf("pcr %d can't be quoted", pcr)
+		}
+	}
+
+	ak, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHEndorsement,
+		InPublic:      tpm2.New2B(akTemplate),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating the attestation key: %w", err)
+	}
+	defer tpm2.FlushContext{FlushHandle: ak.ObjectHandle}.Execute(tpm)
+
+	quote, err := tpm2.Quote{
+		SignHandle: tpm2.AuthHandle{
+			Handle: ak.ObjectHandle,
+			Name:   ak.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+		InScheme:       tpm2.TPMTSigScheme{Scheme: tpm2.TPMAlgNull},
+		PCRSelect:      pcrSelection(pcrs),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed quoting the pcrs: %w", err)
+	}
+
+	values, err := ReadPCRs(tpm, attest.HashSHA256, pcrs)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ak.OutPublic.Contents()
+	if err != nil {
+		return nil, err
+	}
+	bundle := &AttestationBundle{
+		Version:   AttestationVersion,
+		AK:        tpm2.Marshal(pub),
+		Quote:     quote.Quoted.Bytes(),
+		Signature: tpm2.Marshal(&quote.Signature),
+		PCRs:      map[uint]string{},
+		Eventlog:  eventlog,
+		Keys:      keys,
+	}
+	for _, pcr := range values {
+		bundle.PCRs[uint(pcr.Index)] = hex.EncodeToString(pcr.Digest)
+	}
+	return bundle, nil
+}
+
+// akPublicKey returns the public key of an attestation key. The attributes are
+// supplied by the bundle, so they don't prove the key is a TPM key. Only a
+// key pinned by the verifier can be trusted.
+func akPublicKey(b []byte) (*ecdsa.PublicKey, error) {
+	pub, err := tpm2.Unmarshal[tpm2.TPMTPublic](b)
+	if err != nil {
+		return nil, err
+	}
+	attrs := pub.ObjectAttributes
+	if pub.Type != tpm2.TPMAlgECC || !attrs.FixedTPM || !attrs.Restricted || !attrs.SignEncrypt {
+		return nil, errors.New("attestation key is not a restricted signing key")
+	}
+	parms, err := pub.Parameters.ECCDetail()
+	if err != nil {
+		return nil, err
+	}
+	if parms.CurveID != tpm2.TPMECCNistP256 {
+		return nil, fmt.Errorf("unsupported attestation key curve %v", parms.CurveID)
+	}
+	point, err := pub.Unique.ECC()
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(point.X.Buffer),
+		Y:     new(big.Int).SetBytes(point.Y.Buffer),
+	}, nil
+}
+
+// quotedPCRs returns the PCRs selected in the quote
+func quotedPCRs(sel tpm2.TPMLPCRSelection) ([]uint, error) {
+	var pcrs []uint
+	for _, s := range sel.PCRSelections {
+		if s.Hash != tpm2.TPMAlgSHA256 {
+			return nil, fmt.Errorf("unsupported quote bank %v", s.Hash)
+		}
+		for i, b := range s.PCRSelect {
+			for bit := range 8 {
+				if b&(1<<bit) != 0 {
+					pcrs = append(pcrs, uint(i*8+bit))
+				}
+			}
+		}
+	}
+	return pcrs, nil
+}
+
+// AKFingerprint returns the SHA-256 fingerprint of the attestation key of the
+// bundle, which is pinned by the verifier
+func (b *AttestationBundle) AKFingerprint() (string, error) {
+	key, err := akPublicKey(b.AK)
+	if err != nil {
+		return "", err
+	}
+	return akFingerprint(key)
+}
+
+func akFingerprint(key *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks the quote signature, the nonce when given, the PCR values and
+// replays the eventlog to find the Secure Boot state and keys measured at boot.
+// Anyone can create a key and sign a quote, so the attestation key needs to be
+// one of the pinned aks.
+func (b *AttestationBundle) Verify(nonce []byte, aks []string) (*AttestationResult, error) {
+	if b.Version != AttestationVersion {
+		return nil, fmt.Errorf("unsupported attestation bundle version %d", b.Version)
+	}
+	key, err := akPublicKey(b.AK)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := akFingerprint(key)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(aks, fingerprint) {
+		return nil, fmt.Errorf("%w: %s", ErrAttestationKey, fingerprint)
+	}
+	result := &AttestationResult{AK: fingerprint, PCRs: map[uint]string{}}
+
+	sig, err := tpm2.Unmarshal[tpm2.TPMTSignature](b.Signature)
+	if err != nil {
+		return nil, err
+	}
+	esig, err := sig.Signature.ECDSA()
+	if err != nil || sig.SigAlg != tpm2.TPMAlgECDSA || esig.Hash != tpm2.TPMAlgSHA256 {
+		return nil, fmt.Errorf("%w: unsupported signature scheme", ErrAttestationSignature)
+	}
+	digest := sha256.Sum256(b.Quote)
+	r := new(big.Int).SetBytes(esig.SignatureR.Buffer)
+	s := new(big.Int).SetBytes(esig.SignatureS.Buffer)
+	if !ecdsa.Verify(key, digest[:], r, s) {
+		return nil, ErrAttestationSignature
+	}
+
+	quote, err := tpm2.Unmarshal[tpm2.TPMSAttest](b.Quote)
+	if err != nil {
+		return nil, err
+	}
+	if quote.Type != tpm2.TPMSTAttestQuote {
+		return nil, errors.New("attestation is not a quote")
+	}
+	if nonce != nil && !bytes.Equal(quote.ExtraData.Buffer, nonce) {
+		return nil, ErrAttestationNonce
+	}
+	result.Nonce = hex.EncodeToString(quote.ExtraData.Buffer)
+	info, err := quote.Attested.Quote()
+	if err != nil {
+		return nil, err
+	}
+	pcrs, err := quotedPCRs(info.PCRSelect)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(pcrs, 7) {
+		return nil, errors.New("pcr 7 is not quoted")
+	}
+	if len(pcrs) != len(b.PCRs) {
+		return nil, fmt.Errorf("%w: the bundle has unquoted pcrs", ErrAttestationPCRs)
+	}
+	h := sha256.New()
+	var replay []attest.PCR
+	for _, pcr := range pcrs {
+		value, ok := b.PCRs[pcr]
+		if !ok {
+			return nil, fmt.Errorf("%w: pcr %d is missing", ErrAttestationPCRs, pcr)
+		}
+		d, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: pcr %d: %v", ErrAttestationPCRs, pcr, err)
+		}
+		h.Write(d)
+		result.PCRs[pcr] = value
+		if slices.Contains(firmwarePCRs, pcr) {
+			replay = append(replay, attest.PCR{Index: int(pcr), Digest: d, DigestAlg: tpmHashAlgs[attest.HashSHA256].hash})
+		}
+	}
+	if !bytes.Equal(h.Sum(nil), info.PCRDigest.Buffer) {
+		return nil, ErrAttestationPCRs
+	}
+
+	// Only the events of the quoted PCRs are trusted
+	log, err := attest.ParseEventLog(b.Eventlog)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing eventlog: %w", err)
+	}
+	events, err := log.Verify(replay)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEventlogReplay, err)
+	}
+	result.SecureBoot, result.Keys, err = eventlogKeys(events)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Keys.Equal(b.Keys) {
+		return nil, ErrAttestationKeys
+	}
+	return result, nil
+}
+
+// AttestationPolicy is the expected state of an attested machine. Every
+// fingerprint listed must be enrolled, and all listed PCRs must match.
+type AttestationPolicy struct {
+	// AK lists the accepted attestation keys, which are required to verify a
+	// bundle
+	AK         []string        `json:"ak,omitempty"`
+	SecureBoot bool            `json:"secure_boot,omitempty"`
+	PK         []string        `json:"pk,omitempty"`
+	KEK        []string        `json:"kek,omitempty"`
+	Db         []string        `json:"db,omitempty"`
+	PCRs       map[uint]string `json:"pcrs,omitempty"`
+}
+
+// ParseAttestationPolicy parses a policy in YAML or JSON
+func ParseAttestationPolicy(b []byte) (*AttestationPolicy, error) {
+	var p AttestationPolicy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	for _, l := range [][]string{p.AK, p.PK, p.KEK, p.Db} {
+		for i := range l {
+			l[i] = Fingerprint(l[i])
+		}
+	}
+	for pcr, value := range p.PCRs {
+		p.PCRs[pcr] = strings.ToLower(value)
+	}
+	return &p, nil
+}
+
+// Check returns the violations of the policy
+func (p *AttestationPolicy) Check(r *AttestationResult) []string {
+	var violations []string
+	if p.SecureBoot && !r.SecureBoot {
+		violations = append(violations, "secure boot is disabled")
+	}
+	for _, k := range []struct {
+		name     string
+		expected []string
+		enrolled []string
+	}{
+		{"PK", p.PK, r.Keys.PK},
+		{"KEK", p.KEK, r.Keys.KEK},
+		{"db", p.Db, r.Keys.Db},
+	} {
+		for _, f := range k.expected {
+			if !slices.Contains(k.enrolled, f) {
+				violations = append(violations, fmt.Sprintf("%s %s is not enrolled", k.name, f))
+			}
+		}
+	}
+	for _, pcr := range slices.Sorted(maps.Keys(p.PCRs)) {
+		value, ok := r.PCRs[pcr]
+		switch {
+		case !ok:
+			violations = append(violations, fmt.Sprintf("pcr %d is not quoted", pcr))
+		case value != p.PCRs[pcr]:
+			violations = append(violations, fmt.Sprintf("pcr %d is %s", pcr, value))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,129 @@
+package sbctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"github.com/spf13/afero"
+)
+
+func TestAttestation(t *testing.T) {
+	rwc, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+
+	eventlog, err := os.ReadFile("tests/tpm_eventlogs/t14_eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := ParseEventlog(afero.NewOsFs(), "tests/tpm_eventlogs/t14_eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	extendEventlog(t, rwc, log)
+	secureBoot, keys, err := eventlogKeys(log.Events(attest.HashSHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.PK) != 1 || len(keys.KEK) == 0 || len(keys.Db) == 0 {
+		t.Fatalf("unexpected measured keys %+v", keys)
+	}
+
+	nonce := []byte("nonce from the verifier")
+	bundle, err := Attest(rwc, nonce, []uint{4}, eventlog, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bundle.PCRs[7]; !ok || len(bundle.PCRs) != 2 {
+		t.Fatalf("unexpected quoted pcrs %v", bundle.PCRs)
+	}
+
+	// The bundle is verified after a round trip through JSON
+	b, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed AttestationBundle
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	ak, err := parsed.AKFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aks := []string{ak}
+	result, err := parsed.Verify(nonce, aks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.SecureBoot != secureBoot || !result.Keys.Equal(keys) {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// The attestation key is the same every time
+	again, err := Attest(rwc, nil, nil, eventlog, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := again.Verify(nil, aks); err != nil || r.AK != result.AK {
+		t.Fatalf("attestation key changed: %v", err)
+	}
+
+	// A quote signed by any other key is refused
+	if _, err := parsed.Verify(nonce, nil); !errors.Is(err, ErrAttestationKey) {
+		t.Fatalf("unpinned attestation key was accepted: %v", err)
+	}
+	if _, err := parsed.Verify(nonce, []string{"00"}); !errors.Is(err, ErrAttestationKey) {
+		t.Fatalf("wrong attestation key was accepted: %v", err)
+	}
+	if _, err := parsed.Verify([]byte("replayed nonce"), aks); !errors.Is(err, ErrAttestationNonce) {
+		t.Fatalf("wrong nonce was accepted: %v", err)
+	}
+	tampered := parsed
+	tampered.PCRs = map[uint]string{4: parsed.PCRs[4], 7: parsed.PCRs[4]}
+	if _, err := tampered.Verify(nonce, aks); !errors.Is(err, ErrAttestationPCRs) {
+		t.Fatalf("wrong pcr values were accepted: %v", err)
+	}
+	tampered = parsed
+	tampered.Keys = AttestationKeys{PK: keys.PK, KEK: keys.KEK, Db: keys.Db[1:]}
+	if _, err := tampered.Verify(nonce, aks); !errors.Is(err, ErrAttestationKeys) {
+		t.Fatalf("wrong keys were accepted: %v", err)
+	}
+	tampered = parsed
+	tampered.Signature = slices.Clone(parsed.Signature)
+	tampered.Signature[len(tampered.Signature)-1] ^= 0xff
+	if _, err := tampered.Verify(nonce, aks); !errors.Is(err, ErrAttestationSignature) {
+		t.Fatalf("wrong signature was accepted: %v", err)
+	}
+
+	policy, err := ParseAttestationPolicy([]byte(fmt.Sprintf(`
+ak: [%s]
+db:
+  - %s
+pcrs:
+  7: %s
+`, result.AK, keys.Db[0], result.PCRs[7])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := policy.Check(result); len(v) != 0 {
+		t.Fatalf("policy is not satisfied: %v", v)
+	}
+	policy.Db = append(policy.Db, "00")
+	policy.SecureBoot = true
+	want := []string{"db 00 is not enrolled"}
+	if !secureBoot {
+		want = slices.Insert(want, 0, "secure boot is disabled")
+	}
+	if v := policy.Check(result); !slices.Equal(v, want) {
+		t.Fatalf("unexpected violations %v", v)
+	}
+}
@@ -0,0 +1,193 @@
+package sbctl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+// The audit log is a file of JSON lines. Every entry includes the hash of the
+// previous entry, so removing or changing an entry breaks the chain. Removing
+// entries from the end can't be detected from the log alone, the hash of the
+// last entry has to be compared against a copy kept elsewhere.
+
+var ErrAuditLog = errors.New("audit log has been tampered with")
+
+// AuditVariable lists the signatures added to and removed from an EFI
+// variable. Certificates are listed by the SHA-256 fingerprint and hashes by
+// their value, prefixed with the signature type.
+type AuditVariable struct {
+	Variable string   `json:"variable"`
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+}
+
+type AuditEntry struct {
+	Seq      int       `json:"seq"`
+	Time     time.Time `json:"time"`
+	UID      int       `json:"uid"`
+	SudoUser string    `json:"sudo_user,omitempty"`
+	Command  string    `json:"command"`
+	Args     []string  `json:"args"`
+	// Keys are the fingerprints of the sbctl keys after the command, and
+	// PreviousKeys the ones they replaced
+	Keys         map[string]string `json:"keys,omitempty"`
+	PreviousKeys map[string]string `json:"previous_keys,omitempty"`
+	Variables    []AuditVariable   `json:"variables,omitempty"`
+	Result       string            `json:"result"`
+	Error        string            `json:"error,omitempty"`
+	Prev         string            `json:"prev"`
+	Hash         string            `json:"hash"`
+}
+
+func (e *AuditEntry) digest() (string, error) {
+	c := *e
+	c.Hash = ""
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// signatureEntries returns the entries of a signature database
+func signatureEntries(sigdb *signature.SignatureDatabase) []string {
+	entries := []string{}
+	if sigdb == nil {
+		return entries
+	}
+	for _, l := range *sigdb {
+		for _, sig := range l.Signatures {
+			switch l.SignatureType {
+			case signature.CERT_X509_GUID:
+				sum := sha256.Sum256(sig.Data)
+				entries = append(entries, "x509:"+hex.EncodeToString(sum[:]))
+			case signature.CERT_SHA256_GUID:
+				entries = append(entries, "sha256:"+hex.EncodeToString(sig.Data))
+			default:
+				sum := sha256.Sum256(sig.Data)
+				entries = append(entries, fmt.Sprintf("%s:%s", l.SignatureType.Format(), hex.EncodeToString(sum[:])))
+			}
+		}
+	}
+	slices.Sort(entries)
+	return entries
+}
+
+// AuditVariableDiff returns the changes between two states of the EFI
+// variables, variables which did not change are left out
+func AuditVariableDiff(before, after *EFIVariables) []AuditVariable {
+	var diff []AuditVariable
+	for _, v := range []struct {
+		name          string
+		before, after *signature.SignatureDatabase
+	}{
+		{"PK", before.PK, after.PK},
+		{"KEK", before.KEK, after.KEK},
+		{"db", before.Db, after.Db},
+		{"dbx", before.Dbx, after.Dbx},
+	} {
+		b, a := signatureEntries(v.before), signatureEntries(v.after)
+		d := AuditVariable{Variable: v.name}
+		for _, s := range a {
+			if !slices.Contains(b, s) {
+				d.Added = append(d.Added, s)
+			}
+		}
+		for _, s := range b {
+			if !slices.Contains(a, s) {
+				d.Removed = append(d.Removed, s)
+			}
+		}
+		if len(d.Added) > 0 || len(d.Removed) > 0 {
+			diff = append(diff, d)
+		}
+	}
+	return diff
+}
+
+// ReadAuditLog reads the audit log and verifies the hash chain. The entries
+// read before an invalid entry are returned together with the error.
+func ReadAuditLog(r io.Reader) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	prev := ""
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<24)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("%w: line %d: %v", ErrAuditLog, line, err)
+		}
+		digest, err := e.digest()
+		if err != nil {
+			return entries, err
+		}
+		switch {
+		case digest != e.Hash:
+			return entries, fmt.Errorf("%w: line %d: entry does not match its hash", ErrAuditLog, line)
+		case e.Prev != prev:
+			return entries, fmt.Errorf("%w: line %d: entry does not follow the previous entry", ErrAuditLog, line)
+		case e.Seq != len(entries)+1:
+			return entries, fmt.Errorf("%w: line %d: expected entry %d, got %d", ErrAuditLog, line, len(entries)+1, e.Seq)
+		}
+		entries = append(entries, e)
+		prev = e.Hash
+	}
+	return entries, s.Err()
+}
+
+// AppendAuditEntry chains the entry to the last entry of the audit log and
+// appends it
+func AppendAuditEntry(vfs afero.Fs, path string, e *AuditEntry) error {
+	b, err := fs.ReadFile(vfs, path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Refuse to extend a log which has already been tampered with
+	entries, err := ReadAuditLog(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	e.Seq = 1
+	e.Prev = ""
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		e.Seq = last.Seq + 1
+		e.Prev = last.Hash
+	}
+	if e.Hash, err = e.digest(); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(e); err != nil {
+		return err
+	}
+	if err := vfs.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := vfs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,64 @@
+package sbctl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+func TestAuditLog(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	path := "/var/lib/sbctl/audit.log"
+
+	db := signature.NewSignatureDatabase()
+	if err := db.Append(signature.CERT_SHA256_GUID, eventlogGUID, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	empty := &EFIVariables{}
+	enrolled := &EFIVariables{Db: db}
+
+	for _, cmd := range []string{"sbctl create-keys", "sbctl enroll-keys", "sbctl sign"} {
+		e := &AuditEntry{Command: cmd, Args: []string{}, Result: "ok"}
+		if cmd == "sbctl enroll-keys" {
+			e.Variables = AuditVariableDiff(empty, enrolled)
+		}
+		if err := AppendAuditEntry(vfs, path, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := fs.ReadFile(vfs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadAuditLog(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].Prev != entries[1].Hash {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if v := entries[1].Variables; len(v) != 1 || v[0].Variable != "db" || len(v[0].Added) != 1 {
+		t.Fatalf("unexpected variable diff %+v", v)
+	}
+
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	for name, tampered := range map[string][]byte{
+		"modified":  bytes.Join([][]byte{lines[0], bytes.Replace(lines[1], []byte("enroll-keys"), []byte("status"), 1), lines[2]}, nil),
+		"removed":   bytes.Join([][]byte{lines[0], lines[2]}, nil),
+		"reordered": bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil),
+	} {
+		if _, err := ReadAuditLog(bytes.NewReader(tampered)); !errors.Is(err, ErrAuditLog) {
+			t.Fatalf("%s entry was not detected: %v", name, err)
+		}
+		if err := fs.WriteFile(vfs, path, tampered, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := AppendAuditEntry(vfs, path, &AuditEntry{Command: "sbctl reset"}); !errors.Is(err, ErrAuditLog) {
+			t.Fatalf("appended to a log with a %s entry: %v", name, err)
+		}
+	}
+}
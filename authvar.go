@@ -0,0 +1,219 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"github.com/foxboron/sbctl/backend"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Time based authenticated variables include an EFI_TIME in the signed data.
+// Unless the update is appended, the firmware rejects an update which is not
+// later than the timestamp of the variable it replaces. This matters when the
+// updates are signed in advance, or when a variable is written twice within
+// the one second resolution of the timestamp.
+
+var (
+	ErrStaleTimestamp   = errors.New("the update is not newer than the enrolled variable")
+	ErrTimestampUnknown = errors.New("the timestamp of the variable is unknown")
+	ErrUpdateRejected   = errors.New("the firmware rejected the signed update")
+
+	lastEFITime   time.Time
+	lastEFITimeMu sync.Mutex
+)
+
+// EFITime converts t to an EFI_TIME in UTC. The nanosecond, time zone and
+// daylight fields must be zero in authenticated variables.
+func EFITime(t time.Time) util.EFITime {
+	t = t.UTC()
+	return util.EFITime{
+		Year:   uint16(t.Year()),
+		Month:  uint8(t.Month()),
+		Day:    uint8(t.Day()),
+		Hour:   uint8(t.Hour()),
+		Minute: uint8(t.Minute()),
+		Second: uint8(t.Second()),
+	}
+}
+
+func efiTimeToTime(t util.EFITime) time.Time {
+	return time.Date(int(t.Year), time.Month(t.Month), int(t.Day), int(t.Hour), int(t.Minute), int(t.Second), int(t.Nanosecond), time.UTC)
+}
+
+// FormatEFITime formats the timestamp as RFC 3339
+func FormatEFITime(t util.EFITime) string {
+	return efiTimeToTime(t).Format(time.RFC3339)
+}
+
+// CompareEFITime returns -1, 0 or 1 when a is before, equal to or after b
+func CompareEFITime(a, b util.EFITime) int {
+	return efiTimeToTime(a).Compare(efiTimeToTime(b))
+}
+
+// ParseEFITime parses a timestamp given as "now", RFC 3339 or Unix seconds
+// prefixed with @
+func ParseEFITime(s string) (util.EFITime, error) {
+	switch {
+	case s == "now":
+		return EFITime(time.Now()), nil
+	case strings.HasPrefix(s, "@"):
+		sec, err := strconv.ParseInt(s[1:], 10, 64)
+		if err != nil {
+			return util.EFITime{}, fmt.Errorf("invalid timestamp %q: %w", s, err)
+		}
+		return EFITime(time.Unix(sec, 0)), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return util.EFITime{}, fmt.Errorf("invalid timestamp %q, expected RFC 3339 or @<unix seconds>", s)
+	}
+	return EFITime(t), nil
+}
+
+// NextEFITime returns the current time, but always later than the time
+// returned by the previous call so repeated updates are not rejected
+func NextEFITime() util.EFITime {
+	lastEFITimeMu.Lock()
+	defer lastEFITimeMu.Unlock()
+	t := time.Now().UTC().Truncate(time.Second)
+	if !t.After(lastEFITime) {
+		t = lastEFITime.Add(time.Second)
+	}
+	lastEFITime = t
+	return EFITime(t)
+}
+
+// signerFor returns the key which signs updates of ev
+func signerFor(ev efivar.Efivar, hier *backend.KeyHierarchy) backend.KeyBackend {
+	switch ev {
+	case efivar.Db, efivar.Dbx:
+		return hier.GetKeyBackend(efivar.KEK)
+	}
+	return hier.GetKeyBackend(efivar.PK)
+}
+
+// SignVariable returns the time based authenticated update of ev signed by
+// the key of the hierarchy above it. The update is dated t, or the time given
+// by NextEFITime when t is zero.
+func SignVariable(ev efivar.Efivar, m efivar.Marshallable, hier *backend.KeyHierarchy, t util.EFITime) ([]byte, error) {
+	if t == (util.EFITime{}) {
+		t = NextEFITime()
+	}
+	signer := signerFor(ev, hier)
+
+	var data bytes.Buffer
+	m.Marshal(&data)
+
+	// The signed data is the name without the terminating NUL, the vendor
+	// GUID, the attributes, the timestamp and the value
+	var buf bytes.Buffer
+	for _, r := range ev.Name {
+		binary.Write(&buf, binary.LittleEndian, uint16(r))
+	}
+	binary.Write(&buf, binary.LittleEndian, *ev.GUID)
+	binary.Write(&buf, binary.LittleEndian, ev.Attributes)
+	binary.Write(&buf, binary.LittleEndian, t)
+	buf.Write(data.Bytes())
+
+	der, err := pkcs7.SignPKCS7(signer.Signer(), signer.Certificate(), pkcs7.OIDData, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// The authentication header contains the SignedData without the
+	// ContentInfo around it
+	cs := cryptobyte.String(der)
+	_, sig, err := pkcs7.ParseContentInfo(&cs)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := signature.NewEFIVariableAuthentication2()
+	auth.Time = t
+	auth.AuthInfo.Header.Length += uint32(len(sig))
+	auth.AuthInfo.CertData = sig
+
+	var out bytes.Buffer
+	auth.Marshal(&out)
+	out.Write(data.Bytes())
+	return out.Bytes(), nil
+}
+
+// signedUpdate is a signed update which is written as is
+type signedUpdate []byte
+
+func (s signedUpdate) Marshal(b *bytes.Buffer) {
+	b.Write(s)
+}
+
+func (s signedUpdate) Bytes() []byte {
+	return s
+}
+
+// AuthTimestamp returns the timestamp of a signed update, like the .auth files
+// exported by enroll-keys
+func AuthTimestamp(b []byte) (util.EFITime, error) {
+	var auth signature.EFIVariableAuthentication2
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &auth.Time); err != nil {
+		return util.EFITime{}, fmt.Errorf("not an authenticated variable: %w", err)
+	}
+	return auth.Time, nil
+}
+
+// timestampedEFIVars is implemented by variable stores which keep the
+// timestamps of authenticated variables. efivarfs doesn't expose them.
+type timestampedEFIVars interface {
+	GetVarTimestamp(e efivar.Efivar) (util.EFITime, error)
+}
+
+// VariableTimestamp returns the timestamp of the enrolled variable, or
+// ErrTimestampUnknown when the variable store doesn't keep it
+func VariableTimestamp(fs *efivarfs.Efivarfs, ev efivar.Efivar) (util.EFITime, error) {
+	ts, ok := fs.EFIVars.(timestampedEFIVars)
+	if !ok {
+		return util.EFITime{}, ErrTimestampUnknown
+	}
+	return ts.GetVarTimestamp(ev)
+}
+
+// CheckTimestamp returns ErrStaleTimestamp when the firmware would reject an
+// update of ev dated t. Nothing is checked when the timestamp of the enrolled
+// variable is unknown, or the variable is not enrolled.
+func CheckTimestamp(fs *efivarfs.Efivarfs, ev efivar.Efivar, t util.EFITime) error {
+	if ev.Attributes&attributes.EFI_VARIABLE_APPEND_WRITE != 0 {
+		return nil
+	}
+	enrolled, err := VariableTimestamp(fs, ev)
+	if errors.Is(err, ErrTimestampUnknown) || errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed reading the timestamp of %s: %w", ev.Name, err)
+	}
+	if CompareEFITime(t, enrolled) <= 0 {
+		return fmt.Errorf("%w: the %s update is dated %s, the enrolled %s is dated %s", ErrStaleTimestamp, ev.Name, FormatEFITime(t), ev.Name, FormatEFITime(enrolled))
+	}
+	return nil
+}
+
+// rejectedUpdate explains why the firmware refused a signed update. The
+// kernel returns EACCES for EFI_SECURITY_VIOLATION.
+func rejectedUpdate(ev efivar.Efivar, t util.EFITime, err error) error {
+	if !errors.Is(err, syscall.EACCES) {
+		return err
+	}
+	return fmt.Errorf("%w of %s: the update dated %s is either not signed by an enrolled key, or not newer than the enrolled %s: %w", ErrUpdateRejected, ev.Name, FormatEFITime(t), ev.Name, err)
+}
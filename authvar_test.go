@@ -0,0 +1,105 @@
+package sbctl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestParseEFITime(t *testing.T) {
+	for _, s := range []string{"2030-01-02T03:04:05Z", "2030-01-02T04:04:05+01:00", "@1893553445"} {
+		ts, err := ParseEFITime(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := FormatEFITime(ts); got != "2030-01-02T03:04:05Z" {
+			t.Fatalf("%s: got %s", s, got)
+		}
+	}
+	if _, err := ParseEFITime("yesterday"); err == nil {
+		t.Fatal("parsed an invalid timestamp")
+	}
+	if a, b := NextEFITime(), NextEFITime(); CompareEFITime(a, b) >= 0 {
+		t.Fatalf("%s is not before %s", FormatEFITime(a), FormatEFITime(b))
+	}
+}
+
+func TestSignVariableTimestamp(t *testing.T) {
+	state := &config.State{Fs: afero.NewMemMapFs(), Config: config.DefaultConfig()}
+	kh, err := backend.CreateKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := ParseOVMFVarStore(newOVMFVars(0x4000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	efistate := NewEFIVariables(store.Efivarfs())
+	if err := efistate.Db.Append(signature.CERT_X509_GUID, eventlogGUID, kh.Db.CertificateBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	future := EFITime(time.Now().AddDate(1, 0, 0))
+	b, err := SignVariable(efivar.Db, efistate.Db, kh, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts, err := AuthTimestamp(b); err != nil || ts != future {
+		t.Fatalf("unexpected timestamp %+v: %v", ts, err)
+	}
+	var auth signature.EFIVariableAuthentication2
+	if err := auth.Unmarshal(bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := auth.Verify(kh.KEK.Certificate()); err != nil || !ok {
+		t.Fatalf("update is not signed by the KEK: %v", err)
+	}
+
+	efistate.Timestamp = future
+	if err := efistate.EnrollKey(efivar.Db, kh); err != nil {
+		t.Fatal(err)
+	}
+	if ts, err := VariableTimestamp(store.Efivarfs(), efivar.Db); err != nil || ts != future {
+		t.Fatalf("unexpected timestamp of db %+v: %v", ts, err)
+	}
+
+	// Updates which are not newer than the variable are rejected
+	efistate.Timestamp = EFITime(time.Now())
+	if err := efistate.EnrollKey(efivar.Db, kh); !errors.Is(err, ErrStaleTimestamp) {
+		t.Fatalf("expected ErrStaleTimestamp, got %v", err)
+	}
+	if err := store.Efivarfs().WriteVar(efivar.Db, signedUpdate(b)); err == nil {
+		t.Fatal("replayed update was written")
+	} else if err := rejectedUpdate(efivar.Db, future, err); !errors.Is(err, ErrUpdateRejected) {
+		t.Fatalf("expected ErrUpdateRejected, got %v", err)
+	}
+
+	// Variables which are not enrolled can be written with any timestamp,
+	// but a store which can't be read fails the check
+	if err := CheckTimestamp(store.Efivarfs(), efivar.KEK, efistate.Timestamp); err != nil {
+		t.Fatalf("missing variable failed the check: %v", err)
+	}
+	broken := efivarfs.Open(brokenTimestamps{store.Efivarfs().EFIVars})
+	if err := CheckTimestamp(broken, efivar.Db, efistate.Timestamp); !errors.Is(err, errBrokenStore) {
+		t.Fatalf("expected errBrokenStore, got %v", err)
+	}
+}
+
+var errBrokenStore = errors.New("broken variable store")
+
+type brokenTimestamps struct {
+	efivarfs.EFIVars
+}
+
+func (brokenTimestamps) GetVarTimestamp(efivar.Efivar) (util.EFITime, error) {
+	return util.EFITime{}, errBrokenStore
+}
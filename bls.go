@@ -0,0 +1,241 @@
+package sbctl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+// Boot Loader Specification type #1 entries pointing at generated bundles.
+// https://uapi-group.org/specifications/specs/boot_loader_specification/
+
+var (
+	loaderEntriesDir = "loader/entries"
+	loaderConf       = "loader/loader.conf"
+)
+
+type BootEntry struct {
+	Path      string `json:"path"`
+	Title     string `json:"title"`
+	Version   string `json:"version,omitempty"`
+	MachineID string `json:"machine_id,omitempty"`
+	SortKey   string `json:"sort_key,omitempty"`
+	EFI       string `json:"efi"`
+}
+
+func (e *BootEntry) Bytes() []byte {
+	var b bytes.Buffer
+	for _, kv := range [][2]string{
+		{"title", e.Title},
+		{"version", e.Version},
+		{"machine-id", e.MachineID},
+		{"sort-key", e.SortKey},
+		{"efi", e.EFI},
+	} {
+		if kv[1] != "" {
+			fmt.Fprintf(&b, "%s %s\n", kv[0], kv[1])
+		}
+	}
+	return b.Bytes()
+}
+
+// ParseOSRelease parses an os-release file into its key value pairs
+func ParseOSRelease(vfs afero.Fs, path string) (map[string]string, error) {
+	b, err := fs.ReadFile(vfs, path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[k] = strings.Trim(v, `"'`)
+	}
+	return values, scanner.Err()
+}
+
+func (b *Bundle) espPath(state *config.State) (string, error) {
+	if b.ESP != "" {
+		return b.ESP, nil
+	}
+	return FindESP(state)
+}
+
+// bootEntryPath returns the path of the boot entry for a bundle output
+func bootEntryPath(esp, output string) string {
+	name := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+	return filepath.Join(esp, loaderEntriesDir, name+".conf")
+}
+
+// NewBootEntry creates the boot entry for a generated bundle. The bundle
+// output needs to be inside the ESP.
+func (b *Bundle) NewBootEntry(state *config.State) (*BootEntry, error) {
+	vfs := state.Fs
+	esp, err := b.espPath(state)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(esp, b.Output)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("bundle %s is not located in the ESP %s", b.Output, esp)
+	}
+
+	path := bootEntryPath(esp, b.Output)
+	if b.BootCounting > 0 {
+		path = withBootCounter(path, b.BootCounting)
+	}
+	entry := &BootEntry{
+		Path:    path,
+		Title:   "Linux",
+		Version: b.KernelVersion,
+		EFI:     "/" + filepath.ToSlash(rel),
+	}
+	if osrel, err := ParseOSRelease(vfs, b.OSRelease); err == nil {
+		for _, k := range []string{"PRETTY_NAME", "NAME"} {
+			if v := osrel[k]; v != "" {
+				entry.Title = v
+				break
+			}
+		}
+		for _, k := range []string{"IMAGE_ID", "ID"} {
+			if v := osrel[k]; v != "" {
+				entry.SortKey = v
+				break
+			}
+		}
+		if entry.Version == "" {
+			entry.Version = osrel["VERSION_ID"]
+		}
+	}
+	if id, err := GetMachineID(vfs); err == nil {
+		entry.MachineID = id
+	}
+	return entry, nil
+}
+
+// WriteBootEntry writes the boot entry of the bundle and updates the default
+// entry in loader.conf if requested.
+func WriteBootEntry(state *config.State, b *Bundle) (*BootEntry, error) {
+	vfs := state.Fs
+	entry, err := b.NewBootEntry(state)
+	if err != nil {
+		return nil, err
+	}
+	if err := vfs.MkdirAll(filepath.Dir(entry.Path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	esp, err := b.espPath(state)
+	if err != nil {
+		return nil, err
+	}
+	// Entries with a different boot counter are replaced by this one
+	if err := removeBootEntries(vfs, esp, b.Output, entry.Path); err != nil {
+		return nil, err
+	}
+	if err := fs.WriteFile(vfs, entry.Path, entry.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	if b.LoaderDefault {
+		if err := setLoaderDefault(vfs, esp, filepath.Base(bootEntryPath(esp, b.Output))); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+// RemoveBootEntry removes the boot entry of a bundle output, and the default
+// in loader.conf if it points at the entry.
+func RemoveBootEntry(vfs afero.Fs, esp, output string) error {
+	if err := removeBootEntries(vfs, esp, output, ""); err != nil {
+		return err
+	}
+	return unsetLoaderDefault(vfs, esp, filepath.Base(bootEntryPath(esp, output)))
+}
+
+// removeBootEntries removes the boot entry of a bundle output, with any boot
+// counter, except keep
+func removeBootEntries(vfs afero.Fs, esp, output, keep string) error {
+	entries, err := installedBundles(vfs, bootEntryPath(esp, output))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e == keep {
+			continue
+		}
+		if err := vfs.Remove(e); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateLoaderConf rewrites the default line of loader.conf and keeps
+// everything else as it is. An empty value removes the line.
+func updateLoaderConf(vfs afero.Fs, esp string, fn func(current string) (string, bool)) error {
+	path := filepath.Join(esp, loaderConf)
+	b, err := fs.ReadFile(vfs, path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var lines []string
+	var current string
+	idx := -1
+	if len(b) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	for i, line := range lines {
+		if k, v, _ := strings.Cut(strings.TrimSpace(line), " "); k == "default" {
+			current = strings.TrimSpace(v)
+			idx = i
+		}
+	}
+
+	value, ok := fn(current)
+	if !ok {
+		return nil
+	}
+	switch {
+	case value == "" && idx != -1:
+		lines = append(lines[:idx], lines[idx+1:]...)
+	case value == "":
+		return nil
+	case idx != -1:
+		lines[idx] = "default " + value
+	default:
+		lines = append([]string{"default " + value}, lines...)
+	}
+
+	if err := vfs.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return fs.WriteFile(vfs, path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func setLoaderDefault(vfs afero.Fs, esp, entry string) error {
+	return updateLoaderConf(vfs, esp, func(current string) (string, bool) {
+		return entry, current != entry
+	})
+}
+
+func unsetLoaderDefault(vfs afero.Fs, esp, entry string) error {
+	return updateLoaderConf(vfs, esp, func(current string) (string, bool) {
+		return "", current == entry
+	})
+}
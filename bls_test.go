@@ -0,0 +1,72 @@
+package sbctl
+
+import (
+	"testing"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestBootEntry(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for f, data := range map[string]string{
+		"/etc/machine-id":         "0123456789abcdef\n",
+		"/usr/lib/os-release":     "NAME=\"Arch Linux\"\nPRETTY_NAME=\"Arch Linux\"\nID=arch\n",
+		"/efi/loader/loader.conf": "timeout 3\ndefault old.conf\n",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle := &Bundle{
+		Output:        "/efi/EFI/Linux/arch-6.1.0.efi",
+		OSRelease:     "/usr/lib/os-release",
+		ESP:           "/efi",
+		BootEntry:     true,
+		LoaderDefault: true,
+		KernelVersion: "6.1.0",
+	}
+	state := &config.State{Fs: vfs, Config: config.DefaultConfig()}
+	entry, err := WriteBootEntry(state, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Path != "/efi/loader/entries/arch-6.1.0.conf" {
+		t.Fatalf("unexpected entry path %s", entry.Path)
+	}
+	b, err := afero.ReadFile(vfs, entry.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "title Arch Linux\nversion 6.1.0\nmachine-id 0123456789abcdef\nsort-key arch\nefi /EFI/Linux/arch-6.1.0.efi\n"
+	if string(b) != want {
+		t.Fatalf("unexpected entry:\n%s", b)
+	}
+	b, err = afero.ReadFile(vfs, "/efi/loader/loader.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "timeout 3\ndefault arch-6.1.0.conf\n" {
+		t.Fatalf("unexpected loader.conf:\n%s", b)
+	}
+
+	if err := RemoveBootEntry(vfs, "/efi", bundle.Output); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := afero.Exists(vfs, entry.Path); ok {
+		t.Fatalf("boot entry was not removed")
+	}
+	b, err = afero.ReadFile(vfs, "/efi/loader/loader.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "timeout 3\n" {
+		t.Fatalf("unexpected loader.conf:\n%s", b)
+	}
+
+	bundle.Output = "/boot/arch.efi"
+	if _, err := WriteBootEntry(state, bundle); err == nil {
+		t.Fatalf("expected error for bundle outside of the ESP")
+	}
+}
@@ -0,0 +1,446 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/efi/device"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+)
+
+// UEFI boot manager load options, Boot#### and BootOrder.
+// Section 3.1.3 Load Options
+
+const LoadOptionActive uint32 = 0x00000001
+
+var ErrNoLoadOption = errors.New("load option does not exist")
+
+type LoadOption struct {
+	Number       uint16 `json:"number"`
+	Attributes   uint32 `json:"attributes"`
+	Description  string `json:"description"`
+	FilePath     []byte `json:"-"`
+	OptionalData []byte `json:"-"`
+}
+
+func (l *LoadOption) Name() string {
+	return fmt.Sprintf("Boot%04X", l.Number)
+}
+
+func (l *LoadOption) Active() bool {
+	return l.Attributes&LoadOptionActive != 0
+}
+
+// Path returns the device path of the load option in the text representation
+// used by the UEFI shell and efibootmgr.
+func (l *LoadOption) Path() string {
+	return FormatDevicePath(l.FilePath)
+}
+
+// File returns the file path of the load option, or an empty string.
+func (l *LoadOption) File() string {
+	var file string
+	walkDevicePath(l.FilePath, func(h device.EFIDevicePath, data []byte) {
+		if h.Type == device.MediaDevicePath && h.SubType == device.FilePathDevicePath {
+			file += decodeUTF16(data)
+		}
+	})
+	return file
+}
+
+func (l *LoadOption) Marshal(b *bytes.Buffer) {
+	binary.Write(b, binary.LittleEndian, l.Attributes)
+	binary.Write(b, binary.LittleEndian, uint16(len(l.FilePath)))
+	b.Write(util.MarshalUtf16Var(l.Description))
+	b.Write(l.FilePath)
+	b.Write(l.OptionalData)
+}
+
+func (l *LoadOption) Bytes() []byte {
+	var b bytes.Buffer
+	l.Marshal(&b)
+	return b.Bytes()
+}
+
+func (l *LoadOption) Unmarshal(b *bytes.Buffer) error {
+	// Deleted variables are empty
+	if b.Len() == 0 {
+		return ErrNoLoadOption
+	}
+	var length uint16
+	if err := binary.Read(b, binary.LittleEndian, &l.Attributes); err != nil {
+		return fmt.Errorf("can't parse load option: %w", err)
+	}
+	if err := binary.Read(b, binary.LittleEndian, &length); err != nil {
+		return fmt.Errorf("can't parse load option: %w", err)
+	}
+	var desc []uint16
+	for {
+		var c uint16
+		if err := binary.Read(b, binary.LittleEndian, &c); err != nil {
+			return fmt.Errorf("can't parse load option description: %w", err)
+		}
+		if c == 0 {
+			break
+		}
+		desc = append(desc, c)
+	}
+	l.Description = string(utf16.Decode(desc))
+	l.FilePath = make([]byte, length)
+	if _, err := io.ReadFull(b, l.FilePath); err != nil {
+		return fmt.Errorf("can't parse load option device path: %w", err)
+	}
+	l.OptionalData = b.Bytes()
+	return nil
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// walkDevicePath calls fn with every node of a device path until the end
+// node
+func walkDevicePath(path []byte, fn func(h device.EFIDevicePath, data []byte)) {
+	for len(path) >= 4 {
+		h := device.EFIDevicePath{
+			Type:    device.DevicePathType(path[0]),
+			SubType: device.DevicePathSubType(path[1]),
+			Length:  [2]uint8{path[2], path[3]},
+		}
+		n := int(binary.LittleEndian.Uint16(h.Length[:]))
+		if h.Type == device.EndOfHardwareDevicePath || n < 4 || n > len(path) {
+			return
+		}
+		fn(h, path[4:n])
+		path = path[n:]
+	}
+}
+
+// Device path nodes not known by go-uefi
+const (
+	piwgFirmwareVolume  device.DevicePathSubType = 7
+	relativeOffsetRange device.DevicePathSubType = 8
+	nvmeNamespace       device.DevicePathSubType = 23
+	// EISA ID of PNP0A03
+	pciRootHID = 0x0a0341d0
+)
+
+// FormatDevicePath formats the device path nodes sbctl creates and the ones
+// found in the TPM eventlog, and falls back to the node type for everything
+// else.
+func FormatDevicePath(path []byte) string {
+	var nodes []string
+	walkDevicePath(path, func(h device.EFIDevicePath, data []byte) {
+		switch {
+		case h.Type == device.MediaDevicePath && h.SubType == device.HardDriveDevicePath && len(data) == 38:
+			// GPT partitions with a GUID signature
+			if data[36] == 0x02 && data[37] == 0x02 {
+				nodes = append(nodes, fmt.Sprintf("HD(%d,GPT,%s,0x%x,0x%x)",
+					binary.LittleEndian.Uint32(data[0:]),
+					formatGUID(data[20:36]),
+					binary.LittleEndian.Uint64(data[4:]),
+					binary.LittleEndian.Uint64(data[12:])))
+				return
+			}
+		case h.Type == device.MediaDevicePath && h.SubType == device.FilePathDevicePath:
+			nodes = append(nodes, fmt.Sprintf("File(%s)", decodeUTF16(data)))
+			return
+		case h.Type == device.MediaDevicePath && h.SubType == device.PIWGFirmwareDevicePath && len(data) == 16:
+			nodes = append(nodes, fmt.Sprintf("FvFile(%s)", formatGUID(data)))
+			return
+		case h.Type == device.MediaDevicePath && h.SubType == piwgFirmwareVolume && len(data) == 16:
+			nodes = append(nodes, fmt.Sprintf("Fv(%s)", formatGUID(data)))
+			return
+		case h.Type == device.MediaDevicePath && h.SubType == relativeOffsetRange && len(data) == 20:
+			// Option ROMs are located by their offset in the PCI ROM
+			nodes = append(nodes, fmt.Sprintf("Offset(0x%x,0x%x)",
+				binary.LittleEndian.Uint64(data[4:]),
+				binary.LittleEndian.Uint64(data[12:])))
+			return
+		case h.Type == device.ACPI && h.SubType == device.ACPIDevice && len(data) == 8:
+			hid, uid := binary.LittleEndian.Uint32(data[0:]), binary.LittleEndian.Uint32(data[4:])
+			if hid == pciRootHID {
+				nodes = append(nodes, fmt.Sprintf("PciRoot(0x%x)", uid))
+			} else {
+				nodes = append(nodes, fmt.Sprintf("Acpi(0x%x,0x%x)", hid, uid))
+			}
+			return
+		case h.Type == device.MessagingDevicePath && h.SubType == nvmeNamespace && len(data) == 12:
+			eui := make([]string, 8)
+			for i, b := range data[4:] {
+				eui[i] = fmt.Sprintf("%02X", b)
+			}
+			nodes = append(nodes, fmt.Sprintf("NVMe(0x%x,%s)", binary.LittleEndian.Uint32(data), strings.Join(eui, "-")))
+			return
+		case h.Type == device.Hardware && h.SubType == device.HardwarePCI && len(data) == 2:
+			nodes = append(nodes, fmt.Sprintf("Pci(0x%x,0x%x)", data[1], data[0]))
+			return
+		}
+		nodes = append(nodes, fmt.Sprintf("Path(%d,%d)", h.Type, h.SubType))
+	})
+	return strings.Join(nodes, "/")
+}
+
+// Partition is the location of a GPT partition on its disk
+type Partition struct {
+	Number     uint32
+	Start      uint64
+	Size       uint64
+	UUID       string
+	SectorSize uint64
+}
+
+// parseGUID returns the on-disk encoding of a GUID, where the first three
+// fields are little endian
+func parseGUID(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("invalid GUID %s", s)
+	}
+	slices.Reverse(b[0:4])
+	slices.Reverse(b[4:6])
+	slices.Reverse(b[6:8])
+	return b, nil
+}
+
+func formatGUID(b []byte) string {
+	g := slices.Clone(b)
+	slices.Reverse(g[0:4])
+	slices.Reverse(g[4:6])
+	slices.Reverse(g[6:8])
+	return fmt.Sprintf("%x-%x-%x-%x-%x", g[0:4], g[4:6], g[6:8], g[8:10], g[10:16])
+}
+
+func devicePathNode(b *bytes.Buffer, t device.DevicePathType, st device.DevicePathSubType, data []byte) {
+	b.WriteByte(byte(t))
+	b.WriteByte(byte(st))
+	binary.Write(b, binary.LittleEndian, uint16(4+len(data)))
+	b.Write(data)
+}
+
+// NewLoadOption creates a load option for file on the partition. The file path
+// is relative to the root of the partition.
+func NewLoadOption(description string, part *Partition, file string) (*LoadOption, error) {
+	guid, err := parseGUID(part.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if part.SectorSize == 0 {
+		return nil, fmt.Errorf("invalid sector size of partition %s", part.UUID)
+	}
+
+	var hd bytes.Buffer
+	binary.Write(&hd, binary.LittleEndian, part.Number)
+	binary.Write(&hd, binary.LittleEndian, part.Start/part.SectorSize)
+	binary.Write(&hd, binary.LittleEndian, part.Size/part.SectorSize)
+	hd.Write(guid)
+	// GPT partition with a GUID signature
+	hd.Write([]byte{0x02, 0x02})
+
+	file = "\\" + strings.TrimLeft(strings.ReplaceAll(filepath.ToSlash(file), "/", "\\"), "\\")
+
+	var path bytes.Buffer
+	devicePathNode(&path, device.MediaDevicePath, device.HardDriveDevicePath, hd.Bytes())
+	devicePathNode(&path, device.MediaDevicePath, device.FilePathDevicePath, util.MarshalUtf16Var(file))
+	devicePathNode(&path, device.EndOfHardwareDevicePath, device.NoNewDevicePath, nil)
+
+	return &LoadOption{
+		Attributes:  LoadOptionActive,
+		Description: description,
+		FilePath:    path.Bytes(),
+	}, nil
+}
+
+func bootVar(number uint16) efivar.Efivar {
+	v := efivar.BootEntry
+	v.Name = fmt.Sprintf("Boot%04X", number)
+	return v
+}
+
+// ParseBootNumber parses a load option number like 0001 or Boot0001
+func ParseBootNumber(s string) (uint16, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "Boot"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid boot entry %s", s)
+	}
+	return uint16(n), nil
+}
+
+func GetLoadOption(e *efivarfs.Efivarfs, number uint16) (*LoadOption, error) {
+	opt := &LoadOption{}
+	if err := e.GetVar(bootVar(number), opt); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoLoadOption
+		}
+		return nil, err
+	}
+	opt.Number = number
+	return opt, nil
+}
+
+func WriteLoadOption(e *efivarfs.Efivarfs, opt *LoadOption) error {
+	return e.WriteVar(bootVar(opt.Number), opt)
+}
+
+type bootOrder []uint16
+
+func (b *bootOrder) Unmarshal(buf *bytes.Buffer) error {
+	for buf.Len() >= 2 {
+		*b = append(*b, binary.LittleEndian.Uint16(buf.Next(2)))
+	}
+	return nil
+}
+
+func (b bootOrder) Marshal(buf *bytes.Buffer) {
+	binary.Write(buf, binary.LittleEndian, []uint16(b))
+}
+
+func (b bootOrder) Bytes() []byte {
+	var buf bytes.Buffer
+	b.Marshal(&buf)
+	return buf.Bytes()
+}
+
+func GetBootOrder(e *efivarfs.Efivarfs) ([]uint16, error) {
+	var order bootOrder
+	if err := e.GetVar(efivar.BootOrder, &order); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return order, nil
+}
+
+func WriteBootOrder(e *efivarfs.Efivarfs, order []uint16) error {
+	return e.WriteVar(efivar.BootOrder, bootOrder(order))
+}
+
+// GetBootCurrent returns the load option the system was booted from
+func GetBootCurrent(e *efivarfs.Efivarfs) (uint16, error) {
+	var current bootOrder
+	if err := e.GetVar(efivar.BootCurrent, &current); err != nil {
+		return 0, err
+	}
+	if len(current) != 1 {
+		return 0, errors.New("invalid BootCurrent")
+	}
+	return current[0], nil
+}
+
+// GetLoadOptions returns the load options in BootOrder
+func GetLoadOptions(e *efivarfs.Efivarfs) ([]*LoadOption, error) {
+	order, err := GetBootOrder(e)
+	if err != nil {
+		return nil, err
+	}
+	var opts []*LoadOption
+	for _, n := range order {
+		opt, err := GetLoadOption(e, n)
+		if errors.Is(err, ErrNoLoadOption) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed reading Boot%04X: %w", n, err)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// FindLoadOption returns the load option in BootOrder which boots the same
+// device path
+func FindLoadOption(e *efivarfs.Efivarfs, path []byte) (*LoadOption, error) {
+	opts, err := GetLoadOptions(e)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if bytes.Equal(opt.FilePath, path) {
+			return opt, nil
+		}
+	}
+	return nil, ErrNoLoadOption
+}
+
+// freeBootNumber returns the lowest load option number not in use
+func freeBootNumber(e *efivarfs.Efivarfs) (uint16, error) {
+	for n := uint16(0); n < 0xffff; n++ {
+		_, err := GetLoadOption(e, n)
+		if errors.Is(err, ErrNoLoadOption) {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return 0, errors.New("no free boot entry number")
+}
+
+// AddLoadOption writes opt to a free Boot#### variable and adds it to
+// BootOrder, in front of the other entries if first is set. Existing entries
+// booting the same device path are reused.
+func AddLoadOption(e *efivarfs.Efivarfs, opt *LoadOption, first bool) (*LoadOption, error) {
+	existing, err := FindLoadOption(e, opt.FilePath)
+	switch {
+	case err == nil:
+		opt.Number = existing.Number
+	case errors.Is(err, ErrNoLoadOption):
+		if opt.Number, err = freeBootNumber(e); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	if err := WriteLoadOption(e, opt); err != nil {
+		return nil, fmt.Errorf("failed writing %s: %w", opt.Name(), err)
+	}
+
+	order, err := GetBootOrder(e)
+	if err != nil {
+		return nil, err
+	}
+	order = slices.DeleteFunc(order, func(n uint16) bool { return n == opt.Number })
+	if first {
+		order = append([]uint16{opt.Number}, order...)
+	} else {
+		order = append(order, opt.Number)
+	}
+	if err := WriteBootOrder(e, order); err != nil {
+		return nil, fmt.Errorf("failed writing BootOrder: %w", err)
+	}
+	return opt, nil
+}
+
+// RemoveLoadOption deletes the Boot#### variable and removes it from BootOrder
+func RemoveLoadOption(e *efivarfs.Efivarfs, number uint16) error {
+	if _, err := GetLoadOption(e, number); err != nil {
+		return err
+	}
+	order, err := GetBootOrder(e)
+	if err != nil {
+		return err
+	}
+	if i := slices.Index(order, number); i != -1 {
+		if err := WriteBootOrder(e, slices.Delete(order, i, i+1)); err != nil {
+			return fmt.Errorf("failed writing BootOrder: %w", err)
+		}
+	}
+	// Writing an empty variable deletes it
+	return e.WriteVar(bootVar(number), bootOrder(nil))
+}
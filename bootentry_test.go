@@ -0,0 +1,78 @@
+package sbctl
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efivarfs/testfs"
+)
+
+func TestLoadOption(t *testing.T) {
+	part := &Partition{
+		Number:     1,
+		Start:      1048576,
+		Size:       536870912,
+		UUID:       "0f6b4c3d-1a2b-4c5d-8e9f-a0b1c2d3e4f5",
+		SectorSize: 512,
+	}
+	opt, err := NewLoadOption("Arch Linux", part, "EFI/Linux/arch.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `HD(1,GPT,0f6b4c3d-1a2b-4c5d-8e9f-a0b1c2d3e4f5,0x800,0x100000)/File(\EFI\Linux\arch.efi)`
+	if opt.Path() != want {
+		t.Fatalf("expected %s, got %s", want, opt.Path())
+	}
+
+	var parsed LoadOption
+	if err := parsed.Unmarshal(bytes.NewBuffer(opt.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Description != "Arch Linux" || !parsed.Active() || !bytes.Equal(parsed.FilePath, opt.FilePath) {
+		t.Fatalf("unexpected load option %+v", parsed)
+	}
+
+	e := testfs.NewTestFS().Open()
+	first, err := AddLoadOption(e, opt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Name() != "Boot0000" {
+		t.Fatalf("unexpected boot entry %s", first.Name())
+	}
+
+	other, err := NewLoadOption("Fallback", part, `\EFI\BOOT\BOOTX64.EFI`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddLoadOption(e, other, true); err != nil {
+		t.Fatal(err)
+	}
+	order, err := GetBootOrder(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(order, []uint16{1, 0}) {
+		t.Fatalf("unexpected BootOrder %v", order)
+	}
+
+	// Adding the same path again reuses the entry
+	again, err := NewLoadOption("Arch Linux", part, "EFI/Linux/arch.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err = AddLoadOption(e, again, true); err != nil {
+		t.Fatal(err)
+	}
+	if again.Number != 0 {
+		t.Fatalf("expected Boot0000 to be reused, got %s", again.Name())
+	}
+	opts, err := GetLoadOptions(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != 2 || opts[0].File() != `\EFI\Linux\arch.efi` || opts[1].Description != "Fallback" {
+		t.Fatalf("unexpected load options %+v", opts)
+	}
+}
@@ -1,13 +1,19 @@
 package sbctl
 
 import (
+	"bytes"
 	"debug/pe"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/fs"
@@ -25,6 +31,30 @@ type Bundle struct {
 	OSRelease      string `json:"os_release"`
 	EFIStub        string `json:"efi_stub"`
 	ESP            string `json:"esp"`
+	// Architecture the bundle is built for, the architecture of the host
+	// when empty
+	Arch string `json:"arch,omitempty"`
+	// Write a boot loader entry for the bundle into the ESP, and optionally
+	// make it the default entry of systemd-boot
+	BootEntry     bool `json:"boot_entry,omitempty"`
+	LoaderDefault bool `json:"loader_default,omitempty"`
+	// Number of boot attempts for systemd-boot boot counting, and whether the
+	// currently installed bundle is kept as a fallback
+	BootCounting int  `json:"boot_counting,omitempty"`
+	KeepPrevious bool `json:"keep_previous,omitempty"`
+	// Devicetrees included in the bundle. A single devicetree without
+	// hardware IDs is always loaded, otherwise the EFI stub selects the
+	// devicetree by the hardware IDs of the machine.
+	Devicetrees []Devicetree `json:"devicetrees,omitempty"`
+	// Outputs generated from the bundle. Only these are removed once the
+	// bundle no longer generates them.
+	Generated []string `json:"generated,omitempty"`
+	// The bundle is defined in the configuration file. The database entry
+	// only records the outputs generated from it.
+	FromConfig bool `json:"from_config,omitempty"`
+
+	// Kernel version of a bundle expanded from a template
+	KernelVersion string `json:"-"`
 }
 
 type Bundles map[string]*Bundle
@@ -56,58 +86,583 @@ func WriteBundleDatabase(vfs afero.Fs, dbpath string, bundles Bundles) error {
 	return nil
 }
 
-func BundleIter(state *config.State, fn func(s *Bundle) error) error {
+// BundleFromConfig creates a bundle from the configuration file. Unset
+// values are taken from the defaults of NewBundle.
+func BundleFromConfig(state *config.State, c *config.BundleConfig) (*Bundle, error) {
+	vfs := state.Fs
+	bundle, err := NewBundle(state)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Output = c.Output
+	bundle.IntelMicrocode = c.IntelMicrocode
+	bundle.AMDMicrocode = c.AMDMicrocode
+	bundle.Splash = c.Splash
+	bundle.BootEntry = c.BootEntry
+	bundle.LoaderDefault = c.LoaderDefault
+	bundle.BootCounting = c.BootCounting
+	bundle.KeepPrevious = c.KeepPrevious
+	for _, d := range c.Devicetrees {
+		bundle.Devicetrees = append(bundle.Devicetrees, Devicetree(*d))
+	}
+	if c.Arch != "" {
+		arch, err := ParseEFIArch(c.Arch)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Arch = arch.Name
+		if bundle.EFIStub, err = GetEfistubArch(vfs, arch); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range []struct {
+		dst *string
+		src string
+	}{
+		{&bundle.KernelImage, c.KernelImage},
+		{&bundle.Initramfs, c.Initramfs},
+		{&bundle.Cmdline, c.Cmdline},
+		{&bundle.OSRelease, c.OSRelease},
+		{&bundle.EFIStub, c.EFIStub},
+		{&bundle.ESP, c.ESP},
+	} {
+		if v.src != "" {
+			*v.dst = v.src
+		}
+	}
+	return bundle, nil
+}
+
+// BundleConfig returns the bundle as it is written in the configuration file
+func (b *Bundle) BundleConfig() *config.BundleConfig {
+	var dtbs []*config.DevicetreeConfig
+	for _, d := range b.Devicetrees {
+		dtb := config.DevicetreeConfig(d)
+		dtbs = append(dtbs, &dtb)
+	}
+	return &config.BundleConfig{
+		Output:         b.Output,
+		IntelMicrocode: b.IntelMicrocode,
+		AMDMicrocode:   b.AMDMicrocode,
+		KernelImage:    b.KernelImage,
+		Initramfs:      b.Initramfs,
+		Cmdline:        b.Cmdline,
+		Splash:         b.Splash,
+		OSRelease:      b.OSRelease,
+		EFIStub:        b.EFIStub,
+		ESP:            b.ESP,
+		Arch:           b.Arch,
+		BootEntry:      b.BootEntry,
+		LoaderDefault:  b.LoaderDefault,
+		BootCounting:   b.BootCounting,
+		KeepPrevious:   b.KeepPrevious,
+		Devicetrees:    dtbs,
+	}
+}
+
+var bootCounterRe = regexp.MustCompile(`\+\d+(-\d+)?$`)
+
+const previousSuffix = "-previous"
+
+// withBootCounter adds a systemd-boot boot counter, like +3-0, to the file name
+func withBootCounter(path string, tries int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s+%d-0%s", strings.TrimSuffix(path, ext), tries, ext)
+}
+
+// InstallPath returns the path the bundle is written to. With boot counting
+// the counter is part of the file name, unless a boot entry is written. Boot
+// entries carry the counter themselves.
+func (b *Bundle) InstallPath() string {
+	if b.BootCounting > 0 && !b.BootEntry {
+		return withBootCounter(b.Output, b.BootCounting)
+	}
+	return b.Output
+}
+
+// PreviousPath returns the path of the fallback copy of the bundle
+func (b *Bundle) PreviousPath() string {
+	ext := filepath.Ext(b.Output)
+	return strings.TrimSuffix(b.Output, ext) + previousSuffix + ext
+}
+
+// installedBundles returns the installed copies of the bundle output, with
+// or without a boot counter. Bundles which have been booted successfully lost
+// their counter and are returned first.
+func installedBundles(vfs afero.Fs, output string) ([]string, error) {
+	var installed []string
+	if ok, _ := afero.Exists(vfs, output); ok {
+		installed = append(installed, output)
+	}
+	ext := filepath.Ext(output)
+	matches, err := afero.Glob(vfs, strings.TrimSuffix(output, ext)+"+*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		if bootCounterRe.MatchString(strings.TrimSuffix(m, ext)) {
+			installed = append(installed, m)
+		}
+	}
+	return installed, nil
+}
+
+// Placeholders that can be used in the paths of a bundle
+const (
+	PlaceholderKernelVersion = "{kernel_version}"
+	PlaceholderMachineID     = "{machine_id}"
+	PlaceholderEntryToken    = "{entry_token}"
+)
+
+var (
+	machineIDPath  = "/etc/machine-id"
+	entryTokenPath = "/etc/kernel/entry-token"
+	modulesDir     = "/usr/lib/modules"
+)
+
+func (b *Bundle) paths() []*string {
+	paths := []*string{
+		&b.Output, &b.IntelMicrocode, &b.AMDMicrocode, &b.KernelImage,
+		&b.Initramfs, &b.Cmdline, &b.Splash, &b.OSRelease, &b.EFIStub,
+	}
+	for i := range b.Devicetrees {
+		paths = append(paths, &b.Devicetrees[i].Path)
+	}
+	return paths
+}
+
+func (b *Bundle) hasPlaceholder(p string) bool {
+	return slices.ContainsFunc(b.paths(), func(s *string) bool {
+		return strings.Contains(*s, p)
+	})
+}
+
+func (b *Bundle) replace(old, new string) {
+	// Copies of a bundle share the devicetrees
+	b.Devicetrees = slices.Clone(b.Devicetrees)
+	for _, p := range b.paths() {
+		*p = strings.ReplaceAll(*p, old, new)
+	}
+}
+
+// GetMachineID returns the machine id of the system
+func GetMachineID(vfs afero.Fs) (string, error) {
+	b, err := fs.ReadFile(vfs, machineIDPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// GetEntryToken returns the entry token used by kernel-install to name boot
+// entries. It defaults to the machine id.
+func GetEntryToken(vfs afero.Fs) (string, error) {
+	b, err := fs.ReadFile(vfs, entryTokenPath)
+	if err == nil && len(bytes.TrimSpace(b)) > 0 {
+		return strings.TrimSpace(string(b)), nil
+	}
+	return GetMachineID(vfs)
+}
+
+// InstalledKernels returns the versions of all kernels with modules in
+// /usr/lib/modules or an image in /boot/vmlinuz-<version>.
+func InstalledKernels(vfs afero.Fs) ([]string, error) {
+	var versions []string
+	entries, err := afero.ReadDir(vfs, modulesDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			versions = append(versions, e.Name())
+		}
+	}
+	images, err := afero.Glob(vfs, "/boot/vmlinuz-*")
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		versions = append(versions, strings.TrimPrefix(image, "/boot/vmlinuz-"))
+	}
+	slices.Sort(versions)
+	return slices.Compact(versions), nil
+}
+
+// Expand returns the bundles described by a bundle template. Placeholders for
+// the machine id and entry token are replaced, and bundles using the kernel
+// version placeholder are expanded to one bundle for every installed kernel
+// which has a kernel image. Bundles without placeholders are returned as-is.
+func (b *Bundle) Expand(vfs afero.Fs) ([]*Bundle, error) {
+	bundle, err := b.expandSystem(vfs)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bundle.hasPlaceholder(PlaceholderKernelVersion) {
+		return bundle.expandGlob(vfs)
+	}
+	if !strings.Contains(bundle.Output, PlaceholderKernelVersion) {
+		return nil, fmt.Errorf("output %s needs to contain %s", bundle.Output, PlaceholderKernelVersion)
+	}
+
+	versions, err := InstalledKernels(vfs)
+	if err != nil {
+		return nil, err
+	}
+	var bundles []*Bundle
+	for _, version := range versions {
+		kb := *bundle
+		kb.replace(PlaceholderKernelVersion, version)
+		kb.KernelVersion = version
+		// Module directories of removed kernels can linger around
+		if ok, _ := afero.Exists(vfs, kb.KernelImage); !ok {
+			continue
+		}
+		bundles = append(bundles, &kb)
+	}
+	return bundles, nil
+}
+
+func (b *Bundle) expandSystem(vfs afero.Fs) (*Bundle, error) {
+	bundle := *b
+	if bundle.hasPlaceholder(PlaceholderMachineID) {
+		id, err := GetMachineID(vfs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read machine id: %w", err)
+		}
+		bundle.replace(PlaceholderMachineID, id)
+	}
+	if bundle.hasPlaceholder(PlaceholderEntryToken) {
+		token, err := GetEntryToken(vfs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry token: %w", err)
+		}
+		bundle.replace(PlaceholderEntryToken, token)
+	}
+	return &bundle, nil
+}
+
+// expandGlob returns one bundle for every kernel matched by a kernel image
+// glob, like /boot/vmlinuz-*. The part matched by * is substituted into any *
+// in the initramfs and output paths.
+func (b *Bundle) expandGlob(vfs afero.Fs) ([]*Bundle, error) {
+	if !strings.ContainsAny(b.KernelImage, "*?[") {
+		return []*Bundle{b}, nil
+	}
+	prefix, suffix, _ := strings.Cut(b.KernelImage, "*")
+	if strings.Count(b.KernelImage, "*") != 1 || strings.ContainsAny(b.KernelImage, "?[") || strings.Contains(suffix, "/") {
+		return nil, fmt.Errorf("kernel image %s can only contain a single * in the file name", b.KernelImage)
+	}
+	if !strings.Contains(b.Output, "*") {
+		return nil, fmt.Errorf("output %s needs to contain * when the kernel image is a glob", b.Output)
+	}
+
+	matches, err := afero.Glob(vfs, b.KernelImage)
+	if err != nil {
+		return nil, err
+	}
+	var bundles []*Bundle
+	for _, match := range matches {
+		version := strings.TrimSuffix(strings.TrimPrefix(match, prefix), suffix)
+		bundle := *b
+		bundle.KernelImage = match
+		bundle.Initramfs = strings.ReplaceAll(b.Initramfs, "*", version)
+		bundle.Output = strings.ReplaceAll(b.Output, "*", version)
+		bundle.KernelVersion = version
+		bundles = append(bundles, &bundle)
+	}
+	return bundles, nil
+}
+
+// Claims reports whether the output is generated by the bundle, or could be
+// generated by it for another kernel version
+func (b *Bundle) Claims(vfs afero.Fs, output string) (bool, error) {
+	bundle, err := b.expandSystem(vfs)
+	if err != nil {
+		return false, err
+	}
+	pattern := strings.ReplaceAll(bundle.Output, PlaceholderKernelVersion, "*")
+	if pattern == output {
+		return true, nil
+	}
+	return filepath.Match(pattern, output)
+}
+
+// OwnedOutputs returns the outputs the bundle generates and the outputs it is
+// recorded as having generated. Outputs any of the other bundles claim are
+// left out.
+func (b *Bundle) OwnedOutputs(vfs afero.Fs, bundles Bundles) ([]string, error) {
+	outputs, err := b.GeneratedOutputs(vfs)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, b.Generated...)
+	slices.Sort(outputs)
+	return b.unclaimed(vfs, slices.Compact(outputs), bundles)
+}
+
+// RemovedOutputs returns the outputs a bundle which was removed from the
+// configuration file generated. Outputs any of the bundles claim are left out.
+func (b *Bundle) RemovedOutputs(vfs afero.Fs, bundles Bundles) ([]string, error) {
+	return b.unclaimed(vfs, b.Generated, bundles)
+}
+
+// unclaimed returns the outputs none of the other bundles claim
+func (b *Bundle) unclaimed(vfs afero.Fs, outputs []string, bundles Bundles) ([]string, error) {
+	var owned []string
+	var err error
+	for _, output := range outputs {
+		claimed := false
+		for key, other := range bundles {
+			if key == b.Output {
+				continue
+			}
+			if claimed, err = other.Claims(vfs, output); err != nil {
+				return nil, err
+			} else if claimed {
+				break
+			}
+		}
+		if !claimed {
+			owned = append(owned, output)
+		}
+	}
+	return owned, nil
+}
+
+// StaleOutputs returns the outputs the bundle is recorded as having generated,
+// but no longer generates, like the bundles of kernels which are no longer
+// installed. Outputs another bundle claims are never stale.
+func (b *Bundle) StaleOutputs(vfs afero.Fs, bundles Bundles) ([]string, error) {
+	owned, err := b.OwnedOutputs(vfs, bundles)
+	if err != nil {
+		return nil, err
+	}
+	current, err := b.GeneratedOutputs(vfs)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(owned, func(output string) bool {
+		return slices.Contains(current, output)
+	}), nil
+}
+
+// GeneratedOutputs returns the outputs the bundle currently generates
+func (b *Bundle) GeneratedOutputs(vfs afero.Fs) ([]string, error) {
+	expanded, err := b.Expand(vfs)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []string
+	for _, e := range expanded {
+		outputs = append(outputs, e.Output)
+	}
+	return outputs, nil
+}
+
+// OutputFiles returns the installed files of an output, with any boot counter,
+// and its fallback copy
+func OutputFiles(vfs afero.Fs, output string) ([]string, error) {
+	files, err := installedBundles(vfs, output)
+	if err != nil {
+		return nil, err
+	}
+	previous := (&Bundle{Output: output}).PreviousPath()
+	if ok, _ := afero.Exists(vfs, previous); ok {
+		files = append(files, previous)
+	}
+	return files, nil
+}
+
+// RecordGenerated records the outputs generated from the bundles in the bundle
+// database. Bundles from the configuration file are written to the database
+// marked as such, so their outputs are known as well. The entries of bundles
+// removed from the configuration file are dropped, their outputs need to be
+// removed first.
+func RecordGenerated(state *config.State, bundles Bundles) error {
+	db, err := ReadBundleDatabase(state.Fs, state.Config.BundlesDb)
+	if err != nil {
+		return err
+	}
+	for key, e := range db {
+		if _, ok := bundles[key]; e.FromConfig && !ok {
+			delete(db, key)
+		}
+	}
+	for key, b := range bundles {
+		if e, ok := db[key]; ok && !e.FromConfig {
+			e.Generated = b.Generated
+		} else if b.FromConfig {
+			db[key] = b
+		}
+	}
+	return WriteBundleDatabase(state.Fs, state.Config.BundlesDb, db)
+}
+
+// ReconcileBundleDatabase updates bundles to contain exactly the bundles
+// declared in the configuration. They are marked as bundles from the
+// configuration file and keep their generated outputs. Removed bundles which
+// generated outputs are kept as removed configuration bundles until the
+// outputs are removed. The outputs of the bundles which were added, changed or
+// removed are returned.
+func ReconcileBundleDatabase(state *config.State, bundles Bundles, desired []*config.BundleConfig) (added, changed, removed []string, err error) {
+	declared := map[string]bool{}
+	for _, c := range desired {
+		bundle, err := BundleFromConfig(state, c)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bundle.FromConfig = true
+		declared[bundle.Output] = true
+		current, ok := bundles[bundle.Output]
+		switch {
+		case !ok:
+			added = append(added, bundle.Output)
+		case !reflect.DeepEqual(current.BundleConfig(), bundle.BundleConfig()):
+			changed = append(changed, bundle.Output)
+		}
+		if ok {
+			bundle.Generated = current.Generated
+		}
+		bundles[bundle.Output] = bundle
+	}
+	for key, b := range bundles {
+		if declared[key] {
+			continue
+		}
+		// Entries of removed configuration bundles are no longer used
+		if !b.FromConfig {
+			removed = append(removed, key)
+		}
+		if len(b.Generated) > 0 {
+			b.FromConfig = true
+		} else {
+			delete(bundles, key)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(changed)
+	slices.Sort(removed)
+	return added, changed, removed, nil
+}
+
+// ReadBundles returns the bundles from the bundle database and the
+// configuration file. Bundles from the configuration take precedence over
+// database entries with the same output.
+func ReadBundles(state *config.State) (Bundles, error) {
 	files, err := ReadBundleDatabase(state.Fs, state.Config.BundlesDb)
+	if err != nil {
+		return nil, err
+	}
+	// Entries of bundles from the configuration file only record their
+	// generated outputs
+	generated := map[string][]string{}
+	for key, b := range files {
+		if b.FromConfig {
+			generated[key] = b.Generated
+			delete(files, key)
+		}
+	}
+	for _, c := range state.Config.Bundles {
+		bundle, err := BundleFromConfig(state, c)
+		if err != nil {
+			return nil, err
+		}
+		bundle.FromConfig = true
+		bundle.Generated = generated[bundle.Output]
+		if b, ok := files[bundle.Output]; ok && bundle.Generated == nil {
+			bundle.Generated = b.Generated
+		}
+		files[bundle.Output] = bundle
+	}
+	return files, nil
+}
+
+// RemovedBundles returns the entries of the bundle database of bundles which
+// were removed from the configuration file. They are only kept to record the
+// outputs they generated, which are all stale.
+func RemovedBundles(state *config.State) (Bundles, error) {
+	db, err := ReadBundleDatabase(state.Fs, state.Config.BundlesDb)
+	if err != nil {
+		return nil, err
+	}
+	declared := map[string]bool{}
+	for _, c := range state.Config.Bundles {
+		bundle, err := BundleFromConfig(state, c)
+		if err != nil {
+			return nil, err
+		}
+		declared[bundle.Output] = true
+	}
+	removed := Bundles{}
+	for key, b := range db {
+		if b.FromConfig && !declared[key] {
+			removed[key] = b
+		}
+	}
+	return removed, nil
+}
+
+// BundleIter calls fn for all bundles from ReadBundles, with templates
+// expanded.
+func BundleIter(state *config.State, fn func(s *Bundle) error) error {
+	files, err := ReadBundles(state)
 	if err != nil {
 		return err
 	}
-	for _, s := range files {
-		if err := fn(s); err != nil {
+	for _, b := range files {
+		bundles, err := b.Expand(state.Fs)
+		if err != nil {
 			return err
 		}
+		for _, s := range bundles {
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func efiStubArch() (string, error) {
-	switch runtime.GOARCH {
-	case "amd64":
-		return "linuxx64.efi.stub", nil
-	case "arm64":
-		return "linuxaa64.efi.stub", nil
-	case "386":
-		return "linuxia32.efi.stub", nil
+// EFIArch returns the architecture the bundle is built for
+func (b *Bundle) EFIArch() (*EFIArch, error) {
+	if b.Arch == "" {
+		return HostEFIArch()
 	}
-
-	return "", fmt.Errorf("unsupported architecture")
+	return ParseEFIArch(b.Arch)
 }
 
 func GetEfistub(vfs afero.Fs) (string, error) {
-	candidatePaths := []string{
-		"/lib/systemd/boot/efi/",
-		"/lib/gummiboot/",
-	}
-	stubName, err := efiStubArch()
+	arch, err := HostEFIArch()
 	if err != nil {
 		return "", fmt.Errorf("cannot search for EFI stub: %v", err)
 	}
+	return GetEfistubArch(vfs, arch)
+}
 
+// GetEfistubArch returns the systemd-boot EFI stub for the architecture, or
+// an empty path when it isn't installed
+func GetEfistubArch(vfs afero.Fs, arch *EFIArch) (string, error) {
+	candidatePaths := []string{
+		"/lib/systemd/boot/efi/",
+		"/lib/gummiboot/",
+	}
 	for _, f := range candidatePaths {
-		if _, err := vfs.Stat(f + stubName); err == nil {
-			return f + stubName, nil
+		if _, err := vfs.Stat(f + arch.Stub); err == nil {
+			return f + arch.Stub, nil
 		}
 	}
 	return "", nil
 }
 
-func NewBundle(vfs afero.Fs) (bundle *Bundle, err error) {
-	esp, err := GetESP(vfs)
+func NewBundle(state *config.State) (bundle *Bundle, err error) {
+	esp, err := FindESP(state)
 	if err != nil {
 		// This is not critical, just use an empty default.
 		esp = ""
 	}
 
-	stub, err := GetEfistub(vfs)
+	stub, err := GetEfistub(state.Fs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get default EFI stub location: %v", err)
 	}
@@ -139,16 +694,64 @@ func GenerateBundle(vfs afero.Fs, bundle *Bundle) (bool, error) {
 	sections := []section{
 		{".osrel", bundle.OSRelease},
 		{".cmdline", bundle.Cmdline},
-		{".splash", bundle.Splash},
-		{".initrd", bundle.Initramfs},
-		{".linux", bundle.KernelImage},
 	}
 
+	// objcopy can't tell sections with the same name apart, the .dtbauto
+	// sections are added with unique names and renamed afterwards
+	renames := map[string]string{}
+	switch {
+	case len(bundle.Devicetrees) == 1 && len(bundle.Devicetrees[0].HWIDs) == 0 && len(bundle.Devicetrees[0].DMI) == 0:
+		sections = append(sections, section{".dtb", bundle.Devicetrees[0].Path})
+	case len(bundle.Devicetrees) > 0:
+		for i, d := range bundle.Devicetrees {
+			name := fmt.Sprintf(".dtbx%03d", i)
+			renames[name] = ".dtbauto"
+			sections = append(sections, section{name, d.Path})
+		}
+		hwids, err := hwidsSection(vfs, bundle.Devicetrees)
+		if err != nil {
+			return false, err
+		}
+		if hwids != nil {
+			tmpFile, err := afero.TempFile(vfs, "/var/tmp", "hwids-")
+			if err != nil {
+				return false, err
+			}
+			defer vfs.Remove(tmpFile.Name())
+			_, err = tmpFile.Write(hwids)
+			tmpFile.Close()
+			if err != nil {
+				return false, err
+			}
+			sections = append(sections, section{".hwids", tmpFile.Name()})
+		}
+	}
+
+	sections = append(sections,
+		section{".splash", bundle.Splash},
+		section{".initrd", bundle.Initramfs},
+		section{".linux", bundle.KernelImage},
+	)
+
 	if bundle.EFIStub == "" {
 		return false, fmt.Errorf("could not find EFI stub binary, please install systemd-boot or provide --efi-stub on the command line")
 	}
 
-	e, err := pe.Open(bundle.EFIStub)
+	// The stub and the kernel have to be built for the architecture of the
+	// bundle
+	arch, err := bundle.EFIArch()
+	if err != nil {
+		return false, err
+	}
+	if err := CheckMachine(vfs, bundle.EFIStub, arch); err != nil {
+		return false, fmt.Errorf("invalid EFI stub: %w", err)
+	}
+	// Only kernels built with the EFI stub are PE binaries
+	if err := CheckMachine(vfs, bundle.KernelImage, arch); err != nil && !errors.Is(err, ErrNotEFIBinary) {
+		return false, fmt.Errorf("invalid kernel image: %w", err)
+	}
+
+	e, err := pe.Open(RealPath(vfs, bundle.EFIStub))
 	if err != nil {
 		return false, err
 	}
@@ -185,14 +788,14 @@ func GenerateBundle(vfs afero.Fs, bundle *Bundle) (bool, error) {
 			flags = "data,readonly"
 		}
 		args = append(args,
-			"--add-section", fmt.Sprintf("%s=%s", s.section, s.file),
+			"--add-section", fmt.Sprintf("%s=%s", s.section, RealPath(vfs, s.file)),
 			"--set-section-flags", fmt.Sprintf("%s=%s", s.section, flags),
 			"--change-section-vma", fmt.Sprintf("%s=%#x", s.section, vma),
 		)
 		vma += roundUpToBlockSize(uint64(fi.Size()))
 	}
 
-	args = append(args, bundle.EFIStub, bundle.Output)
+	args = append(args, RealPath(vfs, bundle.EFIStub), RealPath(vfs, bundle.Output))
 	cmd := exec.Command("objcopy", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -204,9 +807,47 @@ func GenerateBundle(vfs afero.Fs, bundle *Bundle) (bool, error) {
 			return exitError.ExitCode() == 0, nil
 		}
 	}
+	if len(renames) > 0 {
+		if err := renameSections(vfs, bundle.Output, renames); err != nil {
+			return false, err
+		}
+	}
 	return true, nil
 }
 
+// renameSections changes the names of sections in the section table of a PE
+// binary. The new names can't be longer than 8 bytes.
+func renameSections(vfs afero.Fs, path string, renames map[string]string) error {
+	f, err := vfs.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := pe.NewFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, ErrNotEFIBinary)
+	}
+	var hdr [4]byte
+	if _, err := f.ReadAt(hdr[:], 0x3c); err != nil {
+		return err
+	}
+	// The section table follows the PE signature, the COFF header and the
+	// optional header
+	off := int64(binary.LittleEndian.Uint32(hdr[:])) + 4 + 20 + int64(p.SizeOfOptionalHeader)
+	for i, s := range p.Sections {
+		name, ok := renames[s.Name]
+		if !ok {
+			continue
+		}
+		var b [8]byte
+		copy(b[:], name)
+		if _, err := f.WriteAt(b[:], off+int64(i)*40); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
 func roundUpToBlockSize(size uint64) uint64 {
 	const blockSize = 4096
 	return ((size + blockSize - 1) / blockSize) * blockSize
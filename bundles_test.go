@@ -0,0 +1,211 @@
+package sbctl
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestExpandBundle(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for _, f := range []string{
+		"/boot/vmlinuz-linux",
+		"/boot/vmlinuz-linux-lts",
+		"/boot/initramfs-linux.img",
+		"/boot/initramfs-linux-lts.img",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle := &Bundle{
+		Output:      "/efi/EFI/Linux/*.efi",
+		KernelImage: "/boot/vmlinuz-*",
+		Initramfs:   "/boot/initramfs-*.img",
+	}
+	bundles, err := bundle.Expand(vfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundles) != 2 {
+		t.Fatalf("expected 2 bundles, got %d", len(bundles))
+	}
+	for i, want := range []Bundle{
+		{Output: "/efi/EFI/Linux/linux.efi", KernelImage: "/boot/vmlinuz-linux", Initramfs: "/boot/initramfs-linux.img", KernelVersion: "linux"},
+		{Output: "/efi/EFI/Linux/linux-lts.efi", KernelImage: "/boot/vmlinuz-linux-lts", Initramfs: "/boot/initramfs-linux-lts.img", KernelVersion: "linux-lts"},
+	} {
+		if !reflect.DeepEqual(*bundles[i], want) {
+			t.Fatalf("expected %+v, got %+v", want, *bundles[i])
+		}
+	}
+
+	bundle.Output = "/efi/EFI/Linux/linux.efi"
+	if _, err := bundle.Expand(vfs); err == nil {
+		t.Fatalf("expected error for output without *")
+	}
+}
+
+func TestExpandBundleTemplate(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for f, data := range map[string]string{
+		"/etc/machine-id":                                 "0123456789abcdef\n",
+		"/usr/lib/modules/6.1.0-arch1/vmlinuz":            "",
+		"/usr/lib/modules/6.6.0-arch1/vmlinuz":            "",
+		"/usr/lib/modules/6.0.0-arch1/modules.dep":        "",
+		"/efi/EFI/Linux/0123456789abcdef-6.1.0-arch1.efi": "",
+		"/efi/EFI/Linux/0123456789abcdef-6.0.0-arch1.efi": "",
+		"/efi/EFI/Linux/other.efi":                        "",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle := &Bundle{
+		Output:      "/efi/EFI/Linux/{entry_token}-{kernel_version}.efi",
+		KernelImage: "/usr/lib/modules/{kernel_version}/vmlinuz",
+		Initramfs:   "/boot/initramfs-{kernel_version}.img",
+	}
+	bundles, err := bundle.Expand(vfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []Bundle{
+		{Output: "/efi/EFI/Linux/0123456789abcdef-6.1.0-arch1.efi", KernelImage: "/usr/lib/modules/6.1.0-arch1/vmlinuz", Initramfs: "/boot/initramfs-6.1.0-arch1.img", KernelVersion: "6.1.0-arch1"},
+		{Output: "/efi/EFI/Linux/0123456789abcdef-6.6.0-arch1.efi", KernelImage: "/usr/lib/modules/6.6.0-arch1/vmlinuz", Initramfs: "/boot/initramfs-6.6.0-arch1.img", KernelVersion: "6.6.0-arch1"},
+	} {
+		if i >= len(bundles) || !reflect.DeepEqual(*bundles[i], want) {
+			t.Fatalf("expected %+v, got %+v", want, bundles)
+		}
+	}
+	if len(bundles) != 2 {
+		t.Fatalf("expected 2 bundles, got %d", len(bundles))
+	}
+
+	// Only recorded outputs are stale, and never the ones another bundle
+	// generates
+	bundle.Generated = []string{
+		"/efi/EFI/Linux/0123456789abcdef-6.1.0-arch1.efi",
+		"/efi/EFI/Linux/0123456789abcdef-6.0.0-arch1.efi",
+		"/efi/EFI/Linux/0123456789abcdef-6.0.0-arch1-fallback.efi",
+	}
+	fallback := &Bundle{
+		Output:      "/efi/EFI/Linux/{entry_token}-{kernel_version}-fallback.efi",
+		KernelImage: "/usr/lib/modules/{kernel_version}/vmlinuz",
+	}
+	all := Bundles{bundle.Output: bundle, fallback.Output: fallback}
+	stale, err := bundle.StaleOutputs(vfs, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0] != "/efi/EFI/Linux/0123456789abcdef-6.0.0-arch1.efi" {
+		t.Fatalf("unexpected stale bundles: %v", stale)
+	}
+	bundle.Generated = nil
+	if stale, err := bundle.StaleOutputs(vfs, all); err != nil || len(stale) != 0 {
+		t.Fatalf("unrecorded outputs are stale: %v %v", stale, err)
+	}
+
+	// A glob output never claims the outputs of other bundles
+	glob := &Bundle{Output: "/efi/EFI/Linux/*.efi", KernelImage: "/boot/vmlinuz-*", Generated: []string{"/efi/EFI/Linux/other.efi"}}
+	other := &Bundle{Output: "/efi/EFI/Linux/other.efi", KernelImage: "/boot/vmlinuz-other"}
+	if stale, err := glob.StaleOutputs(vfs, Bundles{glob.Output: glob, other.Output: other}); err != nil || len(stale) != 0 {
+		t.Fatalf("another bundle's output is stale: %v %v", stale, err)
+	}
+}
+
+func TestInstallBundleBootCounting(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for f, data := range map[string]string{
+		"/efi/EFI/Linux/arch.efi":      "booted",
+		"/efi/EFI/Linux/arch+1-2.efi":  "failing",
+		"/efi/EFI/Linux/.arch.efi-tmp": "new",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle := &Bundle{
+		Output:       "/efi/EFI/Linux/arch.efi",
+		BootCounting: 3,
+		KeepPrevious: true,
+	}
+	if err := installBundle(vfs, bundle, "/efi/EFI/Linux/.arch.efi-tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	for f, want := range map[string]string{
+		"/efi/EFI/Linux/arch+3-0.efi":      "new",
+		"/efi/EFI/Linux/arch-previous.efi": "booted",
+	} {
+		b, err := afero.ReadFile(vfs, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("expected %s to contain %q, got %q", f, want, b)
+		}
+	}
+	for _, f := range []string{"/efi/EFI/Linux/arch.efi", "/efi/EFI/Linux/arch+1-2.efi", "/efi/EFI/Linux/.arch.efi-tmp"} {
+		if ok, _ := afero.Exists(vfs, f); ok {
+			t.Fatalf("%s was not removed", f)
+		}
+	}
+}
+
+func TestRemovedBundles(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	state := &config.State{Fs: vfs, Config: config.DefaultConfig()}
+	state.Config.ESP = []string{"/efi"}
+	state.Config.Bundles = []*config.BundleConfig{{Output: "/efi/EFI/Linux/arch.efi"}}
+	db := Bundles{
+		"/efi/EFI/Linux/arch.efi": {Output: "/efi/EFI/Linux/arch.efi", FromConfig: true, Generated: []string{"/efi/EFI/Linux/arch.efi"}},
+		"/efi/EFI/Linux/*.efi": {
+			Output:     "/efi/EFI/Linux/*.efi",
+			FromConfig: true,
+			Generated:  []string{"/efi/EFI/Linux/arch.efi", "/efi/EFI/Linux/6.6.efi"},
+		},
+		"/efi/EFI/Linux/db.efi": {Output: "/efi/EFI/Linux/db.efi"},
+	}
+	if err := WriteBundleDatabase(vfs, state.Config.BundlesDb, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bundles removed from the configuration are only recorded
+	bundles, err := ReadBundles(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bundles["/efi/EFI/Linux/*.efi"]; ok || len(bundles) != 2 {
+		t.Fatalf("unexpected bundles %v", bundles)
+	}
+	removed, err := RemovedBundles(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	glob, ok := removed["/efi/EFI/Linux/*.efi"]
+	if !ok || len(removed) != 1 {
+		t.Fatalf("unexpected removed bundles %v", removed)
+	}
+	// All outputs are stale, except the ones the remaining bundles claim
+	stale, err := glob.RemovedOutputs(vfs, bundles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stale, []string{"/efi/EFI/Linux/6.6.efi"}) {
+		t.Fatalf("unexpected stale outputs %v", stale)
+	}
+
+	// The entries are dropped once the outputs are removed
+	if err := RecordGenerated(state, bundles); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := RemovedBundles(state); err != nil || len(removed) != 0 {
+		t.Fatalf("removed bundles were kept: %v %v", removed, err)
+	}
+}
@@ -3,8 +3,10 @@ package certs
 import (
 	"embed"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/foxboron/go-uefi/efi/signature"
 	"github.com/foxboron/go-uefi/efi/util"
@@ -18,6 +20,7 @@ var (
 	oemGUID      = map[string]util.EFIGUID{
 		"microsoft":    *util.StringToGUID("77fa9abd-0359-4d32-bd60-28f4e78f784b"),
 		"tpm-eventlog": *util.StringToGUID("4f52704f-494d-41736e-6e6f79696e6721"),
+		"pci-oprom":    *util.StringToGUID("a3b7c07a-6d1e-4b8e-9f2f-5c0e3d2a9b41"),
 		"custom":       *util.StringToGUID("88a69775-5ad7-45d9-9f34-cec43e1f1989"),
 	}
 )
@@ -83,6 +86,11 @@ func GetDefaultCerts(variable string) (*signature.SignatureDatabase, error) {
 	return sigdb, nil
 }
 
+// KnownVendors returns the vendors DetectVendorCerts can find
+func KnownVendors() []string {
+	return slices.Sorted(maps.Keys(oemGUID))
+}
+
 func DetectVendorCerts(sb *signature.SignatureDatabase) []string {
 	oems := []string{}
 	detect := map[util.EFIGUID]string{}
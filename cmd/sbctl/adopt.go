@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type AdoptCmdOptions struct {
+	All     bool
+	Classes []string
+}
+
+type AdoptedFile struct {
+	sbctl.EFIBinary
+	Proposed bool `json:"proposed"`
+	Adopted  bool `json:"adopted"`
+}
+
+var (
+	adoptCmdOptions = AdoptCmdOptions{}
+	adoptCmd        = &cobra.Command{
+		Use:   "adopt",
+		Short: "Find EFI binaries in the ESP and add them to the database",
+		RunE:  RunAdopt,
+	}
+)
+
+func RunAdopt(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	for _, class := range adoptCmdOptions.Classes {
+		if !slices.Contains(sbctl.EFIClasses, sbctl.EFIClass(class)) {
+			return fmt.Errorf("unknown class %s, valid classes are: %s", class, efiClassesString())
+		}
+	}
+
+	espPath, err := sbctl.FindESP(state)
+	if err != nil {
+		return err
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.RODirs(espPath),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return err
+	}
+
+	binaries, err := sbctl.FindEFIBinaries(state, kh, espPath)
+	if err != nil {
+		return err
+	}
+
+	adopt := adoptCmdOptions.All || len(adoptCmdOptions.Classes) > 0
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return err
+	}
+
+	adopted := []AdoptedFile{}
+	for _, b := range binaries {
+		f := AdoptedFile{EFIBinary: *b, Proposed: b.Proposed()}
+		if f.Proposed && adopt &&
+			(adoptCmdOptions.All || slices.Contains(adoptCmdOptions.Classes, string(b.Class))) {
+			files[b.Path] = &sbctl.SigningEntry{File: b.Path, OutputFile: b.Path}
+			f.Adopted = true
+		}
+		adopted = append(adopted, f)
+	}
+
+	if adopt {
+		if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+			return err
+		}
+	}
+
+	if cmdOptions.JsonOutput {
+		return JsonOut(adopted)
+	}
+
+	logging.Print("Found %d EFI binaries in %s\n", len(adopted), espPath)
+	for _, f := range adopted {
+		switch {
+		case f.Adopted:
+			logging.Ok("Added %s (%s)", f.Path, f.Class)
+		case f.Tracked:
+			logging.Print("%s (%s) is already in the database\n", f.Path, f.Class)
+		case f.ThirdPartySigned:
+			logging.Unknown("%s (%s) is signed by a third party, skipping", f.Path, f.Class)
+		case f.Proposed:
+			logging.Warn("%s (%s) should be added to the database", f.Path, f.Class)
+		}
+	}
+	if !adopt && slices.ContainsFunc(adopted, func(f AdoptedFile) bool { return f.Proposed }) {
+		logging.Println("\nUse --all or --class to add the files to the database and sign them with sign-all")
+	}
+	return nil
+}
+
+func efiClassesString() string {
+	var classes []string
+	for _, c := range sbctl.EFIClasses {
+		classes = append(classes, string(c))
+	}
+	return strings.Join(classes, ",")
+}
+
+func adoptCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&adoptCmdOptions.All, "all", "a", false, "add all proposed files to the database")
+	f.StringSliceVarP(&adoptCmdOptions.Classes, "class", "c", []string{}, fmt.Sprintf("only add proposed files of the given classes [%s]", efiClassesString()))
+	cmd.MarkFlagsMutuallyExclusive("all", "class")
+}
+
+func init() {
+	adoptCmdFlags(adoptCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:   adoptCmd,
+		Audit: true,
+	})
+}
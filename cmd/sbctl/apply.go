@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+)
+
+type ApplyCmdOptions struct {
+	DryRun bool
+}
+
+type ApplyResult struct {
+	Added   []*sbctl.SigningEntry `json:"added"`
+	Changed []*sbctl.SigningEntry `json:"changed"`
+	Removed []*sbctl.SigningEntry `json:"removed"`
+	// Outputs of the bundles added, changed or removed in the bundle
+	// database
+	AddedBundles   []string `json:"added_bundles"`
+	ChangedBundles []string `json:"changed_bundles"`
+	RemovedBundles []string `json:"removed_bundles"`
+	Signed         []string `json:"signed"`
+	Failed         []string `json:"failed"`
+	// Files which would be signed without --dry-run
+	Unsigned []string `json:"unsigned"`
+	// db_additions which are declared but not enrolled, and the other way
+	// around. Vendors can only be changed with enroll-keys.
+	MissingVendors    []string `json:"missing_vendors"`
+	UndeclaredVendors []string `json:"undeclared_vendors"`
+}
+
+func (a *ApplyResult) HasDrift() bool {
+	return len(a.Added) > 0 || len(a.Changed) > 0 || len(a.Removed) > 0 ||
+		len(a.AddedBundles) > 0 || len(a.ChangedBundles) > 0 || len(a.RemovedBundles) > 0 ||
+		len(a.Signed) > 0 || len(a.Failed) > 0 || len(a.Unsigned) > 0 ||
+		len(a.MissingVendors) > 0 || len(a.UndeclaredVendors) > 0
+}
+
+var (
+	ErrDrift        = errors.New("configuration has drifted")
+	applyCmdOptions = ApplyCmdOptions{}
+	applyCmd        = &cobra.Command{
+		Use:   "apply",
+		Short: "Apply the configuration file to the file database and sign files",
+		RunE:  RunApply,
+	}
+)
+
+func RunApply(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	// If the signing operation opens a Yubikey, ensure it is closed properly at the end
+	defer state.Yubikey.Close()
+
+	result, err := Apply(state, applyCmdOptions.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if cmdOptions.JsonOutput {
+		if err := JsonOut(result); err != nil {
+			return err
+		}
+	} else {
+		PrintApplyResult(result)
+	}
+
+	if len(result.Failed) > 0 {
+		return ErrSilent
+	}
+	if applyCmdOptions.DryRun && result.HasDrift() {
+		return ErrSilent
+	}
+	return nil
+}
+
+func Apply(state *config.State, dryRun bool) (*ApplyResult, error) {
+	result := &ApplyResult{}
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only manage the file database when the configuration declares files
+	if len(state.Config.Files) > 0 {
+		result.Added, result.Changed, result.Removed = sbctl.ReconcileFileDatabase(files, state.Config.Files)
+	}
+
+	bundles, err := sbctl.ReadBundleDatabase(state.Fs, state.Config.BundlesDb)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only manage the bundle database when the configuration declares
+	// bundles
+	if len(state.Config.Bundles) > 0 {
+		result.AddedBundles, result.ChangedBundles, result.RemovedBundles, err = sbctl.ReconcileBundleDatabase(state, bundles, state.Config.Bundles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := sbctl.ExpandSigningEntries(state.Fs, files)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas, err := sbctl.FindReplicas(state)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(sbctl.LandlockRulesFromEntries(state.Fs, entries)...)
+		lsm.RestrictAdditionalPaths(replicas.LandlockRules()...)
+		if err := lsm.Restrict(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !dryRun {
+		if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+			return nil, err
+		}
+		if len(state.Config.Bundles) > 0 {
+			if err := sbctl.WriteBundleDatabase(state.Fs, state.Config.BundlesDb, bundles); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if dryRun {
+			ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, entry.OutputFile)
+			if err != nil || !ok {
+				result.Unsigned = append(result.Unsigned, entry.OutputFile)
+			}
+			continue
+		}
+		err := sbctl.SignFile(state, kh, hierarchy.Db, entry.File, entry.OutputFile)
+		if err != nil && !errors.Is(err, sbctl.ErrAlreadySigned) {
+			logging.Error(fmt.Errorf("failed signing %s: %w", entry.File, err))
+			result.Failed = append(result.Failed, entry.OutputFile)
+			continue
+		} else if err == nil {
+			result.Signed = append(result.Signed, entry.OutputFile)
+		}
+		written, err := replicas.Mirror(state.Fs, entry.OutputFile)
+		if err != nil {
+			logging.Error(err)
+			result.Failed = append(result.Failed, entry.OutputFile)
+		}
+		result.Signed = append(result.Signed, written...)
+	}
+
+	result.MissingVendors, result.UndeclaredVendors = vendorDrift(state)
+	return result, nil
+}
+
+// vendorDrift compares the declared db_additions against the vendor
+// certificates enrolled in db
+func vendorDrift(state *config.State) (missing, undeclared []string) {
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		return nil, nil
+	}
+	enrolled := certs.DetectVendorCerts(db)
+	for _, v := range state.Config.DbAdditions {
+		// Certificates built into the firmware can't be told apart from the
+		// rest of db
+		if v == "firmware-builtin" {
+			continue
+		}
+		if !slices.Contains(enrolled, v) {
+			missing = append(missing, v)
+		}
+	}
+	for _, v := range enrolled {
+		if !slices.Contains(state.Config.DbAdditions, v) {
+			undeclared = append(undeclared, v)
+		}
+	}
+	return missing, undeclared
+}
+
+func PrintApplyResult(result *ApplyResult) {
+	if !result.HasDrift() {
+		logging.Ok("Nothing to do, the system matches the configuration")
+		return
+	}
+	for _, e := range result.Added {
+		logging.Ok("Added %s to the database", e.File)
+	}
+	for _, e := range result.Changed {
+		logging.Ok("Changed the output of %s to %s", e.File, e.OutputFile)
+	}
+	for _, e := range result.Removed {
+		logging.Ok("Removed %s from the database", e.File)
+	}
+	for _, b := range result.AddedBundles {
+		logging.Ok("Added bundle %s to the database", b)
+	}
+	for _, b := range result.ChangedBundles {
+		logging.Ok("Changed bundle %s", b)
+	}
+	for _, b := range result.RemovedBundles {
+		logging.Ok("Removed bundle %s from the database", b)
+	}
+	for _, f := range result.Signed {
+		logging.Ok("Signed %s", f)
+	}
+	for _, f := range result.Unsigned {
+		logging.NotOk("%s is not signed", f)
+	}
+	for _, f := range result.Failed {
+		logging.NotOk("Failed signing %s", f)
+	}
+	for _, v := range result.MissingVendors {
+		logging.Warn("Vendor keys %s are declared but not enrolled", v)
+	}
+	for _, v := range result.UndeclaredVendors {
+		logging.Warn("Vendor keys %s are enrolled but not declared", v)
+	}
+	if len(result.MissingVendors) > 0 || len(result.UndeclaredVendors) > 0 {
+		logging.Println("Vendor keys are only changed by enroll-keys")
+	}
+}
+
+func applyCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&applyCmdOptions.DryRun, "dry-run", "n", false, "only report differences between the configuration and the system")
+}
+
+func init() {
+	applyCmdFlags(applyCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:   applyCmd,
+		Audit: true,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/go-uefi/efivarfs/testfs"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+)
+
+func TestApply(t *testing.T) {
+	mapfs := fstest.MapFS{
+		systemEventlog:        {Data: mustBytes("../../tests/tpm_eventlogs/t480s_eventlog")},
+		"/boot/test.efi":      {Data: mustBytes("../../tests/binaries/test.pecoff")},
+		"/boot/something.efi": {Data: mustBytes("../../tests/binaries/test.pecoff")},
+	}
+
+	conf := config.DefaultConfig()
+	conf.Landlock = false
+	conf.Files = []*config.FileConfig{
+		{Path: "/boot/test.efi"},
+	}
+
+	state := &config.State{
+		Fs: efitest.FromMapFS(mapfs),
+		Efivarfs: testfs.NewTestFS().
+			With(efitest.SetUpModeOn(),
+				mapfs,
+			).
+			Open(),
+		Config: conf,
+	}
+
+	enrollKeysCmdOptions.IgnoreImmutable = true
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+
+	// Declare a new file and drop the old one, and the same for bundles
+	conf.Files = []*config.FileConfig{
+		{Path: "/boot/something.efi", Output: "/boot/something.efi.signed"},
+	}
+	if err := sbctl.WriteBundleDatabase(state.Fs, conf.BundlesDb, sbctl.Bundles{
+		"/efi/EFI/Linux/old.efi": {Output: "/efi/EFI/Linux/old.efi"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conf.Bundles = []*config.BundleConfig{
+		{Output: "/efi/EFI/Linux/arch.efi"},
+	}
+
+	result, err := Apply(state, true)
+	if err != nil {
+		t.Fatalf("failed running Apply: %v", err)
+	}
+	if len(result.Added) != 1 || len(result.Removed) != 1 || len(result.Signed) != 0 {
+		t.Fatalf("unexpected dry-run result: %+v", result)
+	}
+	if !slices.Contains(result.Unsigned, "/boot/something.efi.signed") {
+		t.Fatalf("expected /boot/something.efi.signed to be unsigned: %+v", result)
+	}
+	files, err := sbctl.ReadFileDatabase(state.Fs, conf.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files["/boot/test.efi"]; !ok {
+		t.Fatalf("dry-run modified the file database")
+	}
+	if !slices.Equal(result.AddedBundles, []string{"/efi/EFI/Linux/arch.efi"}) || !slices.Equal(result.RemovedBundles, []string{"/efi/EFI/Linux/old.efi"}) {
+		t.Fatalf("unexpected bundle drift: %+v", result)
+	}
+	bundles, err := sbctl.ReadBundleDatabase(state.Fs, conf.BundlesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bundles["/efi/EFI/Linux/old.efi"]; !ok {
+		t.Fatalf("dry-run modified the bundle database")
+	}
+
+	result, err = Apply(state, false)
+	if err != nil {
+		t.Fatalf("failed running Apply: %v", err)
+	}
+	if !slices.Equal(result.Signed, []string{"/boot/something.efi.signed"}) {
+		t.Fatalf("unexpected signed files: %v", result.Signed)
+	}
+	files, err = sbctl.ReadFileDatabase(state.Fs, conf.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["/boot/something.efi"] == nil {
+		t.Fatalf("unexpected file database: %v", files)
+	}
+	bundles, err = sbctl.ReadBundleDatabase(state.Fs, conf.BundlesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundles) != 1 || bundles["/efi/EFI/Linux/arch.efi"] == nil {
+		t.Fatalf("unexpected bundle database: %v", bundles)
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, "/boot/something.efi.signed")
+	if err != nil || !ok {
+		t.Fatalf("file is not properly signed: %v", err)
+	}
+
+	// Applying twice should not find any drift
+	result, err = Apply(state, true)
+	if err != nil {
+		t.Fatalf("failed running Apply: %v", err)
+	}
+	if result.HasDrift() {
+		t.Fatalf("unexpected drift: %+v", result)
+	}
+}
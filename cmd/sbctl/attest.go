@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type AttestCmdOptions struct {
+	Nonce    string
+	PCRs     []uint
+	Eventlog string
+	Output   string
+	Policy   string
+}
+
+type AttestVerifyResult struct {
+	*sbctl.AttestationResult
+	Violations []string `json:"violations"`
+}
+
+var (
+	attestCmdOptions = AttestCmdOptions{}
+	attestCmd        = &cobra.Command{
+		Use:   "attest",
+		Short: "Quote the Secure Boot state with the TPM for remote attestation",
+		RunE:  RunAttest,
+	}
+	attestVerifyCmd = &cobra.Command{
+		Use:   "verify <BUNDLE>",
+		Short: "Verify an attestation bundle against a key policy",
+		Args:  cobra.ExactArgs(1),
+		RunE:  RunAttestVerify,
+	}
+)
+
+func attestNonce() ([]byte, error) {
+	if attestCmdOptions.Nonce == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(attestCmdOptions.Nonce)
+}
+
+func RunAttest(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	eventlog, err := filepath.Abs(attestCmdOptions.Eventlog)
+	if err != nil {
+		return err
+	}
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(eventlog).IgnoreIfMissing(),
+		)
+		if attestCmdOptions.Output != "" {
+			output, err := filepath.Abs(attestCmdOptions.Output)
+			if err != nil {
+				return err
+			}
+			lsm.RestrictAdditionalPaths(
+				landlock.RWDirs(filepath.Dir(output)),
+			)
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	tpm := systemTPM(state)
+	if tpm == nil {
+		return errors.New("no tpm found")
+	}
+	nonce, err := attestNonce()
+	if err != nil {
+		return fmt.Errorf("invalid nonce: %w", err)
+	}
+	// Without a nonce from the verifier the quote can be replayed
+	if nonce == nil {
+		nonce = make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+	}
+
+	log, err := fs.ReadFile(state.Fs, eventlog)
+	if errors.Is(err, os.ErrNotExist) {
+		return sbctl.ErrNoEventlog
+	} else if err != nil {
+		return err
+	}
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		return fmt.Errorf("can't read efivariables: %v", err)
+	}
+
+	bundle, err := sbctl.Attest(tpm, nonce, attestCmdOptions.PCRs, log, sbctl.EnrolledKeys(efistate))
+	if err != nil {
+		return err
+	}
+	if attestCmdOptions.Output == "" {
+		return JsonOut(bundle)
+	}
+	b, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fs.WriteFile(state.Fs, attestCmdOptions.Output, b, 0o644); err != nil {
+		return err
+	}
+	logging.Ok("Wrote attestation bundle to %s", attestCmdOptions.Output)
+	return nil
+}
+
+func RunAttestVerify(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(args[0]),
+		)
+		if attestCmdOptions.Policy != "" {
+			lsm.RestrictAdditionalPaths(
+				landlock.ROFiles(attestCmdOptions.Policy),
+			)
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	nonce, err := attestNonce()
+	if err != nil {
+		return fmt.Errorf("invalid nonce: %w", err)
+	}
+	b, err := fs.ReadFile(state.Fs, args[0])
+	if err != nil {
+		return err
+	}
+	var bundle sbctl.AttestationBundle
+	if err := json.Unmarshal(b, &bundle); err != nil {
+		return fmt.Errorf("failed parsing attestation bundle: %w", err)
+	}
+	policy := &sbctl.AttestationPolicy{}
+	if attestCmdOptions.Policy != "" {
+		b, err := fs.ReadFile(state.Fs, attestCmdOptions.Policy)
+		if err != nil {
+			return err
+		}
+		if policy, err = sbctl.ParseAttestationPolicy(b); err != nil {
+			return fmt.Errorf("failed parsing policy: %w", err)
+		}
+	}
+	// The attestation key is part of the bundle, only a pinned key proves
+	// the quote was made by the TPM of the machine
+	if len(policy.AK) == 0 {
+		ak, err := bundle.AKFingerprint()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: the policy needs to list the attestation key in ak, the bundle is signed by %s", sbctl.ErrAttestationKey, ak)
+	}
+
+	result, err := bundle.Verify(nonce, policy.AK)
+	if err != nil {
+		return err
+	}
+	out := AttestVerifyResult{
+		AttestationResult: result,
+		Violations:        policy.Check(result),
+	}
+	if cmdOptions.JsonOutput {
+		if err := JsonOut(out); err != nil {
+			return err
+		}
+	} else {
+		printAttestVerifyResult(out)
+	}
+	if len(out.Violations) > 0 {
+		return fmt.Errorf("%w: %s", sbctl.ErrAttestationPolicy, strings.Join(out.Violations, "; "))
+	}
+	return nil
+}
+
+func printAttestVerifyResult(r AttestVerifyResult) {
+	logging.Print("Attestation key:\t%s\n", r.AK)
+	logging.Print("Nonce:\t\t\t%s\n", r.Nonce)
+	logging.Print("Secure Boot:\t\t")
+	if r.SecureBoot {
+		logging.Ok("Enabled")
+	} else {
+		logging.NotOk("Disabled")
+	}
+	for _, k := range []struct {
+		name string
+		keys []string
+	}{
+		{"PK", r.Keys.PK},
+		{"KEK", r.Keys.KEK},
+		{"db", r.Keys.Db},
+	} {
+		logging.Print("%s:\n", k.name)
+		for _, f := range k.keys {
+			logging.Print("\t%s\n", f)
+		}
+	}
+	if len(r.Violations) == 0 {
+		logging.Ok("The attestation satisfies the policy")
+		return
+	}
+	for _, v := range r.Violations {
+		logging.NotOk("%s", v)
+	}
+}
+
+func attestCmdFlags(cmd *cobra.Command) {
+	f := cmd.PersistentFlags()
+	f.StringVarP(&attestCmdOptions.Nonce, "nonce", "n", "", "hex encoded nonce supplied by the verifier")
+	f = cmd.Flags()
+	f.UintSliceVarP(&attestCmdOptions.PCRs, "pcrs", "p", []uint{7}, "PCRs to quote, PCR 7 is always quoted and 4 and 11 can be added")
+	f.StringVarP(&attestCmdOptions.Eventlog, "eventlog", "e", systemEventlog, "path to the TPM eventlog")
+	f.StringVarP(&attestCmdOptions.Output, "output", "o", "", "write the attestation bundle to a file instead of stdout")
+}
+
+func attestVerifyCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&attestCmdOptions.Policy, "policy", "", "", "YAML or JSON file with the pinned attestation keys, and the expected keys and PCR values")
+}
+
+func init() {
+	attestCmdFlags(attestCmd)
+	attestVerifyCmdFlags(attestVerifyCmd)
+	attestCmd.AddCommand(attestVerifyCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: attestCmd,
+	})
+}
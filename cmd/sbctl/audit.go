@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+type AuditVerifyResult struct {
+	Entries int    `json:"entries"`
+	Head    string `json:"head"`
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log of key and EFI variable operations",
+	}
+	auditVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the hash chain of the audit log",
+		RunE:  RunAuditVerify,
+	}
+)
+
+// auditSnapshot is the state an audited command can change
+type auditSnapshot struct {
+	vars *sbctl.EFIVariables
+	keys map[string]string
+}
+
+func takeAuditSnapshot(state *config.State) *auditSnapshot {
+	s := &auditSnapshot{keys: map[string]string{}}
+	if vars, err := sbctl.SystemEFIVariables(state.Efivarfs); err == nil {
+		if dbx, err := state.Efivarfs.Getdbx(); err == nil {
+			vars.Dbx = dbx
+		}
+		s.vars = vars
+	}
+	if state.Config.Keys == nil {
+		return s
+	}
+	for name, key := range map[string]*config.KeyConfig{
+		"PK":  state.Config.Keys.PK,
+		"KEK": state.Config.Keys.KEK,
+		"db":  state.Config.Keys.Db,
+	} {
+		if key == nil {
+			continue
+		}
+		b, err := fs.ReadFile(state.Fs, key.Pubkey)
+		if err != nil {
+			continue
+		}
+		if block, _ := pem.Decode(b); block != nil {
+			sum := sha256.Sum256(block.Bytes)
+			s.keys[name] = hex.EncodeToString(sum[:])
+		}
+	}
+	return s
+}
+
+// auditArgs returns the flags given to the command followed by the arguments
+func auditArgs(cmd *cobra.Command, args []string) []string {
+	out := []string{}
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		out = append(out, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+	})
+	return append(out, args...)
+}
+
+func auditEntry(cmd *cobra.Command, args []string, before, after *auditSnapshot, err error) *sbctl.AuditEntry {
+	e := &sbctl.AuditEntry{
+		Time:     time.Now().UTC(),
+		UID:      os.Getuid(),
+		SudoUser: os.Getenv("SUDO_USER"),
+		Command:  cmd.CommandPath(),
+		Args:     auditArgs(cmd, args),
+		Result:   "ok",
+	}
+	if len(after.keys) > 0 {
+		e.Keys = after.keys
+	}
+	for name, fp := range before.keys {
+		if after.keys[name] == fp {
+			continue
+		}
+		if e.PreviousKeys == nil {
+			e.PreviousKeys = map[string]string{}
+		}
+		e.PreviousKeys[name] = fp
+	}
+	if before.vars != nil && after.vars != nil {
+		e.Variables = sbctl.AuditVariableDiff(before.vars, after.vars)
+	}
+	if err != nil {
+		e.Result = "error"
+		if !errors.Is(err, ErrSilent) {
+			e.Error = err.Error()
+		}
+	}
+	return e
+}
+
+func journalAuditEntry(e *sbctl.AuditEntry) error {
+	h, err := logging.NewJournalHandler()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	attrs := []any{
+		slog.Int("audit_seq", e.Seq),
+		slog.String("audit_hash", e.Hash),
+		slog.Int("audit_uid", e.UID),
+		slog.String("audit_args", strings.Join(e.Args, " ")),
+		slog.String("audit_result", e.Result),
+	}
+	if e.Error != "" {
+		attrs = append(attrs, slog.String("audit_error", e.Error))
+	}
+	slog.New(h).Info(e.Command, attrs...)
+	return nil
+}
+
+// auditCommand records every run of the command in the audit log
+func auditCommand(cmd *cobra.Command) {
+	run := cmd.RunE
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		if state.Config.AuditLog == "" {
+			return run(cmd, args)
+		}
+		before := takeAuditSnapshot(state)
+		err := run(cmd, args)
+		e := auditEntry(cmd, args, before, takeAuditSnapshot(state), err)
+		if aerr := sbctl.AppendAuditEntry(state.Fs, state.Config.AuditLog, e); aerr != nil {
+			// The command has already run, so this only changes the exit status
+			return errors.Join(err, fmt.Errorf("failed writing audit log: %w", aerr))
+		}
+		if state.Config.AuditJournal {
+			if jerr := journalAuditEntry(e); jerr != nil {
+				logging.Warn("Failed writing audit entry to the journal: %v", jerr)
+			}
+		}
+		return err
+	}
+}
+
+func RunAuditVerify(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if state.Config.AuditLog == "" {
+		return errors.New("audit log is disabled in the configuration")
+	}
+	b, err := fs.ReadFile(state.Fs, state.Config.AuditLog)
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Println("The audit log is empty")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entries, verr := sbctl.ReadAuditLog(bytes.NewReader(b))
+	result := AuditVerifyResult{Entries: len(entries)}
+	if len(entries) > 0 {
+		result.Head = entries[len(entries)-1].Hash
+	}
+	if verr != nil {
+		result.Error = verr.Error()
+	}
+
+	if cmdOptions.JsonOutput {
+		if err := JsonOut(result); err != nil {
+			return err
+		}
+		if verr != nil {
+			return ErrSilent
+		}
+		return nil
+	}
+	if verr != nil {
+		logging.NotOk("Verified %d entries before the first invalid entry", result.Entries)
+		return verr
+	}
+	logging.Ok("Verified %d entries", result.Entries)
+	if result.Head != "" {
+		logging.Print("Last entry:\t%s\n", result.Head)
+	}
+	return nil
+}
+
+func init() {
+	auditCmd.AddCommand(auditVerifyCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: auditCmd,
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+)
+
+type BootEntryCmdOptions struct {
+	Create  string
+	Label   string
+	Bundles bool
+	First   bool
+	Remove  string
+	Order   []string
+}
+
+type JsonLoadOption struct {
+	*sbctl.LoadOption
+	Name    string `json:"name"`
+	Active  bool   `json:"active"`
+	Path    string `json:"path"`
+	Current bool   `json:"current"`
+}
+
+var (
+	bootEntryCmdOptions = BootEntryCmdOptions{}
+	bootEntryCmd        = &cobra.Command{
+		Use:   "boot-entry",
+		Short: "List and manage the UEFI boot entries",
+		RunE:  RunBootEntry,
+	}
+)
+
+func RunBootEntry(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	// Everything which needs more than efivarfs is gathered before landlock
+	// is applied
+	var opts []*sbctl.LoadOption
+	if bootEntryCmdOptions.Create != "" || bootEntryCmdOptions.Bundles {
+		var err error
+		opts, err = newLoadOptions(state)
+		if err != nil {
+			return err
+		}
+	}
+
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case bootEntryCmdOptions.Create != "" || bootEntryCmdOptions.Bundles:
+		if len(opts) == 0 {
+			logging.Println("No bundles to create boot entries for")
+			return nil
+		}
+		// Prepend the entries in reverse so they keep their order in BootOrder
+		if bootEntryCmdOptions.First {
+			slices.Reverse(opts)
+		}
+		for _, opt := range opts {
+			opt, err := sbctl.AddLoadOption(state.Efivarfs, opt, bootEntryCmdOptions.First)
+			if err != nil {
+				return err
+			}
+			logging.Ok("Wrote %s: %s", opt.Name(), opt.Description)
+		}
+		return nil
+	case bootEntryCmdOptions.Remove != "":
+		n, err := sbctl.ParseBootNumber(bootEntryCmdOptions.Remove)
+		if err != nil {
+			return err
+		}
+		if err := sbctl.RemoveLoadOption(state.Efivarfs, n); err != nil {
+			if errors.Is(err, sbctl.ErrNoLoadOption) {
+				return fmt.Errorf("boot entry %s does not exist", bootEntryCmdOptions.Remove)
+			}
+			return err
+		}
+		logging.Ok("Removed Boot%04X", n)
+		return nil
+	case len(bootEntryCmdOptions.Order) > 0:
+		var order []uint16
+		for _, s := range bootEntryCmdOptions.Order {
+			n, err := sbctl.ParseBootNumber(s)
+			if err != nil {
+				return err
+			}
+			if _, err := sbctl.GetLoadOption(state.Efivarfs, n); err != nil {
+				return fmt.Errorf("boot entry %s: %w", s, err)
+			}
+			order = append(order, n)
+		}
+		if err := sbctl.WriteBootOrder(state.Efivarfs, order); err != nil {
+			return err
+		}
+		logging.Ok("Wrote BootOrder")
+		return nil
+	}
+	return listBootEntries(state)
+}
+
+// newLoadOptions creates the load options for the file passed to --create, or
+// the bundles generated by generate-bundles
+func newLoadOptions(state *config.State) ([]*sbctl.LoadOption, error) {
+	parts, err := sbctl.FindBootPartitions(state)
+	if err != nil {
+		return nil, err
+	}
+	esp := parts.Primary().Mountpoint
+	part := parts.Primary().Partition
+	if part == nil {
+		return nil, fmt.Errorf("failed to find the partition of the ESP %s", esp)
+	}
+
+	type entry struct{ file, label string }
+	var entries []entry
+	if bootEntryCmdOptions.Create != "" {
+		file, err := filepath.Abs(bootEntryCmdOptions.Create)
+		if err != nil {
+			return nil, err
+		}
+		label := bootEntryCmdOptions.Label
+		if label == "" {
+			label = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		entries = append(entries, entry{file, label})
+	}
+	if bootEntryCmdOptions.Bundles {
+		bundles, err := sbctl.ReadBundles(state)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bundles {
+			expanded, err := b.Expand(state.Fs)
+			if err != nil {
+				return nil, err
+			}
+			for _, bundle := range expanded {
+				entries = append(entries, entry{bundle.InstallPath(), bundleLabel(state, bundle)})
+			}
+		}
+	}
+
+	var opts []*sbctl.LoadOption
+	for _, e := range entries {
+		if _, err := state.Fs.Stat(e.file); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.file, errors.Unwrap(err))
+		}
+		rel, err := filepath.Rel(esp, e.file)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("%s is not located in the ESP %s", e.file, esp)
+		}
+		opt, err := sbctl.NewLoadOption(e.label, part, rel)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+func bundleLabel(state *config.State, bundle *sbctl.Bundle) string {
+	label := strings.TrimSuffix(filepath.Base(bundle.Output), filepath.Ext(bundle.Output))
+	if osrel, err := sbctl.ParseOSRelease(state.Fs, bundle.OSRelease); err == nil && osrel["PRETTY_NAME"] != "" {
+		label = osrel["PRETTY_NAME"]
+	}
+	if bundle.KernelVersion != "" {
+		label += " (" + bundle.KernelVersion + ")"
+	}
+	return label
+}
+
+func listBootEntries(state *config.State) error {
+	opts, err := sbctl.GetLoadOptions(state.Efivarfs)
+	if err != nil {
+		return err
+	}
+	current, err := sbctl.GetBootCurrent(state.Efivarfs)
+	hasCurrent := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	entries := []JsonLoadOption{}
+	for _, opt := range opts {
+		entries = append(entries, JsonLoadOption{
+			LoadOption: opt,
+			Name:       opt.Name(),
+			Active:     opt.Active(),
+			Path:       opt.Path(),
+			Current:    hasCurrent && current == opt.Number,
+		})
+	}
+	if cmdOptions.JsonOutput {
+		return JsonOut(entries)
+	}
+	if len(entries) == 0 {
+		logging.Println("No boot entries in BootOrder")
+		return nil
+	}
+	for _, e := range entries {
+		marker := " "
+		if e.Current {
+			marker = "*"
+		}
+		logging.Print("%s %s  %s\n", marker, e.Name, e.Description)
+		if !e.Active {
+			logging.Print("\tInactive\n")
+		}
+		logging.Print("\t%s\n", e.Path)
+	}
+	return nil
+}
+
+func bootEntryCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&bootEntryCmdOptions.Create, "create", "c", "", "create a boot entry for an EFI binary in the ESP")
+	f.StringVarP(&bootEntryCmdOptions.Label, "label", "L", "", "label of the created boot entry")
+	f.BoolVarP(&bootEntryCmdOptions.Bundles, "bundles", "b", false, "create boot entries for all bundles")
+	f.BoolVarP(&bootEntryCmdOptions.First, "first", "f", false, "put the created boot entries first in BootOrder")
+	f.StringVarP(&bootEntryCmdOptions.Remove, "remove", "r", "", "remove a boot entry, e.g. 0001")
+	f.StringSliceVarP(&bootEntryCmdOptions.Order, "order", "o", []string{}, "set BootOrder, e.g. 0001,0002")
+	cmd.MarkFlagsMutuallyExclusive("remove", "order", "create")
+	cmd.MarkFlagsMutuallyExclusive("remove", "order", "bundles")
+}
+
+func init() {
+	bootEntryCmdFlags(bootEntryCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:   bootEntryCmd,
+		Audit: true,
+	})
+}
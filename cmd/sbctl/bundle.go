@@ -3,11 +3,11 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/logging"
-	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
@@ -22,6 +22,12 @@ var (
 	initramfs  string
 	espPath    string
 	saveBundle bool
+	bootEntry  bool
+	loaderDef  bool
+	bootCount  int
+	keepPrev   bool
+	archName   string
+	dtbs       []string
 )
 
 var bundleCmd = &cobra.Command{
@@ -37,8 +43,13 @@ var bundleCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		checkFiles := []string{amducode, intelucode, splashImg, osRelease, efiStub, kernelImg, cmdline, initramfs}
+		devicetrees := parseDevicetrees(dtbs)
+		for _, d := range devicetrees {
+			checkFiles = append(checkFiles, d.Path)
+		}
 		for _, path := range checkFiles {
-			if path == "" {
+			// Templates are checked when the bundle is expanded
+			if path == "" || strings.ContainsAny(path, "{*") {
 				continue
 			}
 			if _, err := state.Fs.Stat(path); os.IsNotExist(err) {
@@ -46,7 +57,7 @@ var bundleCmd = &cobra.Command{
 				os.Exit(1)
 			}
 		}
-		bundle, err := sbctl.NewBundle(state.Fs)
+		bundle, err := sbctl.NewBundle(state)
 		if err != nil {
 			return err
 		}
@@ -73,12 +84,50 @@ var bundleCmd = &cobra.Command{
 		bundle.Splash = splashImg
 		bundle.OSRelease = osRelease
 		bundle.EFIStub = efiStub
+		bundle.Devicetrees = devicetrees
+		if archName != "" {
+			arch, err := sbctl.ParseEFIArch(archName)
+			if err != nil {
+				return err
+			}
+			bundle.Arch = arch.Name
+			if !cmd.Flags().Changed("efi-stub") {
+				if bundle.EFIStub, err = sbctl.GetEfistubArch(state.Fs, arch); err != nil {
+					return err
+				}
+			}
+		}
 		bundle.ESP = espPath
-		if err = sbctl.CreateBundle(state, *bundle); err != nil {
+		if !cmd.Flags().Changed("esp") {
+			if esp, err := sbctl.FindESP(state); err == nil {
+				bundle.ESP = esp
+			}
+		}
+		bundle.BootEntry = bootEntry || loaderDef
+		bundle.LoaderDefault = loaderDef
+		bundle.BootCounting = bootCount
+		bundle.KeepPrevious = keepPrev
+		expanded, err := bundle.Expand(state.Fs)
+		if err != nil {
 			return err
 		}
-		logging.Print("Wrote EFI bundle %s\n", bundle.Output)
+		for _, b := range expanded {
+			if err = sbctl.CreateBundle(state, *b, nil); err != nil {
+				return err
+			}
+			logging.Print("Wrote EFI bundle %s\n", b.InstallPath())
+			if b.BootEntry {
+				entry, err := sbctl.WriteBootEntry(state, b)
+				if err != nil {
+					return err
+				}
+				logging.Print("Wrote boot entry %s\n", entry.Path)
+			}
+		}
 		if saveBundle {
+			for _, b := range expanded {
+				bundle.Generated = append(bundle.Generated, b.Output)
+			}
 			bundles[bundle.Output] = bundle
 			err := sbctl.WriteBundleDatabase(state.Fs, state.Config.BundlesDb, bundles)
 			if err != nil {
@@ -89,8 +138,22 @@ var bundleCmd = &cobra.Command{
 	},
 }
 
+// parseDevicetrees parses the devicetree arguments, the path of the devicetree
+// optionally followed by = and the comma separated hardware IDs it is used for
+func parseDevicetrees(args []string) []sbctl.Devicetree {
+	var devicetrees []sbctl.Devicetree
+	for _, arg := range args {
+		path, hwids, ok := strings.Cut(arg, "=")
+		d := sbctl.Devicetree{Path: path}
+		if ok {
+			d.HWIDs = strings.Split(hwids, ",")
+		}
+		devicetrees = append(devicetrees, d)
+	}
+	return devicetrees
+}
+
 func bundleCmdFlags(cmd *cobra.Command) {
-	esp, _ := sbctl.GetESP(afero.NewOsFs())
 	f := cmd.Flags()
 	f.StringVarP(&amducode, "amducode", "a", "", "AMD microcode location")
 	f.StringVarP(&intelucode, "intelucode", "i", "", "Intel microcode location")
@@ -100,8 +163,14 @@ func bundleCmdFlags(cmd *cobra.Command) {
 	f.StringVarP(&kernelImg, "kernel-img", "k", "/boot/vmlinuz-linux", "Kernel image location")
 	f.StringVarP(&cmdline, "cmdline", "c", "/etc/kernel/cmdline", "Cmdline location")
 	f.StringVarP(&initramfs, "initramfs", "f", "/boot/initramfs-linux.img", "Initramfs location")
-	f.StringVarP(&espPath, "esp", "p", esp, "ESP location")
+	f.StringVarP(&espPath, "esp", "p", "", "ESP location, discovered when not given")
 	f.BoolVarP(&saveBundle, "save", "s", false, "save bundle to the database")
+	f.BoolVarP(&bootEntry, "boot-entry", "b", false, "write a boot loader entry for the bundle")
+	f.BoolVarP(&loaderDef, "loader-default", "d", false, "make the boot loader entry the default in loader.conf")
+	f.IntVarP(&bootCount, "boot-counting", "t", 0, "number of boot attempts before the bundle is marked as bad")
+	f.BoolVarP(&keepPrev, "keep-previous", "P", false, "keep the previously installed bundle as a fallback")
+	f.StringVarP(&archName, "arch", "", "", "architecture to build the bundle for, defaults to the architecture of the system")
+	f.StringArrayVarP(&dtbs, "devicetree", "", []string{}, "devicetree to include, followed by =HWID,... to select it by the hardware IDs of the system")
 }
 
 func init() {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/quirks"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type CheckCmdOptions struct {
+	Policy string
+}
+
+var (
+	checkCmdOptions = CheckCmdOptions{}
+	checkCmd        = &cobra.Command{
+		Use:   "check",
+		Short: "Check the Secure Boot state against a compliance policy",
+		RunE:  RunCheck,
+	}
+)
+
+// complianceState gathers the state of the system for evaluating a policy
+func complianceState(state *config.State) (*sbctl.ComplianceState, error) {
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		return nil, fmt.Errorf("can't read efivariables: %v", err)
+	}
+	dbx, err := state.Efivarfs.Getdbx()
+	if errors.Is(err, os.ErrNotExist) {
+		dbx = signature.NewSignatureDatabase()
+	} else if err != nil {
+		return nil, err
+	}
+	s := &sbctl.ComplianceState{
+		PK:       efistate.PK,
+		KEK:      efistate.KEK,
+		Db:       efistate.Db,
+		Dbx:      dbx,
+		Unsigned: []string{},
+		Quirks:   quirks.CheckFirmwareQuirks(state),
+	}
+	s.SetupMode, _ = state.Efivarfs.GetSetupMode()
+	s.SecureBoot, _ = state.Efivarfs.GetSecureBoot()
+
+	if !state.IsInstalled() {
+		return s, nil
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return nil, err
+	}
+	s.OwnPK = kh.PK.Certificate().Raw
+	err = sbctl.SigningEntryIter(state, func(e *sbctl.SigningEntry) error {
+		s.Files++
+		ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, e.OutputFile)
+		if err != nil {
+			logging.Warn("%s: %v", e.OutputFile, err)
+		}
+		if !ok {
+			s.Unsigned = append(s.Unsigned, e.OutputFile)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return s, nil
+}
+
+func RunCheck(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if checkCmdOptions.Policy == "" {
+		return errors.New("a policy is required, use --policy")
+	}
+	if state.Config.Landlock {
+		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
+			return err
+		}
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(checkCmdOptions.Policy),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	b, err := fs.ReadFile(state.Fs, checkCmdOptions.Policy)
+	if err != nil {
+		return err
+	}
+	policy, err := sbctl.ParseCompliancePolicy(b)
+	if err != nil {
+		return fmt.Errorf("failed parsing policy: %w", err)
+	}
+	s, err := complianceState(state)
+	if err != nil {
+		return err
+	}
+	report := policy.Evaluate(s)
+
+	if cmdOptions.JsonOutput {
+		if err := JsonOut(report); err != nil {
+			return err
+		}
+	} else {
+		printComplianceReport(report)
+	}
+	if !report.Compliant {
+		// The report already lists the failed rules
+		return ErrSilent
+	}
+	return nil
+}
+
+func printComplianceReport(report *sbctl.ComplianceReport) {
+	for _, r := range report.Results {
+		if r.Passed {
+			logging.Ok("%s: %s", r.Name, r.Message)
+		} else {
+			logging.NotOk("%s: %s", r.Name, r.Message)
+		}
+	}
+	if report.Compliant {
+		logging.Ok("The system is compliant with the policy")
+	} else {
+		logging.NotOk("%s", sbctl.ErrNotCompliant)
+	}
+}
+
+func checkCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&checkCmdOptions.Policy, "policy", "p", "", "YAML or JSON file with the compliance rules")
+}
+
+func init() {
+	checkCmdFlags(checkCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: checkCmd,
+	})
+}
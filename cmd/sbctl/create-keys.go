@@ -125,6 +125,7 @@ func init() {
 	createKeysCmdFlags(createKeysCmd)
 
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: createKeysCmd,
+		Cmd:   createKeysCmd,
+		Audit: true,
 	})
 }
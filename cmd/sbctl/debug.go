@@ -111,6 +111,18 @@ func ProduceDebugInformation(state *config.State) error {
 		return err
 	}
 
+	if parts, err := sbctl.FindBootPartitions(state); err == nil {
+		partsb, err := json.Marshal(parts)
+		if err != nil {
+			return err
+		}
+		if err := writeTw("boot_partitions.json", partsb); err != nil {
+			return err
+		}
+	} else {
+		log.Print(err)
+	}
+
 	if err := writeTw("VERSION", []byte(sbctl.Version)); err != nil {
 		return err
 	}
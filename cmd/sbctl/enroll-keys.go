@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 
 	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
 	"github.com/foxboron/go-uefi/efivar"
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
@@ -16,6 +19,7 @@ import (
 	"github.com/foxboron/sbctl/fs"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/quirks"
 	"github.com/foxboron/sbctl/stringset"
 	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/afero"
@@ -46,26 +50,46 @@ type EnrollKeysCmdOptions struct {
 	IgnoreImmutable      bool
 	Force                bool
 	TPMEventlogChecksums bool
+	PCIOpromChecksums    bool
 	Custom               bool
 	CustomBytes          string
 	Partial              stringset.StringSet
 	BuiltinFirmwareCerts FirmwareBuiltinFlags
 	Export               stringset.StringSet
+	AcceptQuirks         []string
+	Target               string
+	Dbx                  string
+	Timestamp            string
 }
 
 var (
 	systemEventlog       = "/sys/kernel/security/tpm0/binary_bios_measurements"
 	enrollKeysCmdOptions = EnrollKeysCmdOptions{
 		Partial: stringset.StringSet{Allowed: []string{"PK", "KEK", "db"}},
-		Export:  stringset.StringSet{Allowed: []string{"esl", "auth"}},
+		Export:  stringset.StringSet{Allowed: []string{"esl", "auth", "esp"}},
 	}
 	enrollKeysCmd = &cobra.Command{
 		Use:   "enroll-keys",
 		Short: "Enroll the current keys to EFI",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			state := cmd.Context().Value(stateDataKey{}).(*config.State)
+			if enrollKeysCmdOptions.Timestamp != "" {
+				t, err := sbctl.ParseEFITime(enrollKeysCmdOptions.Timestamp)
+				if err != nil {
+					return err
+				}
+				enrollTimestamp = t
+			}
 			if state.Config.Landlock {
-				if enrollKeysCmdOptions.Export.Value != "" {
+				if enrollKeysCmdOptions.Export.Value == "esp" {
+					esp, err := sbctl.FindESP(state)
+					if err != nil {
+						return err
+					}
+					lsm.RestrictAdditionalPaths(
+						landlock.RWDirs(esp),
+					)
+				} else if enrollKeysCmdOptions.Export.Value != "" {
 					wd, err := os.Getwd()
 					if err != nil {
 						return err
@@ -74,31 +98,69 @@ var (
 						landlock.RWDirs(wd),
 					)
 				}
+				if slices.Contains(enrollOEMs(state), "pci-oprom") {
+					lsm.RestrictAdditionalPaths(sbctl.OptionROMLandlockRules()...)
+				}
+				if enrollKeysCmdOptions.Target != "" {
+					target, err := filepath.Abs(enrollKeysCmdOptions.Target)
+					if err != nil {
+						return err
+					}
+					lsm.RestrictAdditionalPaths(
+						landlock.RWDirs(filepath.Dir(target)),
+					)
+				}
+				if enrollKeysCmdOptions.Dbx != "" {
+					lsm.RestrictAdditionalPaths(
+						landlock.ROFiles(enrollKeysCmdOptions.Dbx),
+					)
+				}
 				if err := lsm.Restrict(); err != nil {
 					return err
 				}
 			}
-			return RunEnrollKeys(state)
+			if enrollKeysCmdOptions.Target != "" {
+				return RunEnrollTarget(state)
+			}
+			return quirkGuardOut(quirks.OpEnrollKeys, RunEnrollKeys(state))
 		},
 	}
 	ErrSetupModeDisabled = errors.New("setup mode is disabled")
+
+	// enrollTimestamp is parsed from --timestamp
+	enrollTimestamp util.EFITime
 )
 
-func SignSiglist(k *backend.KeyHierarchy, e efivar.Efivar, sigdb efivar.Marshallable) ([]byte, error) {
-	var signer backend.KeyBackend
-	switch e {
-	case efivar.PK:
-		signer = k.GetKeyBackend(efivar.PK)
-	case efivar.KEK:
-		signer = k.GetKeyBackend(efivar.PK)
-	case efivar.Db:
-		signer = k.GetKeyBackend(efivar.KEK)
-	}
-	_, em, err := signature.SignEFIVariable(e, sigdb, signer.Signer(), signer.Certificate())
-	if err != nil {
-		return nil, err
+// enrollOEMs returns the additions to db from the flags and the db_additions
+// of the configuration
+func enrollOEMs(state *config.State) []string {
+	oems := []string{}
+	if enrollKeysCmdOptions.MicrosoftKeys {
+		oems = append(oems, "microsoft")
+	}
+	if enrollKeysCmdOptions.TPMEventlogChecksums {
+		oems = append(oems, "tpm-eventlog")
+	}
+	if enrollKeysCmdOptions.PCIOpromChecksums {
+		oems = append(oems, "pci-oprom")
+	}
+	if enrollKeysCmdOptions.Custom {
+		oems = append(oems, "custom")
 	}
-	return em.Bytes(), nil
+	if len(enrollKeysCmdOptions.BuiltinFirmwareCerts) >= 1 {
+		oems = append(oems, "firmware-builtin")
+	}
+
+	for _, k := range state.Config.DbAdditions {
+		if !slices.Contains(oems, k) {
+			oems = append(oems, k)
+		}
+	}
+	return oems
+}
+
+func SignSiglist(k *backend.KeyHierarchy, e efivar.Efivar, sigdb efivar.Marshallable) ([]byte, error) {
+	return sbctl.SignVariable(e, sigdb, k, enrollTimestamp)
 }
 
 // Sync keys from a key directory into efivarfs
@@ -136,12 +198,20 @@ func KeySync(state *config.State, oems []string) error {
 		return err
 	}
 
+	efistate.Timestamp = enrollTimestamp
+
+	if enrollKeysCmdOptions.Dbx != "" {
+		if err := readDbx(state, efistate); err != nil {
+			return fmt.Errorf("could not enroll dbx: %w", err)
+		}
+	}
+
 	// If we want OEM certs, we do that here
 	for _, oem := range oems {
 		switch oem {
 		case "tpm-eventlog":
 			logging.Print("\nWith checksums from the TPM Eventlog...")
-			eventlogDB, err := sbctl.GetEventlogChecksums(state.Fs, systemEventlog)
+			eventlogDB, err := sbctl.GetEventlogChecksums(state.Fs, systemEventlog, systemTPM(state))
 			if err != nil {
 				return fmt.Errorf("could not enroll db keys: %w", err)
 			}
@@ -149,6 +219,16 @@ func KeySync(state *config.State, oems []string) error {
 				return fmt.Errorf("could not find any OpROM entries in the TPM eventlog")
 			}
 			efistate.Db.AppendDatabase(eventlogDB)
+		case "pci-oprom":
+			logging.Print("\nWith checksums of the PCI option ROMs...")
+			opromDB, err := sbctl.GetOptionROMChecksums(state.Fs)
+			if err != nil {
+				return fmt.Errorf("could not enroll db keys: %w", err)
+			}
+			if len((*opromDB)) == 0 {
+				return fmt.Errorf("could not find any EFI images in the PCI option ROMs")
+			}
+			efistate.Db.AppendDatabase(opromDB)
 		case "microsoft":
 			logging.Print("\nWith vendor keys from microsoft...")
 
@@ -204,6 +284,16 @@ func KeySync(state *config.State, oems []string) error {
 	}
 
 	if enrollKeysCmdOptions.Export.Value != "" {
+		// Signed updates prepared in advance are checked against the
+		// variables when the store keeps their timestamps
+		if enrollTimestamp != (util.EFITime{}) && enrollKeysCmdOptions.Export.Value != "esl" {
+			logging.Print("\nSigning the updates with the timestamp %s...", sbctl.FormatEFITime(enrollTimestamp))
+			for _, ev := range []efivar.Efivar{efivar.Db, efivar.Dbx, efivar.KEK, efivar.PK} {
+				if err := sbctl.CheckTimestamp(state.Efivarfs, ev, enrollTimestamp); err != nil {
+					return err
+				}
+			}
+		}
 		if enrollKeysCmdOptions.Export.Value == "auth" {
 			logging.Print("\nExporting as auth files...")
 			sigdb, err := SignSiglist(kh, efivar.Db, efistate.Db)
@@ -228,6 +318,15 @@ func KeySync(state *config.State, oems []string) error {
 			if err := fs.WriteFile(state.Fs, "PK.auth", sigpk, 0o644); err != nil {
 				return err
 			}
+			if len(*efistate.Dbx) > 0 {
+				sigdbx, err := SignSiglist(kh, efivar.Dbx, efistate.Dbx)
+				if err != nil {
+					return err
+				}
+				if err := fs.WriteFile(state.Fs, "dbx.auth", sigdbx, 0o644); err != nil {
+					return err
+				}
+			}
 		} else if enrollKeysCmdOptions.Export.Value == "esl" {
 			logging.Print("\nExporting as esl files...")
 			if err := fs.WriteFile(state.Fs, "db.esl", efistate.Db.Bytes(), 0o644); err != nil {
@@ -239,6 +338,13 @@ func KeySync(state *config.State, oems []string) error {
 			if err := fs.WriteFile(state.Fs, "PK.esl", efistate.PK.Bytes(), 0o644); err != nil {
 				return err
 			}
+			if len(*efistate.Dbx) > 0 {
+				if err := fs.WriteFile(state.Fs, "dbx.esl", efistate.Dbx.Bytes(), 0o644); err != nil {
+					return err
+				}
+			}
+		} else if enrollKeysCmdOptions.Export.Value == "esp" {
+			return exportESPKeys(state, kh, guid.Format(), efistate)
 		}
 		return nil
 	}
@@ -282,6 +388,27 @@ func RunEnrollKeys(state *config.State) error {
 		return ErrSetupModeDisabled
 	}
 
+	oems := enrollOEMs(state)
+
+	// Nothing is written to the firmware when exporting or writing a variable
+	// store file
+	if enrollKeysCmdOptions.Export.Value == "" && enrollKeysCmdOptions.Target == "" {
+		partial := enrollKeysCmdOptions.Partial.Value
+		op := &quirks.Operation{
+			Name:                 quirks.OpEnrollKeys,
+			RemovesMicrosoftKeys: !enrollKeysCmdOptions.Append && partial != "PK" && !slices.Contains(oems, "microsoft"),
+			Accepted:             enrollKeysCmdOptions.AcceptQuirks,
+			Force:                enrollKeysCmdOptions.Force,
+		}
+		// Custom bytes are enrolled as they are
+		if enrollKeysCmdOptions.CustomBytes == "" {
+			op.KeepMicrosoftKeys = func() { oems = append(oems, "microsoft") }
+		}
+		if err := guardQuirks(state, op); err != nil {
+			return err
+		}
+	}
+
 	if enrollKeysCmdOptions.CustomBytes != "" {
 		if enrollKeysCmdOptions.Partial.Value == "" {
 			logging.NotOk("")
@@ -302,34 +429,13 @@ func RunEnrollKeys(state *config.State) error {
 		return nil
 	}
 
-	oems := []string{}
-	if enrollKeysCmdOptions.MicrosoftKeys {
-		oems = append(oems, "microsoft")
-	}
-	if enrollKeysCmdOptions.TPMEventlogChecksums {
-		oems = append(oems, "tpm-eventlog")
-	}
-	if enrollKeysCmdOptions.Custom {
-		oems = append(oems, "custom")
-	}
-	if len(enrollKeysCmdOptions.BuiltinFirmwareCerts) >= 1 {
-		oems = append(oems, "firmware-builtin")
-	}
-
-	if len(state.Config.DbAdditions) != 0 {
-		for _, k := range state.Config.DbAdditions {
-			if !slices.Contains(oems, k) {
-				oems = append(oems, k)
-			}
-		}
-	}
-
-	if !enrollKeysCmdOptions.IgnoreImmutable && enrollKeysCmdOptions.Export.Value == "" {
+	if !enrollKeysCmdOptions.IgnoreImmutable && enrollKeysCmdOptions.Export.Value == "" && enrollKeysCmdOptions.Target == "" {
 		if err := sbctl.CheckImmutable(state.Fs); err != nil {
 			return err
 		}
 	}
-	if !enrollKeysCmdOptions.Force && !enrollKeysCmdOptions.TPMEventlogChecksums && !enrollKeysCmdOptions.MicrosoftKeys && !enrollKeysCmdOptions.Append {
+	// The option ROMs of the host say nothing about a virtual machine
+	if !enrollKeysCmdOptions.Force && !enrollKeysCmdOptions.TPMEventlogChecksums && !enrollKeysCmdOptions.PCIOpromChecksums && !slices.Contains(oems, "microsoft") && !enrollKeysCmdOptions.Append && enrollKeysCmdOptions.Target == "" {
 		if err := sbctl.CheckEventlogOprom(state.Fs, systemEventlog); err != nil {
 			return err
 		}
@@ -352,6 +458,97 @@ func RunEnrollKeys(state *config.State) error {
 	return nil
 }
 
+// exportESPKeys writes the signed variables to the ESP in the order they should
+// be enrolled
+func exportESPKeys(state *config.State, kh *backend.KeyHierarchy, guid string, efistate *sbctl.EFIVariables) error {
+	esp, err := sbctl.FindESP(state)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(esp, sbctl.ESPKeysDir)
+	logging.Print("\nExporting as auth files to %s...", dir)
+
+	// Keep the revocations of the firmware unless dbx is replaced
+	if len(*efistate.Dbx) == 0 {
+		if dbx, err := state.Efivarfs.Getdbx(); err == nil {
+			efistate.Dbx = dbx
+		}
+	}
+
+	var payloads []sbctl.ESPKeysPayload
+	for _, v := range []struct {
+		e        efivar.Efivar
+		signedBy string
+		sigdb    *signature.SignatureDatabase
+	}{
+		{efivar.Db, "KEK", efistate.Db},
+		{efivar.Dbx, "KEK", efistate.Dbx},
+		{efivar.KEK, "PK", efistate.KEK},
+		{efivar.PK, "PK", efistate.PK},
+	} {
+		if len(*v.sigdb) == 0 {
+			continue
+		}
+		b, err := SignSiglist(kh, v.e, v.sigdb)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, sbctl.ESPKeysPayload{Variable: v.e.Name, SignedBy: v.signedBy, Data: b})
+	}
+	m, err := sbctl.WriteESPKeys(state.Fs, dir, guid, payloads)
+	if err != nil {
+		return err
+	}
+	for _, f := range m.Files {
+		logging.Print("\n  %s", filepath.Join(dir, f.Name))
+	}
+	logging.Print("\nEnroll the files in this order from the firmware setup or an enrollment tool, and remove them with \"sbctl remove-esp-keys\" afterwards.")
+	return nil
+}
+
+// readDbx reads the signature list given with --dbx into dbx
+func readDbx(state *config.State, efistate *sbctl.EFIVariables) error {
+	b, err := fs.ReadFile(state.Fs, enrollKeysCmdOptions.Dbx)
+	if err != nil {
+		return err
+	}
+	dbx, err := signature.ReadSignatureDatabase(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%s is not an EFI signature list: %w", enrollKeysCmdOptions.Dbx, err)
+	}
+	if enrollKeysCmdOptions.Append {
+		old, err := state.Efivarfs.Getdbx()
+		if err == nil {
+			efistate.Dbx.AppendDatabase(old)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	efistate.Dbx.AppendDatabase(&dbx)
+	return nil
+}
+
+// RunEnrollTarget enrolls the keys into an OVMF variable store file instead of
+// the firmware
+func RunEnrollTarget(state *config.State) error {
+	store, err := sbctl.ReadOVMFVarStore(state.Fs, enrollKeysCmdOptions.Target)
+	if err != nil {
+		return err
+	}
+	state.Efivarfs = store.Efivarfs()
+	if err := RunEnrollKeys(state); err != nil {
+		return err
+	}
+	if enrollKeysCmdOptions.Export.Value != "" {
+		return nil
+	}
+	if err := store.WriteFile(state.Fs, enrollKeysCmdOptions.Target); err != nil {
+		return err
+	}
+	logging.Ok("Wrote the variable store to %s", enrollKeysCmdOptions.Target)
+	return nil
+}
+
 // write custom key from a filePath into an efivar
 func customKey(vfs afero.Fs, hierarchy string, filePath string) error {
 	customBytes, err := fs.ReadFile(vfs, filePath)
@@ -379,6 +576,7 @@ func vendorFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.BoolVarP(&enrollKeysCmdOptions.MicrosoftKeys, "microsoft", "m", false, "include microsoft keys into key enrollment")
 	f.BoolVarP(&enrollKeysCmdOptions.TPMEventlogChecksums, "tpm-eventlog", "t", false, "include TPM eventlog checksums into the db database")
+	f.BoolVarP(&enrollKeysCmdOptions.PCIOpromChecksums, "pci-oprom", "", false, "include checksums of the PCI option ROMs into the db database")
 	f.BoolVarP(&enrollKeysCmdOptions.Custom, "custom", "c", false, "include custom db and KEK")
 	// f.BoolVarP(&enrollKeysCmdOptions.BuiltinFirmwareCerts, "firmware-builtin", "f", false, "include keys indicated by the firmware as being part of the default database")
 	l := f.VarPF(&enrollKeysCmdOptions.BuiltinFirmwareCerts, "firmware-builtin", "f", "include keys indicated by the firmware as being part of the default database")
@@ -391,16 +589,21 @@ func enrollKeysCmdFlags(cmd *cobra.Command) {
 	f.BoolVarP(&enrollKeysCmdOptions.Force, "yolo", "", false, "yolo")
 	f.MarkHidden("yolo")
 	f.BoolVarP(&enrollKeysCmdOptions.IgnoreImmutable, "ignore-immutable", "i", false, "ignore checking for immutable efivarfs files")
-	f.VarPF(&enrollKeysCmdOptions.Export, "export", "", "export the EFI database values to current directory instead of enrolling")
+	f.VarPF(&enrollKeysCmdOptions.Export, "export", "", "export the EFI database values to current directory, or to the ESP with esp, instead of enrolling")
 	f.VarPF(&enrollKeysCmdOptions.Partial, "partial", "p", "enroll a partial set of keys")
 	f.StringVarP(&enrollKeysCmdOptions.CustomBytes, "custom-bytes", "", "", "path to the bytefile to be enrolled to efivar")
+	f.StringVarP(&enrollKeysCmdOptions.Target, "target", "", "", "enroll the keys into an OVMF variable store file instead of the firmware")
+	f.StringVarP(&enrollKeysCmdOptions.Timestamp, "timestamp", "", "", "timestamp of the signed updates, as RFC 3339 or @<unix seconds>")
+	f.StringVarP(&enrollKeysCmdOptions.Dbx, "dbx", "", "", "EFI signature list with revoked hashes and certificates to enroll into dbx")
 	f.BoolVarP(&enrollKeysCmdOptions.Append, "append", "a", false, "append the key to the existing ones")
+	f.StringSliceVarP(&enrollKeysCmdOptions.AcceptQuirks, "accept-quirk", "", []string{}, "enroll keys despite the given firmware quirks, e.g. FQ0001")
 }
 
 func init() {
 	enrollKeysCmdFlags(enrollKeysCmd)
 	vendorFlags(enrollKeysCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: enrollKeysCmd,
+		Cmd:   enrollKeysCmd,
+		Audit: true,
 	})
 }
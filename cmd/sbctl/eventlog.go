@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type EventlogCmdOptions struct {
+	Eventlog string
+	All      bool
+}
+
+var (
+	eventlogCmdOptions = EventlogCmdOptions{}
+	eventlogCmd        = &cobra.Command{
+		Use:   "eventlog",
+		Short: "Analyze the TPM eventlog for option ROMs and boot components",
+		RunE:  RunEventlog,
+	}
+)
+
+func RunEventlog(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	eventlog, err := filepath.Abs(eventlogCmdOptions.Eventlog)
+	if err != nil {
+		return err
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(eventlog).IgnoreIfMissing(),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	log, err := sbctl.ParseEventlog(state.Fs, eventlog)
+	if err != nil {
+		return fmt.Errorf("failed reading eventlog %s: %w", eventlog, err)
+	}
+
+	// The enrolled db is only used to tell if an authority is still enrolled
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var report *sbctl.EventlogReport
+	if efistate != nil {
+		report, err = sbctl.AnalyzeEventlog(log, efistate.Db)
+	} else {
+		report, err = sbctl.AnalyzeEventlog(log, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cmdOptions.JsonOutput {
+		return JsonOut(report)
+	}
+	printEventlogReport(report)
+	return nil
+}
+
+// systemTPM returns the TPM of the system, or nil when there is none
+func systemTPM(state *config.State) transport.TPM {
+	if !state.HasTPM() {
+		return nil
+	}
+	if rwc := state.TPM(); rwc != nil {
+		return rwc
+	}
+	return nil
+}
+
+func printEventlogReport(report *sbctl.EventlogReport) {
+	logging.Print("Banks:\t\t")
+	logging.Println(strings.Join(report.Banks, ", "))
+	logging.Println("Loaded images:")
+	for _, image := range report.Images {
+		if !image.OptionROM && !eventlogCmdOptions.All {
+			continue
+		}
+		logging.Print("  PCR %d %s\n", image.PCR, image.Type)
+		logging.Print("\t%s\n", image.DevicePath)
+		for _, bank := range report.Banks {
+			if d, ok := image.Digests[bank]; ok {
+				logging.Print("\t%s: %s\n", bank, d)
+			}
+		}
+		switch {
+		case image.Authority != nil:
+			logging.Print("\tAuthority: %s\n", image.Authority)
+		case image.AuthorityUnknown:
+			logging.Print("\tAuthority: unknown\n")
+		}
+	}
+	if !eventlogCmdOptions.All && slices.ContainsFunc(report.Images, func(i *sbctl.EventlogImage) bool { return !i.OptionROM }) {
+		logging.Println("  Use --all to list the boot components as well")
+	}
+
+	logging.Print("Option ROMs:\t%d\n", report.OptionROMs)
+	logging.Print("Recommendation:\t")
+	switch report.Recommendation {
+	case sbctl.RecommendNothing:
+		logging.Ok("No option ROMs were loaded, no vendor keys are needed")
+	case sbctl.RecommendMicrosoft:
+		logging.Print("%s", logging.Warnf("Option ROMs are signed by Microsoft, enroll keys with --microsoft"))
+	case sbctl.RecommendTPMEventlog:
+		logging.Print("%s", logging.Warnf("Option ROMs are not verified by Microsoft keys, enroll keys with --tpm-eventlog"))
+	}
+}
+
+func eventlogCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&eventlogCmdOptions.Eventlog, "eventlog", "e", systemEventlog, "path to the TPM eventlog")
+	f.BoolVarP(&eventlogCmdOptions.All, "all", "a", false, "list all loaded images, not only option ROMs")
+}
+
+func init() {
+	eventlogCmdFlags(eventlogCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: eventlogCmd,
+	})
+}
@@ -24,33 +24,64 @@ var generateBundlesCmd = &cobra.Command{
 
 		logging.Errorf("The bundle/uki support in sbctl is deprecated. Please move to dracut/mkinitcpio/ukify.")
 
+		replicas, err := sbctl.FindReplicas(state)
+		if err != nil {
+			return err
+		}
+
 		logging.Println("Generating EFI bundles....")
 		out_create := true
 		out_sign := true
 		var out_err error
-		err := sbctl.BundleIter(state, func(bundle *sbctl.Bundle) error {
-			err := sbctl.CreateBundle(state, *bundle)
-			if err != nil {
+		err = sbctl.BundleIter(state, func(bundle *sbctl.Bundle) error {
+			var signFn func(string) error
+			var signErr error
+			if sign {
+				kh, err := backend.GetKeyHierarchy(state.Fs, state)
+				if err != nil {
+					return err
+				}
+				// Sign the bundle before it replaces the installed one
+				signFn = func(file string) error {
+					err := sbctl.SignFile(state, kh, hierarchy.Db, file, file)
+					if err != nil && !errors.Is(err, sbctl.ErrAlreadySigned) {
+						signErr = fmt.Errorf("failed signing bundle %s: %w", bundle.Output, err)
+						return signErr
+					}
+					return nil
+				}
+			}
+			err := sbctl.CreateBundle(state, *bundle, signFn)
+			if signErr != nil {
+				out_sign = false
+				out_err = signErr
+				return nil
+			} else if err != nil {
 				out_create = false
 				out_err = fmt.Errorf("failed creating bundle %s: %w", bundle.Output, err)
 				return nil
 			}
-			logging.Print("Wrote EFI bundle %s\n", bundle.Output)
+			logging.Print("Wrote EFI bundle %s\n", bundle.InstallPath())
 			if sign {
-				file := bundle.Output
-				kh, err := backend.GetKeyHierarchy(state.Fs, state)
+				logging.Ok("Signed %s", bundle.InstallPath())
+			}
+			var entry *sbctl.BootEntry
+			if bundle.BootEntry {
+				entry, err = sbctl.WriteBootEntry(state, bundle)
 				if err != nil {
-					return err
-				}
-				err = sbctl.SignFile(state, kh, hierarchy.Db, file, file)
-				if errors.Is(err, sbctl.ErrAlreadySigned) {
-					logging.Unknown("Bundle has already been signed")
-				} else if err != nil {
-					out_sign = false
-					out_err = fmt.Errorf("failed signing bundle %s: %w", bundle.Output, err)
-				} else {
-					logging.Ok("Signed %s", file)
+					out_create = false
+					out_err = fmt.Errorf("failed writing boot entry for bundle %s: %w", bundle.Output, err)
+					return nil
 				}
+				logging.Print("Wrote boot entry %s\n", entry.Path)
+			}
+			written, err := replicas.MirrorBundle(state.Fs, bundle, entry)
+			for _, f := range written {
+				logging.Print("Mirrored %s\n", f)
+			}
+			if err != nil {
+				out_create = false
+				out_err = fmt.Errorf("failed mirroring bundle %s: %w", bundle.Output, err)
 			}
 			return nil
 		})
@@ -60,10 +91,87 @@ var generateBundlesCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		return nil
+		return RemoveStaleBundles(state, replicas)
 	},
 }
 
+// RemoveStaleBundles removes the outputs the bundles generated before, but no
+// longer generate, like the bundles of kernels which are no longer installed,
+// and the outputs of bundles removed from the configuration file. The outputs
+// the bundles generate now are recorded in the bundle database.
+func RemoveStaleBundles(state *config.State, replicas *sbctl.Replicas) error {
+	bundles, err := sbctl.ReadBundles(state)
+	if err != nil {
+		return err
+	}
+	removed, err := sbctl.RemovedBundles(state)
+	if err != nil {
+		return err
+	}
+	for _, bundle := range removed {
+		stale, err := bundle.RemovedOutputs(state.Fs, bundles)
+		if err != nil {
+			return err
+		}
+		if err := removeStaleOutputs(state, replicas, bundle, stale); err != nil {
+			return err
+		}
+	}
+	for _, bundle := range bundles {
+		stale, err := bundle.StaleOutputs(state.Fs, bundles)
+		if err != nil {
+			return err
+		}
+		if err := removeStaleOutputs(state, replicas, bundle, stale); err != nil {
+			return err
+		}
+		if bundle.Generated, err = bundle.GeneratedOutputs(state.Fs); err != nil {
+			return err
+		}
+	}
+	return sbctl.RecordGenerated(state, bundles)
+}
+
+// removeStaleOutputs removes the installed files of the outputs of a bundle,
+// their copies in the replicas and their boot entries
+func removeStaleOutputs(state *config.State, replicas *sbctl.Replicas, bundle *sbctl.Bundle, stale []string) error {
+	for _, output := range stale {
+		files, err := sbctl.OutputFiles(state.Fs, output)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := state.Fs.Remove(f); err != nil {
+				return fmt.Errorf("failed removing stale bundle %s: %w", f, err)
+			}
+			logging.Print("Removed stale EFI bundle %s\n", f)
+			if err := replicas.RemoveBundle(state.Fs, bundle, f); err != nil {
+				return fmt.Errorf("failed removing stale bundle %s from replicas: %w", f, err)
+			}
+		}
+		if bundle.BootEntry {
+			if err := removeBootEntry(state, bundle, output); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func removeBootEntry(state *config.State, bundle *sbctl.Bundle, output string) error {
+	esp := bundle.ESP
+	if esp == "" {
+		var err error
+		if esp, err = sbctl.FindESP(state); err != nil {
+			return err
+		}
+	}
+	if err := sbctl.RemoveBootEntry(state.Fs, esp, output); err != nil {
+		return fmt.Errorf("failed removing boot entry for bundle %s: %w", output, err)
+	}
+	return nil
+}
+
 func generateBundlesCmdFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.BoolVarP(&sign, "sign", "s", false, "Sign all the generated bundles")
@@ -72,6 +180,7 @@ func generateBundlesCmdFlags(cmd *cobra.Command) {
 func init() {
 	generateBundlesCmdFlags(generateBundlesCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: generateBundlesCmd,
+		Cmd:   generateBundlesCmd,
+		Audit: true,
 	})
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/dmi"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+// JsonHWIDs is the JSON output of the hwids command. The DMI fields can be
+// used for the devicetrees of a bundle.
+type JsonHWIDs struct {
+	DMI   map[string]string `json:"dmi"`
+	HWIDs []dmi.CHID        `json:"hwids"`
+}
+
+var hwidsCmd = &cobra.Command{
+	Use:   "hwids",
+	Short: "Show the hardware IDs of the system",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+		if state.Config.Landlock {
+			lsm.RestrictAdditionalPaths(
+				landlock.RODirs("/sys/devices/virtual/dmi/id").IgnoreIfMissing(),
+			)
+			if err := lsm.Restrict(); err != nil {
+				return err
+			}
+		}
+
+		table := dmi.ParseDMI(state)
+		chids := table.CHIDs()
+		if cmdOptions.JsonOutput {
+			return JsonOut(JsonHWIDs{DMI: table.Fields(), HWIDs: chids})
+		}
+		for _, chid := range chids {
+			logging.Print("%2d: %s <- %s\n", chid.Type, chid.ID, strings.Join(chid.Fields, " + "))
+		}
+		return nil
+	},
+}
+
+func init() {
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: hwidsCmd,
+	})
+}
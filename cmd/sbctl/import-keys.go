@@ -178,6 +178,7 @@ func importKeysCmdFlags(cmd *cobra.Command) {
 func init() {
 	importKeysCmdFlags(importKeysCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: importKeysCmd,
+		Cmd:   importKeysCmd,
+		Audit: true,
 	})
 }
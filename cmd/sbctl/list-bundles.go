@@ -58,11 +58,14 @@ var listBundlesCmd = &cobra.Command{
 					isSigned = false
 					logging.NotOk("Not Signed")
 				}
-				esp, err := sbctl.GetESP(state.Fs)
+				esp, err := sbctl.FindESP(state)
 				if err != nil {
 					return err
 				}
 				logging.Print("\tESP Location:\t%s\n", esp)
+				if s.Arch != "" {
+					logging.Print("\tArchitecture:\t%s\n", s.Arch)
+				}
 				logging.Print("\tOutput:\t\t└─%s\n", strings.TrimPrefix(s.Output, esp))
 				logging.Print("\tEFI Stub Image:\t  └─%s\n", s.EFIStub)
 				if s.Splash != "" {
@@ -78,6 +81,9 @@ var listBundlesCmd = &cobra.Command{
 				if s.IntelMicrocode != "" {
 					logging.Print("\tIntel Microcode:      └─%s\n", s.IntelMicrocode)
 				}
+				for _, d := range s.Devicetrees {
+					logging.Print("\tDevicetree:\t    %s\n", d.Path)
+				}
 				bundles = append(bundles, JsonBundle{*s, isSigned})
 				logging.Println("")
 				return nil
@@ -4,59 +4,77 @@ import (
 	"crypto/x509"
 	"fmt"
 
-	"github.com/foxboron/go-uefi/efi"
 	"github.com/foxboron/go-uefi/efi/signature"
 	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/cobra"
 )
 
-var listKeysCmd = &cobra.Command{
-	Use: "list-enrolled-keys",
-	Aliases: []string{
-		"ls-enrolled-keys",
-	},
-	Short: "List enrolled keys on the system",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		state := cmd.Context().Value(stateDataKey{}).(*config.State)
-		if state.Config.Landlock {
-			if err := lsm.Restrict(); err != nil {
-				return err
-			}
-		}
+type ListKeysCmdOptions struct {
+	Source string
+}
 
-		var err error
-		certList := map[string]([]*x509.Certificate){}
+var (
+	listKeysCmdOptions = ListKeysCmdOptions{}
+	listKeysCmd        = &cobra.Command{
+		Use: "list-enrolled-keys",
+		Aliases: []string{
+			"ls-enrolled-keys",
+		},
+		Short: "List enrolled keys on the system",
+		RunE:  RunListKeys,
+	}
+)
 
-		pk, err := efi.GetPK()
-		if err != nil {
-			return err
+func RunListKeys(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	if state.Config.Landlock {
+		if listKeysCmdOptions.Source != "" {
+			lsm.RestrictAdditionalPaths(
+				landlock.ROFiles(listKeysCmdOptions.Source),
+			)
 		}
-		kek, err := efi.GetKEK()
-		if err != nil {
+		if err := lsm.Restrict(); err != nil {
 			return err
 		}
-		db, err := efi.Getdb()
+	}
+
+	if listKeysCmdOptions.Source != "" {
+		store, err := sbctl.ReadOVMFVarStore(state.Fs, listKeysCmdOptions.Source)
 		if err != nil {
 			return err
 		}
+		state.Efivarfs = store.Efivarfs()
+	}
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		return fmt.Errorf("can't read efivariables: %v", err)
+	}
 
-		certList["PK"] = ExtractCertsFromSignatureDatabase(pk)
-		certList["KEK"] = ExtractCertsFromSignatureDatabase(kek)
-		certList["DB"] = ExtractCertsFromSignatureDatabase(db)
+	certList := map[string]([]*x509.Certificate){}
+	certList["PK"] = ExtractCertsFromSignatureDatabase(efistate.PK)
+	certList["KEK"] = ExtractCertsFromSignatureDatabase(efistate.KEK)
+	certList["DB"] = ExtractCertsFromSignatureDatabase(efistate.Db)
 
-		if cmdOptions.JsonOutput {
-			return JsonOut(certList)
-		}
+	if cmdOptions.JsonOutput {
+		return JsonOut(certList)
+	}
 
-		printCertsPlainText(certList)
+	printCertsPlainText(certList)
+
+	return nil
+}
 
-		return nil
-	},
+func listKeysCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&listKeysCmdOptions.Source, "source", "", "", "list the keys in an OVMF variable store file instead of the firmware")
 }
 
 func init() {
+	listKeysCmdFlags(listKeysCmd)
 	CliCommands = append(CliCommands, cliCommand{
 		Cmd: listKeysCmd,
 	})
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+)
+
+var listOptionROMsCmd = &cobra.Command{
+	Use: "list-option-roms",
+	Aliases: []string{
+		"ls-option-roms",
+	},
+	Short: "List the option ROMs of the PCI devices",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+		if state.Config.Landlock {
+			lsm.RestrictAdditionalPaths(sbctl.OptionROMLandlockRules()...)
+			if err := lsm.Restrict(); err != nil {
+				return err
+			}
+		}
+
+		roms, err := sbctl.GetOptionROMs(state.Fs)
+		if err != nil {
+			return err
+		}
+		if cmdOptions.JsonOutput {
+			return JsonOut(roms)
+		}
+		printOptionROMs(roms)
+		return nil
+	},
+}
+
+func printOptionROMs(roms []*sbctl.OptionROM) {
+	for _, rom := range roms {
+		logging.Println(rom.Device)
+		for _, image := range rom.Images {
+			logging.Print("  0x%06x %s:%s %s", image.Offset, image.VendorID, image.DeviceID, image.CodeType)
+			if image.Machine != "" {
+				logging.Print(" %s", image.Machine)
+			}
+			logging.Println("")
+			if !image.EFI() {
+				continue
+			}
+			if image.Compressed {
+				logging.Print("\t%s", logging.Warnf("Compressed image, the checksum can't be calculated"))
+				continue
+			}
+			logging.Print("\tsha256: %s\n", image.Digest)
+			if len(image.Signers) > 0 {
+				logging.Print("\tSigned by: %s\n", strings.Join(image.Signers, ", "))
+			}
+			if image.Authority != "" {
+				logging.Print("\tAuthority: %s (%s)\n", image.Authority, image.Vendor)
+			}
+		}
+	}
+}
+
+func init() {
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: listOptionROMsCmd,
+	})
+}
@@ -10,12 +10,14 @@ import (
 	"os"
 	"strings"
 
+	efs "github.com/foxboron/go-uefi/efi/fs"
 	"github.com/foxboron/go-uefi/efivarfs"
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
@@ -26,10 +28,14 @@ type CmdOptions struct {
 	Config          string
 	DisableLandlock bool
 	Debug           bool
+	Root            string
+	Efivars         string
 }
 
 type cliCommand struct {
 	Cmd *cobra.Command
+	// Audit records the command in the audit log
+	Audit bool
 }
 
 type stateDataKey struct{}
@@ -46,9 +52,10 @@ var (
 	}
 	baseErrorMsg = `
 
-There are three flags that can be used:
+There are four flags that can be used:
     --microsoft: Enroll the Microsoft OEM certificates into the signature database.
     --tpm-eventlog: Enroll OpRom checksums into the signature database (experimental!).
+    --pci-oprom: Enroll checksums of the OpRoms read from the PCI devices into the signature database (experimental!).
     --yes-this-might-brick-my-machine: Ignore this warning and continue regardless.
 
 Please read the FAQ for more information: https://github.com/Foxboron/sbctl/wiki/FAQ#option-rom`
@@ -64,6 +71,37 @@ func baseFlags(cmd *cobra.Command) {
 	flags.BoolVar(&cmdOptions.DisableLandlock, "disable-landlock", false, "Disable landlock sandboxing")
 	flags.BoolVar(&cmdOptions.Debug, "debug", false, "Enable verbose debug logging")
 	flags.StringVarP(&cmdOptions.Config, "config", "", "", "Path to configuration file")
+	flags.StringVarP(&cmdOptions.Root, "root", "", "", "Operate on the files in a root directory instead of the running system")
+	flags.StringVarP(&cmdOptions.Efivars, "efivars", "", "", "Read and write EFI variables in a directory instead of the firmware")
+}
+
+// offlineState points the state at a root directory and a directory of EFI
+// variables, so images can be prepared without touching the running system
+func offlineState(state *config.State) error {
+	if cmdOptions.Root != "" {
+		if fi, err := os.Stat(cmdOptions.Root); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", cmdOptions.Root)
+		}
+		state.Fs = afero.NewBasePathFs(state.Fs, cmdOptions.Root)
+	}
+	if cmdOptions.Efivars != "" {
+		if err := os.MkdirAll(cmdOptions.Efivars, 0o755); err != nil {
+			return err
+		}
+		vfs := sbctl.NewEfivarsDirFs(cmdOptions.Efivars)
+		// The older go-uefi functions read the variables from this filesystem
+		efs.SetFS(vfs)
+		state.Efivarfs = sbctl.NewVirtualEfivarfs(vfs)
+	} else if cmdOptions.Root != "" {
+		// The firmware of the host is never written when operating on a
+		// root directory. enroll-keys --target replaces the variables with
+		// the ones of the variable store.
+		efs.SetFS(afero.NewReadOnlyFs(afero.NewOsFs()))
+		state.Efivarfs = sbctl.ReadOnlyEfivarfs(state.Efivarfs)
+	}
+	return nil
 }
 
 func JsonOut(v interface{}) error {
@@ -80,6 +118,9 @@ func JsonOut(v interface{}) error {
 
 func main() {
 	for _, cmd := range CliCommands {
+		if cmd.Audit {
+			auditCommand(cmd.Cmd)
+		}
 		rootCmd.AddCommand(cmd.Cmd)
 	}
 
@@ -106,6 +147,9 @@ func main() {
 				UnsetImmutable().
 				Open(),
 		}
+		if err := offlineState(state); err != nil {
+			return err
+		}
 
 		var conf *config.Config
 
@@ -130,12 +174,13 @@ func main() {
 			// state.Config.Keys = kh.GetConfig(state.Config.Keydir)
 			// state.Config.DbAdditions = sbctl.GetEnrolledVendorCerts()
 		} else {
+			fs := state.Fs
 			if config.HasOldConfig(fs, sbctl.DatabasePath) && !config.HasConfigurationFile(fs, "/etc/sbctl/sbctl.conf") {
 				logging.Error(fmt.Errorf("old configuration detected. Please use `sbctl setup --migrate`"))
 				conf = config.OldConfig(sbctl.DatabasePath)
 				state.Config = conf
 			} else if ok, _ := afero.Exists(fs, "/etc/sbctl/sbctl.conf"); ok {
-				b, err := os.ReadFile("/etc/sbctl/sbctl.conf")
+				b, err := afero.ReadFile(fs, "/etc/sbctl/sbctl.conf")
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -159,6 +204,11 @@ func main() {
 		if cmdOptions.DisableLandlock {
 			state.Config.Landlock = false
 		}
+		if cmdOptions.Root != "" {
+			// The landlock rules are written for the paths of the running system
+			slog.Debug("landlock is disabled with --root")
+			state.Config.Landlock = false
+		}
 
 		// Setup debug logging
 		opts := &slog.HandlerOptions{
@@ -176,6 +226,9 @@ func main() {
 
 		if state.Config.Landlock {
 			lsm.LandlockRulesFromConfig(state.Config)
+			if cmdOptions.Efivars != "" {
+				lsm.RestrictAdditionalPaths(landlock.RWDirs(cmdOptions.Efivars))
+			}
 		}
 		ctx := context.WithValue(cmd.Context(), stateDataKey{}, state)
 		cmd.SetContext(ctx)
@@ -192,6 +245,8 @@ func main() {
 	if err := rootCmd.Execute(); err != nil {
 		if strings.HasPrefix(err.Error(), "unknown command") {
 			logging.Println(err.Error())
+		} else if errors.Is(err, sbctl.ErrReadOnlyEfivars) {
+			logging.Error(fmt.Errorf("%w, use --efivars or enroll-keys --target to write EFI variables with --root", err))
 		} else if errors.Is(err, os.ErrPermission) {
 			logging.Error(fmt.Errorf("sbctl requires root to run: %w", err))
 		} else if errors.Is(err, sbctl.ErrImmutable) {
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type MetricsCmdOptions struct {
+	Output string
+}
+
+var (
+	metricsCmdOptions = MetricsCmdOptions{}
+	metricsCmd        = &cobra.Command{
+		Use:   "metrics",
+		Short: "Print the Secure Boot status as Prometheus metrics",
+		RunE:  RunMetrics,
+	}
+)
+
+// metrics writes the Prometheus text exposition format
+type metrics struct {
+	strings.Builder
+}
+
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+func sample(value float64, labels ...string) metricSample {
+	return metricSample{labels: labels, value: value}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metrics) gauge(name, help string, samples ...metricSample) {
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(m, "# HELP sbctl_%s %s\n", name, help)
+	fmt.Fprintf(m, "# TYPE sbctl_%s gauge\n", name)
+	for _, s := range samples {
+		var labels []string
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1])))
+		}
+		if len(labels) > 0 {
+			fmt.Fprintf(m, "sbctl_%s{%s} %v\n", name, strings.Join(labels, ","), s.value)
+		} else {
+			fmt.Fprintf(m, "sbctl_%s %v\n", name, s.value)
+		}
+	}
+}
+
+// unsignedFiles counts the files in the file database, and the files which are
+// missing, not PE/COFF binaries or not signed by the db key
+func unsignedFiles(state *config.State, kh *backend.KeyHierarchy) (int, int, error) {
+	var total, unsigned int
+	err := sbctl.SigningEntryIter(state, func(file *sbctl.SigningEntry) error {
+		total++
+		ok, err := signedFile(state, kh, file.OutputFile)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			unsigned++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return total, unsigned, nil
+}
+
+func signedFile(state *config.State, kh *backend.KeyHierarchy, file string) (bool, error) {
+	f, err := state.Fs.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if ok, err := sbctl.CheckMSDos(f); err != nil || !ok {
+		return false, nil
+	}
+	return sbctl.VerifyFile(state, kh, hierarchy.Db, file)
+}
+
+func RunMetrics(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if state.Config.Landlock {
+		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
+			return err
+		}
+		if metricsCmdOptions.Output != "" {
+			output, err := filepath.Abs(metricsCmdOptions.Output)
+			if err != nil {
+				return err
+			}
+			lsm.RestrictAdditionalPaths(
+				landlock.RWDirs(filepath.Dir(output)),
+			)
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	// Only the metrics are printed, errors are printed by main
+	logging.PrintOff()
+	defer logging.PrintOn()
+	stat, err := GetStatus(state)
+	if err != nil {
+		return err
+	}
+
+	var m metrics
+	m.gauge("secure_boot_enabled", "Whether Secure Boot is enabled.", sample(boolValue(stat.SecureBoot)))
+	m.gauge("setup_mode_enabled", "Whether the firmware is in Setup Mode.", sample(boolValue(stat.SetupMode)))
+	m.gauge("installed", "Whether sbctl keys have been created.", sample(boolValue(stat.Installed)))
+
+	if stat.Installed {
+		kh, err := backend.GetKeyHierarchy(state.Fs, state)
+		if err != nil {
+			return err
+		}
+		var expiry []metricSample
+		for h, key := range map[string]backend.KeyBackend{"PK": kh.PK, "KEK": kh.KEK, "db": kh.Db} {
+			expiry = append(expiry, sample(float64(key.Certificate().NotAfter.Unix()), "hierarchy", h))
+		}
+		slices.SortFunc(expiry, func(a, b metricSample) int { return strings.Compare(a.labels[1], b.labels[1]) })
+		m.gauge("key_expiry_timestamp_seconds", "Expiry time of the sbctl keys in seconds since the epoch.", expiry...)
+
+		total, unsigned, err := unsignedFiles(state, kh)
+		if err != nil {
+			return err
+		}
+		m.gauge("files", "Number of files in the file database.", sample(float64(total)))
+		m.gauge("files_unsigned", "Number of files in the file database which are not signed.", sample(float64(unsigned)))
+	}
+
+	var vendors []metricSample
+	for _, v := range slices.Compact(slices.Sorted(slices.Values(append(certs.KnownVendors(), stat.Vendors...)))) {
+		vendors = append(vendors, sample(boolValue(slices.Contains(stat.Vendors, v)), "vendor", v))
+	}
+	m.gauge("vendor_keys_enrolled", "Whether the keys of a vendor are enrolled.", vendors...)
+
+	var quirks []metricSample
+	for _, q := range stat.FirmwareQuirks {
+		quirks = append(quirks, sample(1, "id", q.ID, "name", q.Name, "severity", q.Severity))
+	}
+	m.gauge("firmware_quirk", "Known firmware quirks affecting the system.", quirks...)
+
+	var replays []metricSample
+	for _, r := range stat.EventlogReplay {
+		replays = append(replays, sample(boolValue(r.Valid()), "bank", r.Bank))
+	}
+	m.gauge("eventlog_replay_valid", "Whether the TPM eventlog replays to the PCR values.", replays...)
+
+	if metricsCmdOptions.Output == "" {
+		logging.PrintOn()
+		logging.Print("%s", m.String())
+		return nil
+	}
+	// The textfile collector might read the file while it is written
+	tmp := metricsCmdOptions.Output + ".tmp"
+	if err := fs.WriteFile(state.Fs, tmp, []byte(m.String()), 0o644); err != nil {
+		return err
+	}
+	return state.Fs.Rename(tmp, metricsCmdOptions.Output)
+}
+
+func metricsCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&metricsCmdOptions.Output, "output", "o", "", "write the metrics to a file for the node_exporter textfile collector")
+}
+
+func init() {
+	metricsCmdFlags(metricsCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: metricsCmd,
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/sbctl/config"
+)
+
+func TestMetrics(t *testing.T) {
+	cmd := SetFS(
+		fstest.MapFS{"/sys/devices/virtual/dmi/id/bios_date": {Data: []byte("01/06/2023\n")}},
+		fstest.MapFS{"/sys/devices/virtual/dmi/id/bios_version": {Data: []byte("A.30\n")}},
+		fstest.MapFS{"/sys/devices/virtual/dmi/id/board_name": {Data: []byte("PRO Z790-A WIFI (MS-7E07)\n")}},
+		fstest.MapFS{"/sys/devices/virtual/dmi/id/board_vendor": {Data: []byte("Micro-Star International Co., Ltd.\n")}},
+		fstest.MapFS{"/sys/devices/virtual/dmi/id/chassis_type": {Data: []byte("3\n")}},
+		fstest.MapFS{"/sys/devices/virtual/dmi/id/product_name": {Data: []byte("MS-7E07\n")}},
+		efitest.SecureBootOn(),
+		efitest.SetUpModeOff(),
+	)
+	// Landlock would restrict the remaining tests
+	cmd.Context().Value(stateDataKey{}).(*config.State).Config.Landlock = false
+
+	b, err := captureOutput(func() error {
+		return RunMetrics(cmd, []string{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, want := range []string{
+		"# TYPE sbctl_secure_boot_enabled gauge\n",
+		"sbctl_secure_boot_enabled 1\n",
+		"sbctl_installed 0\n",
+		`sbctl_vendor_keys_enrolled{vendor="microsoft"} 0` + "\n",
+		`sbctl_firmware_quirk{id="FQ0001",`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("metrics are missing %q:\n%s", want, out)
+		}
+	}
+}
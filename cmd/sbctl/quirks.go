@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/quirks"
+)
+
+// QuirkGuardResult is the JSON output of the commands guarded by quirks
+type QuirkGuardResult struct {
+	Operation      string            `json:"operation"`
+	QuirkDecisions []quirks.Decision `json:"quirk_decisions"`
+	Error          string            `json:"error,omitempty"`
+}
+
+var quirkDecisions = []quirks.Decision{}
+
+// guardQuirks checks the operation against the guards of the firmware quirks
+// affecting the system. The decisions are kept for the JSON output.
+func guardQuirks(state *config.State, op *quirks.Operation) error {
+	decisions, err := op.Check(quirks.CheckFirmwareQuirks(state))
+	quirkDecisions = append(quirkDecisions, decisions...)
+	for _, d := range decisions {
+		switch d.Decision {
+		case quirks.DecisionRefused:
+			logging.NotOk("%s: %s", d.Quirk, d.Reason)
+		default:
+			logging.Warn("%s: %s", d.Quirk, d.Reason)
+		}
+	}
+	if errors.Is(err, quirks.ErrRefused) {
+		logging.Println("Pass --accept-quirk with the quirk ID to continue regardless.")
+	}
+	return err
+}
+
+// quirkGuardOut writes the quirk decisions of an operation as JSON
+func quirkGuardOut(op string, err error) error {
+	if !cmdOptions.JsonOutput {
+		return err
+	}
+	result := QuirkGuardResult{Operation: op, QuirkDecisions: quirkDecisions}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if jerr := JsonOut(result); jerr != nil {
+		return jerr
+	}
+	return err
+}
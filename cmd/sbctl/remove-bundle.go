@@ -29,10 +29,34 @@ var removeBundleCmd = &cobra.Command{
 			return err
 		}
 
-		if _, ok := bundles[args[0]]; !ok {
+		bundle, ok := bundles[args[0]]
+		if !ok || bundle.FromConfig {
+			for _, b := range state.Config.Bundles {
+				if b.Output == args[0] {
+					logging.Print("Bundle %s is defined in the configuration file and needs to be removed there!\n", args[0])
+					os.Exit(1)
+				}
+			}
+		}
+		if !ok {
 			logging.Print("Bundle %s doesn't exist in database!\n", args[0])
 			os.Exit(1)
 		}
+		if bundle.BootEntry {
+			all, err := sbctl.ReadBundles(state)
+			if err != nil {
+				return err
+			}
+			outputs, err := bundle.OwnedOutputs(state.Fs, all)
+			if err != nil {
+				return err
+			}
+			for _, output := range outputs {
+				if err := removeBootEntry(state, bundle, output); err != nil {
+					return err
+				}
+			}
+		}
 		delete(bundles, args[0])
 		err = sbctl.WriteBundleDatabase(state.Fs, state.Config.BundlesDb, bundles)
 		if err != nil {
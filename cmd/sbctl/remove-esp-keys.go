@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type RemoveESPKeysCmdOptions struct {
+	Force bool
+}
+
+var (
+	removeESPKeysCmdOptions = RemoveESPKeysCmdOptions{}
+	removeESPKeysCmd        = &cobra.Command{
+		Use:   "remove-esp-keys",
+		Short: "Remove the keys exported to the ESP with enroll-keys --export esp",
+		RunE:  RunRemoveESPKeys,
+	}
+)
+
+func RunRemoveESPKeys(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	esp, err := sbctl.FindESP(state)
+	if err != nil {
+		return err
+	}
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.RWDirs(esp),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Join(esp, sbctl.ESPKeysDir)
+	removed, err := sbctl.RemoveESPKeys(state.Fs, dir, removeESPKeysCmdOptions.Force)
+	for _, f := range removed {
+		logging.Ok("Removed %s", f)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Println("No keys have been exported to the ESP")
+		return nil
+	} else if errors.Is(err, sbctl.ErrESPKeysModified) {
+		logging.NotOk("Kept files which have been modified since they were exported, use --force to remove them")
+	}
+	return err
+}
+
+func removeESPKeysCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&removeESPKeysCmdOptions.Force, "force", "", false, "remove files which have been modified since they were exported")
+}
+
+func init() {
+	removeESPKeysCmdFlags(removeESPKeysCmd)
+
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:   removeESPKeysCmd,
+		Audit: true,
+	})
+}
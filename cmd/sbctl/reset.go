@@ -13,13 +13,15 @@ import (
 	"github.com/foxboron/sbctl/fs"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/quirks"
 	"github.com/foxboron/sbctl/stringset"
 	"github.com/spf13/cobra"
 )
 
 type resetCmdOptions struct {
-	Partial   stringset.StringSet
-	CertFiles string
+	Partial      stringset.StringSet
+	CertFiles    string
+	AcceptQuirks []string
 }
 
 var (
@@ -163,21 +165,32 @@ func RunReset(cmd *cobra.Command, args []string) error {
 			return err
 		}
 	}
-	if err := resetKeys(state); err != nil {
-		return err
+	partial := resetCmdOpts.Partial.Value
+	// reset has no --yes-this-might-brick-my-machine, the refused quirks are
+	// only overridden with --accept-quirk
+	op := &quirks.Operation{
+		Name: quirks.OpReset,
+		// Removing only our own certificates keeps the Microsoft keys
+		RemovesMicrosoftKeys: (partial == "KEK" || partial == "db") && resetCmdOpts.CertFiles == "",
+		Accepted:             resetCmdOpts.AcceptQuirks,
 	}
-	return nil
+	if err := guardQuirks(state, op); err != nil {
+		return quirkGuardOut(quirks.OpReset, err)
+	}
+	return quirkGuardOut(quirks.OpReset, resetKeys(state))
 }
 
 func resetKeysCmdFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.VarPF(&resetCmdOpts.Partial, "partial", "p", "reset a partial set of keys")
 	f.StringVarP(&resetCmdOpts.CertFiles, "cert-files", "c", "", "optional paths to certificate file to remove from the hierarchy (separate individual paths by ';')")
+	f.StringSliceVarP(&resetCmdOpts.AcceptQuirks, "accept-quirk", "", []string{}, "reset keys despite the given firmware quirks, e.g. FQ0001")
 }
 
 func init() {
 	resetKeysCmdFlags(resetCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: resetCmd,
+		Cmd:   resetCmd,
+		Audit: true,
 	})
 }
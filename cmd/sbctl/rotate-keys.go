@@ -13,6 +13,7 @@ import (
 	"github.com/foxboron/sbctl/hierarchy"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/quirks"
 	"github.com/foxboron/sbctl/stringset"
 	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/cobra"
@@ -27,6 +28,8 @@ type RotateKeysCmdOptions struct {
 
 	Keytype                          string
 	PKKeytype, KEKKeytype, DbKeytype string
+
+	AcceptQuirks []string
 }
 
 var (
@@ -98,10 +101,16 @@ func RunRotateKeys(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("can't create tmp directory: %v", err)
 	}
 
+	replicas, err := sbctl.FindReplicas(state)
+	if err != nil {
+		return err
+	}
+
 	if state.Config.Landlock {
 		lsm.RestrictAdditionalPaths(
 			landlock.RWDirs(tmpPath),
 		)
+		lsm.RestrictAdditionalPaths(replicas.LandlockRules()...)
 		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
 			return err
 		}
@@ -110,21 +119,28 @@ func RunRotateKeys(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// rotate-keys has no --yes-this-might-brick-my-machine, the refused
+	// quirks are only overridden with --accept-quirk
+	op := &quirks.Operation{
+		Name:     quirks.OpRotateKeys,
+		Accepted: rotateKeysCmdOptions.AcceptQuirks,
+	}
+	if err := guardQuirks(state, op); err != nil {
+		return quirkGuardOut(quirks.OpRotateKeys, err)
+	}
+
 	partial := rotateKeysCmdOptions.Partial.Value
 
 	// rotate all keys if no specific key should be replaced
 	if partial == "" {
-		if err := rotateAllKeys(state, rotateKeysCmdOptions.BackupDir, rotateKeysCmdOptions.NewKeysDir); err != nil {
-			return err
-		}
-
-		return nil
+		err := rotateAllKeys(state, rotateKeysCmdOptions.BackupDir, rotateKeysCmdOptions.NewKeysDir, replicas)
+		return quirkGuardOut(quirks.OpRotateKeys, err)
 	}
 
-	return rotateKey(state, partial, rotateKeysCmdOptions.KeyFile, rotateKeysCmdOptions.CertFile)
+	return quirkGuardOut(quirks.OpRotateKeys, rotateKey(state, partial, rotateKeysCmdOptions.KeyFile, rotateKeysCmdOptions.CertFile))
 }
 
-func rotateAllKeys(state *config.State, backupDir, newKeysDir string) error {
+func rotateAllKeys(state *config.State, backupDir, newKeysDir string, replicas *sbctl.Replicas) error {
 	oldKeys, err := backend.GetKeyHierarchy(state.Fs, state)
 	if err != nil {
 		return fmt.Errorf("can't read old keys from dir: %v", err)
@@ -214,7 +230,7 @@ func rotateAllKeys(state *config.State, backupDir, newKeysDir string) error {
 
 	logging.Ok("Enrolled new keys into UEFI!")
 
-	if err := SignAll(state); err != nil {
+	if err := SignAll(state, replicas); err != nil {
 		return fmt.Errorf("failed resigning files: %v", err)
 	}
 
@@ -320,6 +336,7 @@ func rotateKeysCmdFlags(cmd *cobra.Command) {
 	f.VarPF(&rotateKeysCmdOptions.Partial, "partial", "p", "rotate a key of a specific hierarchy")
 	f.StringVarP(&rotateKeysCmdOptions.KeyFile, "key-file", "k", "", "key file to replace (only with partial flag)")
 	f.StringVarP(&rotateKeysCmdOptions.CertFile, "cert-file", "c", "", "certificate file to replace (only with partial flag)")
+	f.StringSliceVarP(&rotateKeysCmdOptions.AcceptQuirks, "accept-quirk", "", []string{}, "rotate keys despite the given firmware quirks, e.g. FQ0001")
 
 	f.StringVarP(&rotateKeysCmdOptions.Keytype, "keytype", "", "", "key type for all keys")
 	f.StringVarP(&rotateKeysCmdOptions.PKKeytype, "pk-keytype", "", "", "PK key type (default: file)")
@@ -330,6 +347,7 @@ func rotateKeysCmdFlags(cmd *cobra.Command) {
 func init() {
 	rotateKeysCmdFlags(rotateKeysCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: rotateKeysCmd,
+		Cmd:   rotateKeysCmd,
+		Audit: true,
 	})
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
@@ -60,20 +61,43 @@ func PrintConfig(state *config.State) error {
 
 	// Setup the files
 	if ok, _ := afero.Exists(state.Fs, state.Config.FilesDb); ok {
-		var files []*config.FileConfig
-		if err := sbctl.SigningEntryIter(state,
-			func(s *sbctl.SigningEntry) error {
-				files = append(files, &config.FileConfig{
-					Path:   s.File,
-					Output: s.OutputFile,
-				})
-				return nil
-			}); err != nil {
+		// Read the database directly so patterns are kept as they are
+		entries, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+		if err != nil {
 			return err
 		}
+		var files []*config.FileConfig
+		for _, s := range entries {
+			files = append(files, &config.FileConfig{
+				Path:   s.File,
+				Output: s.OutputFile,
+			})
+		}
 		state.Config.Files = files
 	}
 
+	// Setup the bundles, entries from the configuration file are kept as they
+	// are
+	if ok, _ := afero.Exists(state.Fs, state.Config.BundlesDb); ok {
+		bundles, err := sbctl.ReadBundleDatabase(state.Fs, state.Config.BundlesDb)
+		if err != nil {
+			return err
+		}
+		for _, b := range bundles {
+			// Entries recording the outputs of bundles from the
+			// configuration file
+			if b.FromConfig {
+				continue
+			}
+			if slices.ContainsFunc(state.Config.Bundles, func(c *config.BundleConfig) bool {
+				return c.Output == b.Output
+			}) {
+				continue
+			}
+			state.Config.Bundles = append(state.Config.Bundles, b.BundleConfig())
+		}
+	}
+
 	ser = state.Config
 	if setupCmdOptions.PrintState && !cmdOptions.JsonOutput {
 		return fmt.Errorf("can only use --print-state with --json")
@@ -101,10 +125,16 @@ func PrintConfig(state *config.State) error {
 }
 
 func SetupInstallation(state *config.State) error {
+	replicas, err := sbctl.FindReplicas(state)
+	if err != nil {
+		return err
+	}
+
 	if state.Config.Landlock {
 		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
 			return err
 		}
+		lsm.RestrictAdditionalPaths(replicas.LandlockRules()...)
 		if err := lsm.Restrict(); err != nil {
 			return err
 		}
@@ -145,7 +175,7 @@ func SetupInstallation(state *config.State) error {
 		return err
 	}
 
-	if err := SignAll(state); err != nil {
+	if err := SignAll(state, replicas); err != nil {
 		return err
 	}
 
@@ -23,11 +23,16 @@ var signAllCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var gerr error
 		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		replicas, err := sbctl.FindReplicas(state)
+		if err != nil {
+			return err
+		}
 		// Don't run landlock if we are making UKIs
 		if state.Config.Landlock && !generate {
 			if err := sbctl.LandlockFromFileDatabase(state); err != nil {
 				return err
 			}
+			lsm.RestrictAdditionalPaths(replicas.LandlockRules()...)
 			if err := lsm.Restrict(); err != nil {
 				return err
 			}
@@ -43,7 +48,7 @@ var signAllCmd = &cobra.Command{
 				logging.Error(err)
 			}
 		}
-		serr := SignAll(state)
+		serr := SignAll(state, replicas)
 		if serr != nil || gerr != nil {
 			return ErrSilent
 		}
@@ -51,33 +56,48 @@ var signAllCmd = &cobra.Command{
 	},
 }
 
-func SignAll(state *config.State) error {
+func SignAll(state *config.State, replicas *sbctl.Replicas) error {
 	var signerr error
 	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
 	if err != nil {
 		return err
 	}
-	for _, entry := range files {
-
-		kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	for key, pattern := range files {
+		entries, err := pattern.Expand(state.Fs)
 		if err != nil {
-			return err
-		}
-
-		err = sbctl.SignFile(state, kh, hierarchy.Db, entry.File, entry.OutputFile)
-		if errors.Is(err, sbctl.ErrAlreadySigned) {
-			logging.Print("File has already been signed %s\n", entry.OutputFile)
-		} else if err != nil {
-			logging.Error(fmt.Errorf("failed signing %s: %w", entry.File, err))
-			// Ensure we are getting os.Exit(1)
+			logging.Error(err)
 			signerr = ErrSilent
 			continue
-		} else {
-			logging.Ok("Signed %s", entry.OutputFile)
+		}
+		if pattern.IsPattern() && len(entries) == 0 {
+			logging.Warn("%s does not match any files", pattern.File)
+		}
+
+		for _, entry := range entries {
+			kh, err := backend.GetKeyHierarchy(state.Fs, state)
+			if err != nil {
+				return err
+			}
+
+			err = sbctl.SignFile(state, kh, hierarchy.Db, entry.File, entry.OutputFile)
+			if errors.Is(err, sbctl.ErrAlreadySigned) {
+				logging.Print("File has already been signed %s\n", entry.OutputFile)
+			} else if err != nil {
+				logging.Error(fmt.Errorf("failed signing %s: %w", entry.File, err))
+				// Ensure we are getting os.Exit(1)
+				signerr = ErrSilent
+				continue
+			} else {
+				logging.Ok("Signed %s", entry.OutputFile)
+			}
+			if err := mirrorFile(state, replicas, entry.OutputFile); err != nil {
+				logging.Error(err)
+				signerr = ErrSilent
+			}
 		}
 
 		// Update checksum after we signed it
-		files[entry.File] = entry
+		files[key] = pattern
 		if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
 			return err
 		}
@@ -93,6 +113,7 @@ func signAllCmdFlags(cmd *cobra.Command) {
 func init() {
 	signAllCmdFlags(signAllCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: signAllCmd,
+		Cmd:   signAllCmd,
+		Audit: true,
 	})
 }
@@ -2,12 +2,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/landlock-lsm/go-landlock/landlock"
@@ -41,6 +44,10 @@ var signCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		// Keep the trailing slash of directory patterns
+		if strings.HasSuffix(args[0], "/") {
+			file += "/"
+		}
 		// Get output path from database for file if output not specified
 		if output == "" {
 			files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
@@ -55,6 +62,16 @@ var signCmd = &cobra.Command{
 			}
 		}
 
+		replicas, err := sbctl.FindReplicas(state)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, replicas.LandlockRules()...)
+
+		if entry := (&sbctl.SigningEntry{File: file, OutputFile: output}); entry.IsPattern() {
+			return signPattern(state, entry, replicas)
+		}
+
 		if output == "" {
 			output = file
 			rules = append(rules, lsm.TruncFile(file).IgnoreIfMissing())
@@ -92,10 +109,90 @@ var signCmd = &cobra.Command{
 		} else {
 			logging.Ok("Signed %s", output)
 		}
-		return nil
+		return mirrorFile(state, replicas, output)
 	},
 }
 
+// mirrorFile copies a signed file to the ESP replicas
+func mirrorFile(state *config.State, replicas *sbctl.Replicas, file string) error {
+	written, err := replicas.Mirror(state.Fs, file)
+	for _, f := range written {
+		logging.Ok("Mirrored %s", f)
+	}
+	return err
+}
+
+func signPattern(state *config.State, entry *sbctl.SigningEntry, replicas *sbctl.Replicas) error {
+	// Output templates starting with {path} or {dir} are already absolute,
+	// other templates are relative to the current directory
+	if entry.OutputFile != "" &&
+		!strings.HasPrefix(entry.OutputFile, sbctl.PlaceholderPath) &&
+		!strings.HasPrefix(entry.OutputFile, sbctl.PlaceholderDir) {
+		output, err := filepath.Abs(entry.OutputFile)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(entry.OutputFile, "/") {
+			output += "/"
+		}
+		entry.OutputFile = output
+	}
+
+	entries, err := entry.Expand(state.Fs)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		logging.Warn("%s does not match any files", entry.File)
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(sbctl.LandlockRulesFromEntries(state.Fs, entries)...)
+		lsm.RestrictAdditionalPaths(replicas.LandlockRules()...)
+		if save {
+			lsm.RestrictAdditionalPaths(landlock.RWFiles(state.Config.FilesDb))
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return err
+	}
+
+	var signerr error
+	for _, e := range entries {
+		err := sbctl.SignFile(state, kh, hierarchy.Db, e.File, e.OutputFile)
+		if errors.Is(err, sbctl.ErrAlreadySigned) {
+			logging.Print("File has already been signed %s\n", e.OutputFile)
+		} else if err != nil {
+			logging.Error(fmt.Errorf("failed signing %s: %w", e.File, err))
+			signerr = ErrSilent
+			continue
+		} else {
+			logging.Ok("Signed %s", e.OutputFile)
+		}
+		if err := mirrorFile(state, replicas, e.OutputFile); err != nil {
+			logging.Error(err)
+			signerr = ErrSilent
+		}
+	}
+
+	if save {
+		files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+		if err != nil {
+			return err
+		}
+		files[entry.File] = entry
+		if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+			return err
+		}
+	}
+	return signerr
+}
+
 func signCmdFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.BoolVarP(&save, "save", "s", false, "save file to the database")
@@ -105,6 +202,7 @@ func signCmdFlags(cmd *cobra.Command) {
 func init() {
 	signCmdFlags(signCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: signCmd,
+		Cmd:   signCmd,
+		Audit: true,
 	})
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/foxboron/sbctl/quirks"
+	"github.com/google/go-tpm/tpm2/transport"
 	"github.com/spf13/cobra"
 )
 
@@ -30,6 +32,8 @@ type Status struct {
 	SecureBoot     bool           `json:"secure_boot"`
 	Vendors        []string       `json:"vendors"`
 	FirmwareQuirks []quirks.Quirk `json:"firmware_quirks"`
+	// EventlogReplay is unset when there is no TPM or eventlog
+	EventlogReplay []sbctl.EventlogReplay `json:"eventlog_replay,omitempty"`
 }
 
 func NewStatus() *Status {
@@ -74,11 +78,30 @@ func PrintStatus(s *Status) {
 	} else {
 		logging.Println("none")
 	}
+	if len(s.EventlogReplay) > 0 {
+		logging.Print("TPM Eventlog:\t")
+		var invalid []string
+		for _, r := range s.EventlogReplay {
+			if !r.Valid() {
+				invalid = append(invalid, r.String())
+			}
+		}
+		if len(invalid) == 0 {
+			logging.Ok("Matches the PCR values")
+		} else {
+			logging.NotOk("Does not match the PCR values (%s)", strings.Join(invalid, "; "))
+		}
+	}
 	if len(s.FirmwareQuirks) > 0 {
 		logging.Print("Firmware:\t")
 		logging.Print("%s", logging.Warnf("Your firmware has known quirks"))
 		for _, quirk := range s.FirmwareQuirks {
 			logging.Println("\t\t- " + quirk.ID + ": " + quirk.Name + " (" + quirk.Severity + ")\n\t\t  " + quirk.Link)
+			for _, line := range strings.Split(quirk.Remediation, "\n") {
+				if line != "" {
+					logging.Println("\t\t  " + line)
+				}
+			}
 		}
 	}
 }
@@ -114,22 +137,27 @@ func RunDebug(state *config.State) error {
 	return nil
 }
 
-func RunStatus(cmd *cobra.Command, args []string) error {
-	state := cmd.Context().Value(stateDataKey{}).(*config.State)
-
-	if state.Config.Landlock {
-		if err := lsm.Restrict(); err != nil {
-			return err
-		}
+// eventlogReplay replays the eventlog against the PCR values. A missing
+// eventlog or unreadable PCRs are not reported.
+func eventlogReplay(state *config.State, tpm transport.TPM) []sbctl.EventlogReplay {
+	log, err := sbctl.ParseEventlog(state.Fs, systemEventlog)
+	if err != nil {
+		slog.Debug("can't read the eventlog", slog.Any("err", err))
+		return nil
 	}
-
-	if cmdOptions.Debug {
-		RunDebug(state)
+	replays, err := sbctl.ReplayEventlog(log, tpm)
+	if err != nil {
+		slog.Debug("can't replay the eventlog", slog.Any("err", err))
+		return nil
 	}
+	return replays
+}
 
+// GetStatus gathers the Secure Boot status of the system
+func GetStatus(state *config.State) (*Status, error) {
 	stat := NewStatus()
-	if _, err := state.Fs.Stat("/sys/firmware/efi/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c"); os.IsNotExist(err) {
-		return fmt.Errorf("system is not booted with UEFI")
+	if _, err := state.Efivarfs.GetSetupMode(); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("system is not booted with UEFI")
 	}
 
 	if state.IsInstalled() {
@@ -151,7 +179,30 @@ func RunStatus(cmd *cobra.Command, args []string) error {
 	if keys, err := certs.BuiltinSignatureOwners(); err == nil {
 		stat.Vendors = append(stat.Vendors, keys...)
 	}
+	if tpm := systemTPM(state); tpm != nil {
+		stat.EventlogReplay = eventlogReplay(state, tpm)
+	}
 	stat.FirmwareQuirks = quirks.CheckFirmwareQuirks(state)
+	return stat, nil
+}
+
+func RunStatus(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if cmdOptions.Debug {
+		RunDebug(state)
+	}
+
+	stat, err := GetStatus(state)
+	if err != nil {
+		return err
+	}
 	if cmdOptions.JsonOutput {
 		if err := JsonOut(stat); err != nil {
 			return err
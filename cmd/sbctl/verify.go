@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
@@ -23,6 +24,11 @@ type VerifiedFile struct {
 	//   -  1: "signed"
 	//   - -1: "file does not exist"
 	IsSigned       int8           `json:"is_signed"`
+	// Divergence is set when the file in an ESP replica differs from the
+	// primary ESP. See sbctl.ReplicaMissing and friends.
+	Divergence     string         `json:"divergence,omitempty"`
+	// Machine is the architecture the binary is built for
+	Machine        string         `json:"machine,omitempty"`
 }
 
 var (
@@ -66,11 +72,17 @@ func VerifyOneFile(state *config.State, f string) error {
 		return err
 	}
 
+	name := f
+	if machine, err := sbctl.PEMachine(state.Fs, f); err == nil {
+		fileentry.Machine = sbctl.MachineName(machine)
+		name = fmt.Sprintf("%s (%s)", f, fileentry.Machine)
+	}
+
 	if ok {
-		logging.Ok("%s is signed", f)
+		logging.Ok("%s is signed", name)
 		fileentry.IsSigned = 1
 	} else {
-		logging.NotOk("%s is not signed", f)
+		logging.NotOk("%s is not signed", name)
 	}
 	verifiedFiles = append(verifiedFiles, fileentry)
 
@@ -81,7 +93,12 @@ func RunVerify(cmd *cobra.Command, args []string) error {
 	state := cmd.Context().Value(stateDataKey{}).(*config.State)
 
 	// Exit early if we can't verify files
-	espPath, err := sbctl.GetESP(state.Fs)
+	espPath, err := sbctl.FindESP(state)
+	if err != nil {
+		return err
+	}
+
+	replicas, err := sbctl.FindReplicas(state)
 	if err != nil {
 		return err
 	}
@@ -90,6 +107,7 @@ func RunVerify(cmd *cobra.Command, args []string) error {
 		lsm.RestrictAdditionalPaths(
 			landlock.RWDirs(espPath),
 		)
+		lsm.RestrictAdditionalPaths(replicas.LandlockRules()...)
 		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
 			return err
 		}
@@ -124,11 +142,34 @@ func RunVerify(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	if err := afero.Walk(state.Fs, espPath, func(path string, info os.FileInfo, err error) error {
+	if err := verifyESP(state, espPath); err != nil {
+		return err
+	}
+	if replicas != nil {
+		for _, replica := range replicas.Replicas {
+			logging.Print("Verifying EFI images in replica %s...\n", replica)
+			if err := verifyESP(state, replica); err != nil {
+				return err
+			}
+		}
+		if err := verifyReplicas(state, replicas); err != nil {
+			return err
+		}
+	}
+	if cmdOptions.JsonOutput {
+		return JsonOut(verifiedFiles)
+	}
+	return nil
+}
+
+// verifyESP verifies all EFI binaries in the ESP which are not in the file
+// database
+func verifyESP(state *config.State, espPath string) error {
+	return afero.Walk(state.Fs, espPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			logging.Error(fmt.Errorf("failed to read path %s: %s", path, err))
 		}
-		if fi, _ := state.Fs.Stat(path); fi.IsDir() {
+		if fi, _ := state.Fs.Stat(path); fi == nil || fi.IsDir() {
 			return nil
 		}
 		if sbctl.InChecked(path) {
@@ -142,11 +183,37 @@ func RunVerify(cmd *cobra.Command, args []string) error {
 			logging.Error(fmt.Errorf("failed to verify file %s: %s", path, err))
 		}
 		return nil
-	}); err != nil {
+	})
+}
+
+// verifyReplicas reports the files which differ between the primary ESP and
+// its replicas
+func verifyReplicas(state *config.State, replicas *sbctl.Replicas) error {
+	divergences, err := replicas.Compare(state.Fs)
+	if err != nil {
 		return err
 	}
-	if cmdOptions.JsonOutput {
-		return JsonOut(verifiedFiles)
+	for _, d := range divergences {
+		switch d.Kind {
+		case sbctl.ReplicaMissing:
+			logging.Warn("%s is missing in the replica", d.File)
+		case sbctl.ReplicaDiffers:
+			logging.Warn("%s differs from the primary ESP", d.File)
+		case sbctl.ReplicaExtra:
+			logging.Warn("%s does not exist in the primary ESP", d.File)
+		}
+		idx := slices.IndexFunc(verifiedFiles, func(f VerifiedFile) bool {
+			return f.FileName == d.File
+		})
+		switch {
+		case idx != -1:
+			verifiedFiles[idx].Divergence = d.Kind
+		case d.Kind == sbctl.ReplicaMissing:
+			verifiedFiles = append(verifiedFiles, VerifiedFile{FileName: d.File, IsSigned: -1, Divergence: d.Kind})
+		}
+	}
+	if len(divergences) == 0 {
+		logging.Ok("All replicas match the primary ESP")
 	}
 	return nil
 }
@@ -0,0 +1,276 @@
+package sbctl
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl/quirks"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+// Rules of a compliance policy
+const (
+	RuleSecureBoot  = "secure-boot"
+	RuleSetupMode   = "setup-mode-disabled"
+	RulePKOwned     = "pk-owned"
+	RuleContains    = "contains"
+	RuleOnly        = "only"
+	RuleAbsent      = "absent"
+	RuleDbxVersion  = "dbx-version"
+	RuleFilesSigned = "files-signed"
+	RuleNoQuirks    = "no-quirks"
+)
+
+var complianceRules = []string{
+	RuleSecureBoot, RuleSetupMode, RulePKOwned, RuleContains, RuleOnly,
+	RuleAbsent, RuleDbxVersion, RuleFilesSigned, RuleNoQuirks,
+}
+
+var ErrNotCompliant = errors.New("system is not compliant with the policy")
+
+// ComplianceRule is one assertion of a compliance policy. Certificates are
+// given as SHA-256 fingerprints or as the common name of the certificate.
+type ComplianceRule struct {
+	Name         string   `json:"name,omitempty"`
+	Rule         string   `json:"rule"`
+	Variable     string   `json:"variable,omitempty"`
+	Certificates []string `json:"certificates,omitempty"`
+	Version      int      `json:"version,omitempty"`
+	Severity     []string `json:"severity,omitempty"`
+}
+
+type CompliancePolicy struct {
+	Rules []ComplianceRule `json:"rules"`
+}
+
+// ComplianceState is the state of the system a policy is evaluated against
+type ComplianceState struct {
+	SecureBoot bool
+	SetupMode  bool
+	PK         *signature.SignatureDatabase
+	KEK        *signature.SignatureDatabase
+	Db         *signature.SignatureDatabase
+	Dbx        *signature.SignatureDatabase
+	// OwnPK is the certificate of the PK created by sbctl, nil when sbctl is
+	// not installed
+	OwnPK []byte
+	// Files in the file database, and the ones which are not signed
+	Files    int
+	Unsigned []string
+	Quirks   []quirks.Quirk
+}
+
+type ComplianceResult struct {
+	Name    string `json:"name"`
+	Rule    string `json:"rule"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+}
+
+type ComplianceReport struct {
+	Compliant bool               `json:"compliant"`
+	Results   []ComplianceResult `json:"results"`
+}
+
+// ParseCompliancePolicy parses a policy in YAML or JSON
+func ParseCompliancePolicy(b []byte) (*CompliancePolicy, error) {
+	var p CompliancePolicy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Rules) == 0 {
+		return nil, errors.New("policy has no rules")
+	}
+	for i, r := range p.Rules {
+		if !slices.Contains(complianceRules, r.Rule) {
+			return nil, fmt.Errorf("rule %d: unknown rule %q", i+1, r.Rule)
+		}
+		switch r.Rule {
+		case RuleContains, RuleOnly, RuleAbsent:
+			if _, ok := r.variable(&ComplianceState{}); !ok {
+				return nil, fmt.Errorf("rule %d: unknown variable %q, valid values are PK, KEK, db and dbx", i+1, r.Variable)
+			}
+		case RuleDbxVersion:
+			if r.Version <= 0 {
+				return nil, fmt.Errorf("rule %d: missing dbx version", i+1)
+			}
+		}
+		if r.Name == "" {
+			p.Rules[i].Name = r.Rule
+			if r.Variable != "" {
+				p.Rules[i].Name += " " + r.Variable
+			}
+		}
+	}
+	return &p, nil
+}
+
+// variable returns the signature database the rule applies to
+func (r *ComplianceRule) variable(s *ComplianceState) (*signature.SignatureDatabase, bool) {
+	switch r.Variable {
+	case "PK":
+		return s.PK, true
+	case "KEK":
+		return s.KEK, true
+	case "db":
+		return s.Db, true
+	case "dbx":
+		return s.Dbx, true
+	}
+	return nil, false
+}
+
+// complianceCert is an X.509 certificate in a signature database
+type complianceCert struct {
+	fingerprint string
+	name        string
+}
+
+func (c complianceCert) String() string {
+	if c.name == "" {
+		return c.fingerprint
+	}
+	return fmt.Sprintf("%s (%s)", c.name, c.fingerprint)
+}
+
+func (c complianceCert) matches(s string) bool {
+	return Fingerprint(s) == c.fingerprint || (c.name != "" && strings.EqualFold(s, c.name))
+}
+
+func complianceCerts(sigdb *signature.SignatureDatabase) []complianceCert {
+	var certs []complianceCert
+	if sigdb == nil {
+		return certs
+	}
+	for _, l := range *sigdb {
+		if l.SignatureType != signature.CERT_X509_GUID {
+			continue
+		}
+		for _, sig := range l.Signatures {
+			sum := sha256.Sum256(sig.Data)
+			c := complianceCert{fingerprint: hex.EncodeToString(sum[:])}
+			if cert, err := x509.ParseCertificate(sig.Data); err == nil {
+				c.name = cert.Subject.CommonName
+			}
+			certs = append(certs, c)
+		}
+	}
+	return certs
+}
+
+// DbxVersion is the number of entries in dbx, which grows with every
+// revocation update
+func DbxVersion(dbx *signature.SignatureDatabase) int {
+	var n int
+	if dbx == nil {
+		return n
+	}
+	for _, l := range *dbx {
+		n += len(l.Signatures)
+	}
+	return n
+}
+
+func (r *ComplianceRule) evaluate(s *ComplianceState) (bool, string) {
+	switch r.Rule {
+	case RuleSecureBoot:
+		if s.SecureBoot {
+			return true, "Secure Boot is enabled"
+		}
+		return false, "Secure Boot is disabled"
+	case RuleSetupMode:
+		if s.SetupMode {
+			return false, "Setup Mode is enabled"
+		}
+		return true, "Setup Mode is disabled"
+	case RulePKOwned:
+		if s.OwnPK == nil {
+			return false, "sbctl is not installed"
+		}
+		certs := complianceCerts(s.PK)
+		if len(certs) != 1 {
+			return false, fmt.Sprintf("PK has %d certificates", len(certs))
+		}
+		sum := sha256.Sum256(s.OwnPK)
+		if certs[0].fingerprint != hex.EncodeToString(sum[:]) {
+			return false, fmt.Sprintf("PK is %s", certs[0])
+		}
+		return true, "PK is the sbctl PK"
+	case RuleContains:
+		sigdb, _ := r.variable(s)
+		certs := complianceCerts(sigdb)
+		var missing []string
+		for _, want := range r.Certificates {
+			if !slices.ContainsFunc(certs, func(c complianceCert) bool { return c.matches(want) }) {
+				missing = append(missing, want)
+			}
+		}
+		if len(missing) > 0 {
+			return false, fmt.Sprintf("%s is missing %s", r.Variable, strings.Join(missing, ", "))
+		}
+		return true, fmt.Sprintf("%s contains all certificates", r.Variable)
+	case RuleOnly, RuleAbsent:
+		var found []string
+		sigdb, _ := r.variable(s)
+		for _, c := range complianceCerts(sigdb) {
+			listed := slices.ContainsFunc(r.Certificates, c.matches)
+			if listed == (r.Rule == RuleAbsent) {
+				found = append(found, c.String())
+			}
+		}
+		switch {
+		case len(found) == 0 && r.Rule == RuleOnly:
+			return true, fmt.Sprintf("%s contains only the listed certificates", r.Variable)
+		case len(found) == 0:
+			return true, fmt.Sprintf("%s contains none of the listed certificates", r.Variable)
+		default:
+			return false, fmt.Sprintf("%s contains %s", r.Variable, strings.Join(found, ", "))
+		}
+	case RuleDbxVersion:
+		v := DbxVersion(s.Dbx)
+		if v < r.Version {
+			return false, fmt.Sprintf("dbx version %d is older than %d", v, r.Version)
+		}
+		return true, fmt.Sprintf("dbx version is %d", v)
+	case RuleFilesSigned:
+		if len(s.Unsigned) > 0 {
+			return false, fmt.Sprintf("%s not signed", strings.Join(s.Unsigned, ", "))
+		}
+		return true, fmt.Sprintf("all %d files are signed", s.Files)
+	case RuleNoQuirks:
+		var found []string
+		for _, q := range s.Quirks {
+			if len(r.Severity) == 0 || slices.ContainsFunc(r.Severity, func(sev string) bool { return strings.EqualFold(sev, q.Severity) }) {
+				found = append(found, fmt.Sprintf("%s (%s)", q.ID, q.Severity))
+			}
+		}
+		if len(found) > 0 {
+			return false, fmt.Sprintf("firmware has quirks %s", strings.Join(found, ", "))
+		}
+		return true, "firmware has no matching quirks"
+	}
+	return false, fmt.Sprintf("unknown rule %q", r.Rule)
+}
+
+// Evaluate checks every rule of the policy against the state
+func (p *CompliancePolicy) Evaluate(s *ComplianceState) *ComplianceReport {
+	report := &ComplianceReport{Compliant: true, Results: []ComplianceResult{}}
+	for _, r := range p.Rules {
+		ok, msg := r.evaluate(s)
+		report.Results = append(report.Results, ComplianceResult{
+			Name:    r.Name,
+			Rule:    r.Rule,
+			Passed:  ok,
+			Message: msg,
+		})
+		report.Compliant = report.Compliant && ok
+	}
+	return report
+}
@@ -0,0 +1,104 @@
+package sbctl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/foxboron/sbctl/quirks"
+)
+
+func TestCompliancePolicy(t *testing.T) {
+	msDb, err := certs.GetOEMCerts("microsoft", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msKEK, err := certs.GetOEMCerts("microsoft", "KEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Any certificate works as our PK
+	pkCert := (*msKEK)[0].Signatures[0].Data
+	pk := signature.NewSignatureDatabase()
+	if err := pk.Append(signature.CERT_X509_GUID, eventlogGUID, pkCert); err != nil {
+		t.Fatal(err)
+	}
+	pkSum := sha256.Sum256(pkCert)
+	dbx := signature.NewSignatureDatabase()
+	for i := range 3 {
+		if err := dbx.Append(signature.CERT_SHA256_GUID, eventlogGUID, []byte{byte(i), 31: 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := &ComplianceState{
+		SecureBoot: true,
+		PK:         pk,
+		KEK:        msKEK,
+		Db:         msDb,
+		Dbx:        dbx,
+		OwnPK:      pkCert,
+		Files:      2,
+		Unsigned:   []string{"/efi/EFI/Linux/arch.efi"},
+		Quirks:     []quirks.Quirk{{ID: "FQ0001", Severity: "CRITICAL"}},
+	}
+
+	policy, err := ParseCompliancePolicy([]byte(`
+rules:
+  - rule: secure-boot
+  - rule: setup-mode-disabled
+  - name: PK is ours
+    rule: pk-owned
+  - rule: contains
+    variable: PK
+    certificates: [` + hex.EncodeToString(pkSum[:]) + `]
+  - rule: only
+    variable: KEK
+    certificates: ["Microsoft Corporation KEK CA 2011"]
+  - name: Microsoft 2011 CA absent
+    rule: absent
+    variable: db
+    certificates: ["Microsoft Corporation UEFI CA 2011"]
+  - rule: dbx-version
+    version: 3
+  - rule: dbx-version
+    version: 4
+  - rule: files-signed
+  - rule: no-quirks
+    severity: [critical]
+  - rule: no-quirks
+    severity: [low]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := policy.Evaluate(state)
+	if report.Compliant {
+		t.Fatal("system with failing rules is compliant")
+	}
+	var passed []bool
+	for _, r := range report.Results {
+		passed = append(passed, r.Passed)
+	}
+	want := []bool{true, true, true, true, false, false, true, false, false, false, true}
+	if !slices.Equal(passed, want) {
+		t.Fatalf("unexpected results %v, expected %v: %+v", passed, want, report.Results)
+	}
+	if report.Results[1].Name != "setup-mode-disabled" || report.Results[3].Name != "contains PK" {
+		t.Fatalf("unexpected default rule names %q %q", report.Results[1].Name, report.Results[3].Name)
+	}
+
+	for _, invalid := range []string{
+		"rules: []",
+		"rules: [{rule: unknown}]",
+		"rules: [{rule: only, variable: MOK}]",
+		"rules: [{rule: dbx-version}]",
+	} {
+		if _, err := ParseCompliancePolicy([]byte(invalid)); err == nil {
+			t.Fatalf("invalid policy %q was accepted", invalid)
+		}
+	}
+}
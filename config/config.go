@@ -28,6 +28,55 @@ type FileConfig struct {
 	Output string `json:"output,omitempty"`
 }
 
+// DevicetreeConfig is a devicetree included in a bundle, for the boards with
+// the given hardware IDs or DMI fields
+type DevicetreeConfig struct {
+	Path  string            `json:"path"`
+	Name  string            `json:"name,omitempty"`
+	HWIDs []string          `json:"hwids,omitempty"`
+	DMI   map[string]string `json:"dmi,omitempty"`
+}
+
+// BundleConfig mirrors the bundle database entries. The kernel image can be a
+// glob with a single *, which is replaced with the matched kernel version in
+// the initramfs and output paths.
+type BundleConfig struct {
+	Output         string `json:"output"`
+	IntelMicrocode string `json:"intel_microcode,omitempty"`
+	AMDMicrocode   string `json:"amd_microcode,omitempty"`
+	KernelImage    string `json:"kernel_image,omitempty"`
+	Initramfs      string `json:"initramfs,omitempty"`
+	Cmdline        string `json:"cmdline,omitempty"`
+	Splash         string `json:"splash,omitempty"`
+	OSRelease      string `json:"os_release,omitempty"`
+	EFIStub        string `json:"efi_stub,omitempty"`
+	ESP            string `json:"esp,omitempty"`
+	Arch           string `json:"arch,omitempty"`
+	BootEntry      bool   `json:"boot_entry,omitempty"`
+	LoaderDefault  bool   `json:"loader_default,omitempty"`
+	BootCounting   int    `json:"boot_counting,omitempty"`
+	KeepPrevious   bool   `json:"keep_previous,omitempty"`
+
+	Devicetrees []*DevicetreeConfig `json:"devicetrees,omitempty"`
+}
+
+// Paths is a list of paths, which can also be written as a single path
+type Paths []string
+
+func (p *Paths) UnmarshalYAML(b []byte) error {
+	var path string
+	if err := yaml.Unmarshal(b, &path); err == nil {
+		*p = Paths{path}
+		return nil
+	}
+	var paths []string
+	if err := yaml.Unmarshal(b, &paths); err != nil {
+		return err
+	}
+	*p = paths
+	return nil
+}
+
 type KeyConfig struct {
 	Privkey     string `json:"privkey"`
 	Pubkey      string `json:"pubkey"`
@@ -52,14 +101,20 @@ func (k *Keys) GetKeysConfigs() []*KeyConfig {
 // Note: Anything serialized as part of this struct will end up in a public
 // debug dump at some point, probably.
 type Config struct {
-	Landlock    bool          `json:"landlock"`
-	Keydir      string        `json:"keydir"`
-	GUID        string        `json:"guid"`
-	FilesDb     string        `json:"files_db"`
-	BundlesDb   string        `json:"bundles_db"`
-	DbAdditions []string      `json:"db_additions,omitempty"`
-	Files       []*FileConfig `json:"files,omitempty"`
-	Keys        *Keys         `json:"keys"`
+	Landlock    bool            `json:"landlock"`
+	Keydir      string          `json:"keydir"`
+	GUID        string          `json:"guid"`
+	FilesDb     string          `json:"files_db"`
+	BundlesDb   string          `json:"bundles_db"`
+	DbAdditions []string        `json:"db_additions,omitempty"`
+	Files       []*FileConfig   `json:"files,omitempty"`
+	Bundles     []*BundleConfig `json:"bundles,omitempty"`
+	ESP         Paths           `json:"esp,omitempty"`
+	XBOOTLDR    Paths           `json:"xbootldr,omitempty"`
+	Keys        *Keys           `json:"keys"`
+	// AuditLog is empty when auditing is disabled
+	AuditLog     string `json:"audit_log"`
+	AuditJournal bool   `json:"audit_journal,omitempty"`
 }
 
 func (c *Config) GetGUID(vfs afero.Fs) (*util.EFIGUID, error) {
@@ -82,6 +137,7 @@ func MkConfig(dir string) *Config {
 		Keydir:    path.Join(dir, "keys"),
 		FilesDb:   path.Join(dir, "files.json"),
 		BundlesDb: path.Join(dir, "bundles.json"),
+		AuditLog:  path.Join(dir, "audit.log"),
 	}
 	conf.Keys = &Keys{
 		PK: &KeyConfig{
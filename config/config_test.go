@@ -17,6 +17,13 @@ files:
   - path: /boot/vmlinuz-linux-lts
   - path: /usr/lib/fwupd/efi/fwupdx64.efi
     output: /usr/lib/fwupd/efi/fwupdx64.efi.signed
+bundles:
+  - output: /efi/EFI/Linux/linux-*.efi
+    kernel_image: /boot/vmlinuz-*
+    initramfs: /boot/initramfs-*.img
+esp: /efi
+xbootldr:
+  - /boot
 keys:
   pk:
     privkey: /etc/sbctl/keys/PK/PK.key
@@ -38,4 +45,10 @@ func TestParseConfig(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 	fmt.Println(conf.Keys.PK)
+	if len(conf.Bundles) != 1 || conf.Bundles[0].KernelImage != "/boot/vmlinuz-*" {
+		t.Fatalf("failed to parse bundles")
+	}
+	if len(conf.ESP) != 1 || conf.ESP[0] != "/efi" || len(conf.XBOOTLDR) != 1 || conf.XBOOTLDR[0] != "/boot" {
+		t.Fatalf("failed to parse esp: %v xbootldr: %v", conf.ESP, conf.XBOOTLDR)
+	}
 }
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/fs"
@@ -20,6 +22,128 @@ type SigningEntry struct {
 
 type SigningEntries map[string]*SigningEntry
 
+// Placeholders that can be used in the output file of a pattern entry. They
+// are replaced with the respective part of every matched file.
+const (
+	PlaceholderPath = "{path}"
+	PlaceholderDir  = "{dir}"
+	PlaceholderName = "{name}"
+)
+
+// IsPattern reports whether the entry holds a glob pattern, like
+// /boot/vmlinuz-*, or a directory, like /efi/EFI/Linux/, instead of a file.
+func (s *SigningEntry) IsPattern() bool {
+	return strings.HasSuffix(s.File, "/") || strings.ContainsAny(s.File, "*?[")
+}
+
+func (s *SigningEntry) outputFor(match string) string {
+	switch {
+	case s.OutputFile == "" || s.OutputFile == s.File:
+		return match
+	case strings.HasSuffix(s.OutputFile, "/"):
+		return filepath.Join(s.OutputFile, filepath.Base(match))
+	}
+	return strings.NewReplacer(
+		PlaceholderPath, match,
+		PlaceholderDir, filepath.Dir(match),
+		PlaceholderName, filepath.Base(match),
+	).Replace(s.OutputFile)
+}
+
+// Expand returns one entry for every file matched by a pattern entry. Entries
+// which are not patterns are returned as-is.
+func (s *SigningEntry) Expand(vfs afero.Fs) ([]*SigningEntry, error) {
+	if !s.IsPattern() {
+		return []*SigningEntry{s}, nil
+	}
+
+	// Every match needs a distinct output file
+	if s.OutputFile != "" && s.OutputFile != s.File && !strings.HasSuffix(s.OutputFile, "/") &&
+		!strings.Contains(s.OutputFile, PlaceholderPath) && !strings.Contains(s.OutputFile, PlaceholderName) {
+		return nil, fmt.Errorf("output of pattern %s needs to be a directory or contain %s or %s",
+			s.File, PlaceholderPath, PlaceholderName)
+	}
+
+	pattern := s.File
+	if strings.HasSuffix(pattern, "/") {
+		pattern = filepath.Join(pattern, "*")
+	}
+	matches, err := afero.Glob(vfs, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", s.File, err)
+	}
+
+	var entries []*SigningEntry
+	outputs := map[string]bool{}
+	for _, match := range matches {
+		if fi, err := vfs.Stat(match); err != nil || fi.IsDir() {
+			continue
+		}
+		entry := &SigningEntry{File: match, OutputFile: s.outputFor(match)}
+		if entry.File != entry.OutputFile {
+			outputs[entry.OutputFile] = true
+		}
+		entries = append(entries, entry)
+	}
+
+	// Output files might match the pattern themselves, e.g. /efi/*.efi with
+	// the output {path}.signed.efi. Don't sign those a second time.
+	return slices.DeleteFunc(entries, func(e *SigningEntry) bool {
+		return outputs[e.File]
+	}), nil
+}
+
+// ExpandSigningEntries expands all pattern entries and returns the resulting
+// list of files.
+func ExpandSigningEntries(vfs afero.Fs, files SigningEntries) ([]*SigningEntry, error) {
+	var entries []*SigningEntry
+	for _, s := range files {
+		expanded, err := s.Expand(vfs)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, expanded...)
+	}
+	return entries, nil
+}
+
+// ReconcileFileDatabase updates files to contain exactly the files declared
+// in the configuration. The entries which were added, changed or removed are
+// returned.
+func ReconcileFileDatabase(files SigningEntries, desired []*config.FileConfig) (added, changed, removed []*SigningEntry) {
+	declared := map[string]bool{}
+	for _, f := range desired {
+		entry := &SigningEntry{File: f.Path, OutputFile: f.Output}
+		if entry.OutputFile == "" {
+			entry.OutputFile = entry.File
+		}
+		declared[entry.File] = true
+		current, ok := files[entry.File]
+		switch {
+		case !ok:
+			added = append(added, entry)
+		case current.OutputFile != entry.OutputFile:
+			changed = append(changed, entry)
+		default:
+			continue
+		}
+		files[entry.File] = entry
+	}
+	for key, entry := range files {
+		if !declared[key] {
+			removed = append(removed, entry)
+			delete(files, key)
+		}
+	}
+	sortEntries := func(a, b *SigningEntry) int {
+		return strings.Compare(a.File, b.File)
+	}
+	slices.SortFunc(added, sortEntries)
+	slices.SortFunc(changed, sortEntries)
+	slices.SortFunc(removed, sortEntries)
+	return added, changed, removed
+}
+
 func ReadFileDatabase(vfs afero.Fs, dbpath string) (SigningEntries, error) {
 	f, err := ReadOrCreateFile(vfs, dbpath)
 	if err != nil {
@@ -49,12 +173,18 @@ func WriteFileDatabase(vfs afero.Fs, dbpath string, files SigningEntries) error
 	return nil
 }
 
+// SigningEntryIter calls fn for every file in the database. Pattern entries
+// are expanded to the files they currently match.
 func SigningEntryIter(state *config.State, fn func(s *SigningEntry) error) error {
 	files, err := ReadFileDatabase(state.Fs, state.Config.FilesDb)
 	if err != nil {
 		return fmt.Errorf("couldn't open database %v: %w", state.Config.FilesDb, err)
 	}
-	for _, s := range files {
+	entries, err := ExpandSigningEntries(state.Fs, files)
+	if err != nil {
+		return err
+	}
+	for _, s := range entries {
 		if err := fn(s); err != nil {
 			return err
 		}
@@ -62,34 +192,72 @@ func SigningEntryIter(state *config.State, fn func(s *SigningEntry) error) error
 	return nil
 }
 
-func LandlockFromFileDatabase(state *config.State) error {
+// LandlockRulesFromEntries returns the rules needed to sign the given
+// entries. Directories are only included once, and not at all if a parent
+// directory is already writable.
+func LandlockRulesFromEntries(vfs afero.Fs, entries []*SigningEntry) []landlock.Rule {
 	var llrules []landlock.Rule
-	files, err := ReadFileDatabase(state.Fs, state.Config.FilesDb)
-	if err != nil {
-		return err
-	}
-	for _, entry := range files {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
 		if entry.File == entry.OutputFile {
 			// If file is the same as output, set RW+Trunc on file
-			llrules = append(llrules,
-				lsm.TruncFile(entry.File).IgnoreIfMissing(),
-			)
+			if !seen[entry.File] {
+				llrules = append(llrules,
+					lsm.TruncFile(entry.File).IgnoreIfMissing(),
+				)
+				seen[entry.File] = true
+			}
+			continue
 		}
-		if entry.File != entry.OutputFile {
-			// Set input file to RO, ignore if missing so we can bubble a useable
-			// error to the user
+
+		// Set input file to RO, ignore if missing so we can bubble a useable
+		// error to the user
+		if !seen[entry.File] {
 			llrules = append(llrules, landlock.ROFiles(entry.File).IgnoreIfMissing())
+			seen[entry.File] = true
+		}
 
-			// Check if output file exists
-			// if it does we set RW on the file directly
-			// if it doesnt, we set RW on the directory
-			if ok, _ := afero.Exists(state.Fs, entry.OutputFile); ok {
+		// Check if output file exists
+		// if it does we set RW on the file directly
+		// if it doesnt, we set RW on the directory
+		if ok, _ := afero.Exists(vfs, entry.OutputFile); ok {
+			if !seen[entry.OutputFile] {
 				llrules = append(llrules, lsm.TruncFile(entry.OutputFile))
-			} else {
-				llrules = append(llrules, landlock.RWDirs(filepath.Dir(entry.OutputFile)))
+				seen[entry.OutputFile] = true
 			}
+		} else {
+			dirs = append(dirs, filepath.Clean(filepath.Dir(entry.OutputFile)))
+		}
+	}
+
+	// Sorting puts parent directories in front of their children
+	slices.Sort(dirs)
+	dirs = slices.Compact(dirs)
+	var covered []string
+	for _, dir := range dirs {
+		if slices.ContainsFunc(covered, func(parent string) bool {
+			return parent == "/" || strings.HasPrefix(dir, parent+"/")
+		}) {
+			continue
 		}
+		covered = append(covered, dir)
+	}
+	if len(covered) > 0 {
+		llrules = append(llrules, landlock.RWDirs(covered...))
+	}
+	return llrules
+}
+
+func LandlockFromFileDatabase(state *config.State) error {
+	files, err := ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return err
+	}
+	entries, err := ExpandSigningEntries(state.Fs, files)
+	if err != nil {
+		return err
 	}
-	lsm.RestrictAdditionalPaths(llrules...)
+	lsm.RestrictAdditionalPaths(LandlockRulesFromEntries(state.Fs, entries)...)
 	return nil
 }
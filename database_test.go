@@ -0,0 +1,87 @@
+package sbctl
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestExpandSigningEntry(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for _, f := range []string{
+		"/boot/vmlinuz-linux",
+		"/boot/vmlinuz-linux-lts",
+		"/boot/initramfs-linux.img",
+		"/efi/EFI/Linux/arch.efi",
+		"/efi/EFI/Linux/arch.efi.signed",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte("MZ"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vfs.MkdirAll("/efi/EFI/Linux/subdir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		entry   SigningEntry
+		want    []SigningEntry
+		wantErr bool
+	}{
+		{
+			entry: SigningEntry{File: "/boot/vmlinuz-linux", OutputFile: "/boot/vmlinuz-linux"},
+			want:  []SigningEntry{{"/boot/vmlinuz-linux", "/boot/vmlinuz-linux"}},
+		},
+		{
+			entry: SigningEntry{File: "/boot/vmlinuz-*", OutputFile: "/boot/vmlinuz-*"},
+			want: []SigningEntry{
+				{"/boot/vmlinuz-linux", "/boot/vmlinuz-linux"},
+				{"/boot/vmlinuz-linux-lts", "/boot/vmlinuz-linux-lts"},
+			},
+		},
+		{
+			entry: SigningEntry{File: "/boot/vmlinuz-*", OutputFile: "/efi/{name}.efi"},
+			want: []SigningEntry{
+				{"/boot/vmlinuz-linux", "/efi/vmlinuz-linux.efi"},
+				{"/boot/vmlinuz-linux-lts", "/efi/vmlinuz-linux-lts.efi"},
+			},
+		},
+		{
+			entry: SigningEntry{File: "/boot/vmlinuz-*", OutputFile: "/efi/"},
+			want: []SigningEntry{
+				{"/boot/vmlinuz-linux", "/efi/vmlinuz-linux"},
+				{"/boot/vmlinuz-linux-lts", "/efi/vmlinuz-linux-lts"},
+			},
+		},
+		{
+			// The output of arch.efi matches the pattern and is skipped
+			entry: SigningEntry{File: "/efi/EFI/Linux/", OutputFile: "{path}.signed"},
+			want: []SigningEntry{
+				{"/efi/EFI/Linux/arch.efi", "/efi/EFI/Linux/arch.efi.signed"},
+			},
+		},
+		{
+			entry:   SigningEntry{File: "/boot/vmlinuz-*", OutputFile: "/efi/linux.efi"},
+			wantErr: true,
+		},
+	} {
+		entries, err := c.entry.Expand(vfs)
+		if c.wantErr {
+			if err == nil {
+				t.Fatalf("%s: expected error", c.entry.File)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.entry.File, err)
+		}
+		var got []SigningEntry
+		for _, e := range entries {
+			got = append(got, *e)
+		}
+		if !slices.Equal(got, c.want) {
+			t.Fatalf("%s: got %v, want %v", c.entry.File, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/foxboron/sbctl/dmi"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+)
+
+// A bundle can carry a single devicetree in the .dtb section, or several in
+// .dtbauto sections. The EFI stub picks the .dtbauto devicetree with the
+// compatible string the .hwids section lists for the hardware IDs of the
+// machine, so one bundle boots several boards.
+
+var ErrInvalidDevicetree = errors.New("invalid devicetree blob")
+
+// Devicetree is a devicetree blob included in a bundle
+type Devicetree struct {
+	Path string `json:"path"`
+	// Name describes the board in the .hwids section, the product name from
+	// DMI is used when it is empty
+	Name string `json:"name,omitempty"`
+	// HWIDs are the hardware IDs of the boards the devicetree is for, as
+	// printed by sbctl hwids
+	HWIDs []string `json:"hwids,omitempty"`
+	// DMI fields of a board the devicetree is for, keyed by the names used
+	// by sbctl hwids. The hardware IDs are computed from them.
+	DMI map[string]string `json:"dmi,omitempty"`
+}
+
+const (
+	fdtMagic     = 0xd00dfeed
+	fdtBeginNode = 0x1
+	fdtEndNode   = 0x2
+	fdtProp      = 0x3
+	fdtNop       = 0x4
+	fdtEnd       = 0x9
+)
+
+// DevicetreeCompatible returns the first compatible string of the root node
+// of a flattened devicetree blob
+func DevicetreeCompatible(b []byte) (string, error) {
+	var hdr struct {
+		Magic, TotalSize, OffStruct, OffStrings uint32
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &hdr); err != nil || hdr.Magic != fdtMagic {
+		return "", ErrInvalidDevicetree
+	}
+	if int(hdr.OffStruct) >= len(b) || int(hdr.OffStrings) >= len(b) {
+		return "", fmt.Errorf("%w: truncated", ErrInvalidDevicetree)
+	}
+	strs := b[hdr.OffStrings:]
+	p := b[hdr.OffStruct:]
+	align := func(n int) int { return (n + 3) &^ 3 }
+	depth := 0
+	for len(p) >= 4 {
+		token := binary.BigEndian.Uint32(p)
+		p = p[4:]
+		switch token {
+		case fdtBeginNode:
+			depth++
+			// Properties of child nodes don't belong to the root node
+			if depth > 1 {
+				return "", fmt.Errorf("%w: no compatible property", ErrInvalidDevicetree)
+			}
+			n := bytes.IndexByte(p, 0)
+			if n < 0 {
+				return "", fmt.Errorf("%w: truncated", ErrInvalidDevicetree)
+			}
+			p = p[min(align(n+1), len(p)):]
+		case fdtProp:
+			if len(p) < 8 {
+				return "", fmt.Errorf("%w: truncated", ErrInvalidDevicetree)
+			}
+			size, nameoff := int(binary.BigEndian.Uint32(p)), int(binary.BigEndian.Uint32(p[4:]))
+			p = p[8:]
+			if size > len(p) || nameoff >= len(strs) {
+				return "", fmt.Errorf("%w: truncated", ErrInvalidDevicetree)
+			}
+			name, _, _ := bytes.Cut(strs[nameoff:], []byte{0})
+			if string(name) == "compatible" {
+				compatible, _, _ := bytes.Cut(p[:size], []byte{0})
+				return string(compatible), nil
+			}
+			p = p[min(align(size), len(p)):]
+		case fdtNop:
+		case fdtEndNode, fdtEnd:
+			return "", fmt.Errorf("%w: no compatible property", ErrInvalidDevicetree)
+		default:
+			return "", fmt.Errorf("%w: unknown token %#x", ErrInvalidDevicetree, token)
+		}
+	}
+	return "", fmt.Errorf("%w: truncated", ErrInvalidDevicetree)
+}
+
+// hardwareIDs returns the hardware IDs of the devicetree. The IDs computed
+// from DMI leave out the ones which only identify the manufacturer, which
+// would match every board of the manufacturer.
+func (d *Devicetree) hardwareIDs() ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, s := range d.HWIDs {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hardware ID %q: %w", s, err)
+		}
+		ids = append(ids, id)
+	}
+	if len(d.DMI) > 0 {
+		table, err := dmi.FromFields(d.DMI)
+		if err != nil {
+			return nil, err
+		}
+		for _, chid := range table.CHIDs() {
+			if chid.Type == 12 || chid.Type == 14 {
+				continue
+			}
+			ids = append(ids, chid.ID)
+		}
+	}
+	return ids, nil
+}
+
+const (
+	hwidsDeviceTypeDevicetree = 0x1
+	// descriptor, CHID, name and compatible offsets
+	hwidsDeviceSize = 4 + 16 + 4 + 4
+)
+
+// hwidsSection builds the .hwids section for the devicetrees. It is a table
+// of devices terminated by an empty entry, followed by the strings the
+// entries refer to by their offset from the start of the section.
+func hwidsSection(vfs afero.Fs, dtbs []Devicetree) ([]byte, error) {
+	type device struct {
+		chid             uuid.UUID
+		name, compatible string
+	}
+	var devices []device
+	var strs []string
+	for _, d := range dtbs {
+		b, err := fs.ReadFile(vfs, d.Path)
+		if err != nil {
+			return nil, err
+		}
+		compatible, err := DevicetreeCompatible(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Path, err)
+		}
+		ids, err := d.hardwareIDs()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Path, err)
+		}
+		name := d.Name
+		if name == "" {
+			name = d.DMI["product_name"]
+		}
+		if name == "" {
+			name = compatible
+		}
+		for _, id := range ids {
+			devices = append(devices, device{id, name, compatible})
+		}
+		strs = append(strs, name, compatible)
+	}
+	if len(devices) == 0 {
+		return nil, nil
+	}
+	slices.Sort(strs)
+	strs = slices.Compact(strs)
+
+	base := (len(devices) + 1) * hwidsDeviceSize
+	offsets := map[string]uint32{}
+	var strtab bytes.Buffer
+	for _, s := range strs {
+		offsets[s] = uint32(base + strtab.Len())
+		strtab.WriteString(s + "\x00")
+	}
+
+	var b bytes.Buffer
+	for _, d := range devices {
+		binary.Write(&b, binary.LittleEndian, uint32(hwidsDeviceTypeDevicetree<<28|hwidsDeviceSize))
+		// The CHID is stored as an EFI_GUID
+		id := d.chid
+		binary.Write(&b, binary.LittleEndian, binary.BigEndian.Uint32(id[0:4]))
+		binary.Write(&b, binary.LittleEndian, binary.BigEndian.Uint16(id[4:6]))
+		binary.Write(&b, binary.LittleEndian, binary.BigEndian.Uint16(id[6:8]))
+		b.Write(id[8:])
+		binary.Write(&b, binary.LittleEndian, offsets[d.name])
+		binary.Write(&b, binary.LittleEndian, offsets[d.compatible])
+	}
+	b.Write(make([]byte, hwidsDeviceSize))
+	b.Write(strtab.Bytes())
+	return b.Bytes(), nil
+}
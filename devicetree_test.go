@@ -0,0 +1,185 @@
+package sbctl
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/foxboron/sbctl/fs"
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+)
+
+// newDevicetree returns a devicetree blob with a root node and a child node,
+// both with a compatible property
+func newDevicetree(compatible ...string) []byte {
+	var strs bytes.Buffer
+	strs.WriteString("model\x00compatible\x00")
+	var st bytes.Buffer
+	u32 := func(v uint32) { binary.Write(&st, binary.BigEndian, v) }
+	pad := func() {
+		for st.Len()%4 != 0 {
+			st.WriteByte(0)
+		}
+	}
+	prop := func(nameoff uint32, value string) {
+		u32(fdtProp)
+		u32(uint32(len(value)))
+		u32(nameoff)
+		st.WriteString(value)
+		pad()
+	}
+	u32(fdtBeginNode)
+	u32(0)
+	prop(0, "Some Board\x00")
+	var value string
+	for _, c := range compatible {
+		value += c + "\x00"
+	}
+	if value != "" {
+		prop(6, value)
+	}
+	u32(fdtBeginNode)
+	st.WriteString("soc\x00")
+	pad()
+	prop(6, "simple-bus\x00")
+	u32(fdtEndNode)
+	u32(fdtEndNode)
+	u32(fdtEnd)
+
+	const hdrSize = 40
+	var b bytes.Buffer
+	for _, v := range []uint32{
+		fdtMagic, uint32(hdrSize + st.Len() + strs.Len()), hdrSize, uint32(hdrSize + st.Len()),
+		hdrSize, 17, 16, 0, uint32(strs.Len()), uint32(st.Len()),
+	} {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	b.Write(st.Bytes())
+	b.Write(strs.Bytes())
+	return b.Bytes()
+}
+
+func TestDevicetreeCompatible(t *testing.T) {
+	compatible, err := DevicetreeCompatible(newDevicetree("vendor,board-a", "vendor,soc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compatible != "vendor,board-a" {
+		t.Fatalf("unexpected compatible %s", compatible)
+	}
+	// The compatible property of a child node isn't used
+	if _, err := DevicetreeCompatible(newDevicetree()); !errors.Is(err, ErrInvalidDevicetree) {
+		t.Fatalf("expected ErrInvalidDevicetree, got %v", err)
+	}
+	if _, err := DevicetreeCompatible([]byte("not a devicetree")); !errors.Is(err, ErrInvalidDevicetree) {
+		t.Fatalf("expected ErrInvalidDevicetree, got %v", err)
+	}
+}
+
+func TestHWIDsSection(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	fs.WriteFile(vfs, "/board-a.dtb", newDevicetree("vendor,board-a"), 0o644)
+	fs.WriteFile(vfs, "/board-b.dtb", newDevicetree("vendor,board-b"), 0o644)
+	fs.WriteFile(vfs, "/generic.dtb", newDevicetree("vendor,soc"), 0o644)
+
+	idA := uuid.MustParse("01234567-89ab-cdef-0011-223344556677")
+	b, err := hwidsSection(vfs, []Devicetree{
+		{Path: "/board-a.dtb", Name: "Board A", HWIDs: []string{idA.String()}},
+		{Path: "/board-b.dtb", DMI: map[string]string{"system_vendor": "Vendor", "product_name": "Board B"}},
+		{Path: "/generic.dtb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One entry for board A and one for every CHID type of board B, except
+	// the enclosure and manufacturer only types
+	n := 1 + 13
+	if len(b) < (n+1)*hwidsDeviceSize {
+		t.Fatalf("section is too short: %d bytes", len(b))
+	}
+	str := func(off uint32) string {
+		s, _, _ := bytes.Cut(b[off:], []byte{0})
+		return string(s)
+	}
+	entry := b[:hwidsDeviceSize]
+	if desc := binary.LittleEndian.Uint32(entry); desc != 1<<28|hwidsDeviceSize {
+		t.Fatalf("unexpected descriptor %#x", desc)
+	}
+	if !bytes.Equal(entry[4:20], []byte{0x67, 0x45, 0x23, 0x01, 0xab, 0x89, 0xef, 0xcd, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}) {
+		t.Fatalf("unexpected CHID % x", entry[4:20])
+	}
+	if name, compatible := str(binary.LittleEndian.Uint32(entry[20:])), str(binary.LittleEndian.Uint32(entry[24:])); name != "Board A" || compatible != "vendor,board-a" {
+		t.Fatalf("unexpected strings %q %q", name, compatible)
+	}
+	entry = b[hwidsDeviceSize : 2*hwidsDeviceSize]
+	if name, compatible := str(binary.LittleEndian.Uint32(entry[20:])), str(binary.LittleEndian.Uint32(entry[24:])); name != "Board B" || compatible != "vendor,board-b" {
+		t.Fatalf("unexpected strings %q %q", name, compatible)
+	}
+	if !bytes.Equal(b[n*hwidsDeviceSize:(n+1)*hwidsDeviceSize], make([]byte, hwidsDeviceSize)) {
+		t.Fatal("missing terminating entry")
+	}
+
+	if _, err := hwidsSection(vfs, []Devicetree{{Path: "/board-a.dtb", HWIDs: []string{"board-a"}}}); err == nil {
+		t.Fatal("accepted an invalid hardware ID")
+	}
+	if b, err := hwidsSection(vfs, []Devicetree{{Path: "/generic.dtb"}}); err != nil || b != nil {
+		t.Fatalf("expected no section, got %d bytes: %v", len(b), err)
+	}
+}
+
+func TestRenameSections(t *testing.T) {
+	b, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs := afero.NewMemMapFs()
+	if err := fs.WriteFile(vfs, "/test.efi", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameSections(vfs, "/test.efi", map[string]string{".text": ".dtbauto"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := vfs.Open("/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := pe.NewFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Section(".text") != nil || p.Section(".dtbauto") == nil {
+		t.Fatal(".text was not renamed")
+	}
+}
+
+func TestExpandDevicetrees(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for _, f := range []string{"/usr/lib/modules/6.1/dtb/board.dtb", "/usr/lib/modules/6.2/dtb/board.dtb", "/boot/vmlinuz-6.1", "/boot/vmlinuz-6.2"} {
+		fs.WriteFile(vfs, f, nil, 0o644)
+	}
+	bundle := &Bundle{
+		Output:      "/efi/EFI/Linux/linux-{kernel_version}.efi",
+		KernelImage: "/boot/vmlinuz-{kernel_version}",
+		Devicetrees: []Devicetree{{Path: "/usr/lib/modules/{kernel_version}/dtb/board.dtb"}},
+	}
+	bundles, err := bundle.Expand(vfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundles) != 2 {
+		t.Fatalf("expected 2 bundles, got %d", len(bundles))
+	}
+	for _, b := range bundles {
+		if want := "/usr/lib/modules/" + b.KernelVersion + "/dtb/board.dtb"; b.Devicetrees[0].Path != want {
+			t.Fatalf("expected %s, got %s", want, b.Devicetrees[0].Path)
+		}
+	}
+	if bundle.Devicetrees[0].Path != "/usr/lib/modules/{kernel_version}/dtb/board.dtb" {
+		t.Fatal("expanding changed the template")
+	}
+}
@@ -0,0 +1,113 @@
+package dmi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+// Computer Hardware IDs (CHIDs) identify a machine model by its SMBIOS
+// fields, from the exact firmware release down to just the manufacturer. They
+// are computed the way Windows and fwupd do, and are used by the systemd EFI
+// stub to select a devicetree.
+
+var chidNamespace = uuid.MustParse("70ffd812-4c7f-4c7d-0000-000000000000")
+
+const (
+	chidManufacturer = iota
+	chidFamily
+	chidProductName
+	chidProductSKU
+	chidBaseboardManufacturer
+	chidBaseboardProduct
+	chidBiosVendor
+	chidBiosVersion
+	chidBiosMajorRelease
+	chidBiosMinorRelease
+	chidEnclosureType
+)
+
+var chidFieldNames = []string{
+	"Manufacturer", "Family", "ProductName", "ProductSku", "BaseboardManufacturer",
+	"BaseboardProduct", "BiosVendor", "BiosVersion", "BiosMajorRelease",
+	"BiosMinorRelease", "EnclosureKind",
+}
+
+// chidTypes are the fields of every CHID type
+var chidTypes = [][]int{
+	{chidManufacturer, chidFamily, chidProductName, chidProductSKU, chidBiosVendor, chidBiosVersion, chidBiosMajorRelease, chidBiosMinorRelease},
+	{chidManufacturer, chidFamily, chidProductName, chidBiosVendor, chidBiosVersion, chidBiosMajorRelease, chidBiosMinorRelease},
+	{chidManufacturer, chidProductName, chidBiosVendor, chidBiosVersion, chidBiosMajorRelease, chidBiosMinorRelease},
+	{chidManufacturer, chidFamily, chidProductName, chidProductSKU, chidBaseboardManufacturer, chidBaseboardProduct},
+	{chidManufacturer, chidFamily, chidProductName, chidProductSKU},
+	{chidManufacturer, chidFamily, chidProductName},
+	{chidManufacturer, chidProductSKU, chidBaseboardManufacturer, chidBaseboardProduct},
+	{chidManufacturer, chidProductSKU},
+	{chidManufacturer, chidProductName, chidBaseboardManufacturer, chidBaseboardProduct},
+	{chidManufacturer, chidProductName},
+	{chidManufacturer, chidFamily, chidBaseboardManufacturer, chidBaseboardProduct},
+	{chidManufacturer, chidFamily},
+	{chidManufacturer, chidEnclosureType},
+	{chidManufacturer, chidBaseboardManufacturer, chidBaseboardProduct},
+	{chidManufacturer},
+}
+
+// CHID is a Computer Hardware ID of the given type
+type CHID struct {
+	Type   int       `json:"type"`
+	ID     uuid.UUID `json:"id"`
+	Fields []string  `json:"fields"`
+}
+
+// hexInteger formats a decimal value read from sysfs as hexadecimal, with
+// at least width digits
+func hexInteger(s string, width int) string {
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%0*x", width, n)
+}
+
+func (d DMI) chidFields() []string {
+	major, minor, _ := strings.Cut(d.FirmwareRelease, ".")
+	return []string{
+		chidManufacturer:          d.SystemVendor,
+		chidFamily:                d.ProductFamily,
+		chidProductName:           d.ProductName,
+		chidProductSKU:            d.ProductSKU,
+		chidBaseboardManufacturer: d.BoardVendor,
+		chidBaseboardProduct:      d.BoardName,
+		chidBiosVendor:            d.FirmwareVendor,
+		chidBiosVersion:           d.FirmwareVersion,
+		chidBiosMajorRelease:      hexInteger(major, 2),
+		chidBiosMinorRelease:      hexInteger(minor, 2),
+		chidEnclosureType:         hexInteger(d.ChassisType, 1),
+	}
+}
+
+// CHIDs returns the Computer Hardware IDs of the machine, the most specific
+// first
+func (d DMI) CHIDs() []CHID {
+	values := d.chidFields()
+	var chids []CHID
+	for i, fields := range chidTypes {
+		var parts, names []string
+		for _, f := range fields {
+			parts = append(parts, strings.TrimSpace(values[f]))
+			names = append(names, chidFieldNames[f])
+		}
+		// The fields are joined with & and hashed as UTF-16LE
+		u := utf16.Encode([]rune(strings.Join(parts, "&")))
+		b := make([]byte, 2*len(u))
+		for j, c := range u {
+			binary.LittleEndian.PutUint16(b[2*j:], c)
+		}
+		chids = append(chids, CHID{Type: i, ID: uuid.NewSHA1(chidNamespace, b), Fields: names})
+	}
+	return chids
+}
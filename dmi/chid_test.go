@@ -0,0 +1,57 @@
+package dmi
+
+import (
+	"testing"
+)
+
+func TestCHIDs(t *testing.T) {
+	d := DMI{
+		SystemVendor:    "Vendor",
+		ProductFamily:   "Family",
+		ProductName:     "Board",
+		FirmwareRelease: "1.10",
+		ChassisType:     "10",
+	}
+	chids := d.CHIDs()
+	if len(chids) != 15 {
+		t.Fatalf("expected 15 CHIDs, got %d", len(chids))
+	}
+	fields := d.chidFields()
+	if fields[chidBiosMajorRelease] != "01" || fields[chidBiosMinorRelease] != "0a" || fields[chidEnclosureType] != "a" {
+		t.Fatalf("unexpected integer fields %q", fields)
+	}
+
+	// The manufacturer only CHID doesn't depend on the other fields, and
+	// surrounding whitespace is ignored
+	other := DMI{SystemVendor: " Vendor ", ProductName: "Other Board"}
+	if other.CHIDs()[14].ID != chids[14].ID {
+		t.Fatal("manufacturer CHIDs differ")
+	}
+	if other.CHIDs()[9].ID == chids[9].ID {
+		t.Fatal("product CHIDs are the same for different products")
+	}
+	if chids[5].ID.Version() != 5 {
+		t.Fatalf("expected a version 5 UUID, got %d", chids[5].ID.Version())
+	}
+}
+
+func TestFields(t *testing.T) {
+	d := DMI{SystemVendor: "Vendor", ProductName: "Board", ChassisType: "3"}
+	fields := d.Fields()
+	if len(fields) != 3 || fields["product_name"] != "Board" {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	parsed, err := FromFields(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != d {
+		t.Fatalf("expected %+v, got %+v", d, parsed)
+	}
+	if _, err := FromFields(map[string]string{"serial": "1234"}); err == nil {
+		t.Fatal("accepted an unknown field")
+	}
+	if _, err := FromFields(map[string]string{"firmware_date": "01/13/2023"}); err == nil {
+		t.Fatal("accepted an invalid date")
+	}
+}
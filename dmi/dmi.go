@@ -1,6 +1,9 @@
 package dmi
 
 import (
+	"fmt"
+	"reflect"
+	"slices"
 	"strings"
 	"time"
 
@@ -50,3 +53,62 @@ func ParseDMI(state *config.State) DMI {
 
 	return dmi
 }
+
+// Field returns the value of the field with the given JSON name. The firmware
+// date is formatted as YYYY-MM-DD.
+func (d DMI) Field(name string) (string, bool) {
+	v := reflect.ValueOf(d)
+	t := v.Type()
+	for i := range t.NumField() {
+		if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] != name {
+			continue
+		}
+		switch f := v.Field(i).Interface().(type) {
+		case string:
+			return f, true
+		case time.Time:
+			return f.Format(time.DateOnly), true
+		}
+	}
+	return "", false
+}
+
+// Fields returns all fields which are set by their JSON names, as accepted by
+// FromFields
+func (d DMI) Fields() map[string]string {
+	fields := map[string]string{}
+	for _, f := range reflect.VisibleFields(reflect.TypeOf(d)) {
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if v, _ := d.Field(name); v != "" && v != (time.Time{}).Format(time.DateOnly) {
+			fields[name] = v
+		}
+	}
+	return fields
+}
+
+// FromFields returns a table with the fields given by their JSON names. The
+// firmware date is parsed as YYYY-MM-DD.
+func FromFields(fields map[string]string) (DMI, error) {
+	var d DMI
+	v := reflect.ValueOf(&d).Elem()
+	t := v.Type()
+	for name, value := range fields {
+		i := slices.IndexFunc(reflect.VisibleFields(t), func(f reflect.StructField) bool {
+			return strings.Split(f.Tag.Get("json"), ",")[0] == name
+		})
+		if i < 0 {
+			return DMI{}, fmt.Errorf("unknown DMI field %s", name)
+		}
+		switch f := v.Field(i); f.Interface().(type) {
+		case string:
+			f.SetString(value)
+		case time.Time:
+			date, err := time.Parse(time.DateOnly, value)
+			if err != nil {
+				return DMI{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			f.Set(reflect.ValueOf(date))
+		}
+	}
+	return d, nil
+}
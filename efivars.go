@@ -0,0 +1,234 @@
+package sbctl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/go-uefi/efivarfs/fswrapper"
+	"github.com/spf13/afero"
+)
+
+// A virtual efivarfs is a directory with files in the efivarfs format, used to
+// prepare the EFI variables of a virtual machine or a disk image without
+// touching the firmware of the host.
+
+// efivarsDirFs maps the paths in /sys/firmware/efi/efivars to a directory
+type efivarsDirFs struct {
+	afero.Fs
+}
+
+// NewEfivarsDirFs returns a filesystem where the efivarfs paths are files in
+// dir
+func NewEfivarsDirFs(dir string) afero.Fs {
+	return &efivarsDirFs{afero.NewBasePathFs(afero.NewOsFs(), dir)}
+}
+
+func (f *efivarsDirFs) path(op, name string) (string, error) {
+	rel, err := filepath.Rel(attributes.Efivars, filepath.Clean(name))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return filepath.Join("/", rel), nil
+}
+
+func (f *efivarsDirFs) Create(name string) (afero.File, error) {
+	p, err := f.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Fs.Create(p)
+}
+
+func (f *efivarsDirFs) Mkdir(name string, perm os.FileMode) error {
+	p, err := f.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return f.Fs.Mkdir(p, perm)
+}
+
+func (f *efivarsDirFs) MkdirAll(name string, perm os.FileMode) error {
+	p, err := f.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return f.Fs.MkdirAll(p, perm)
+}
+
+func (f *efivarsDirFs) Open(name string) (afero.File, error) {
+	p, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Fs.Open(p)
+}
+
+func (f *efivarsDirFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	p, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Fs.OpenFile(p, flag, perm)
+}
+
+func (f *efivarsDirFs) Remove(name string) error {
+	p, err := f.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return f.Fs.Remove(p)
+}
+
+func (f *efivarsDirFs) RemoveAll(name string) error {
+	p, err := f.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return f.Fs.RemoveAll(p)
+}
+
+func (f *efivarsDirFs) Rename(oldname, newname string) error {
+	o, err := f.path("rename", oldname)
+	if err != nil {
+		return err
+	}
+	n, err := f.path("rename", newname)
+	if err != nil {
+		return err
+	}
+	return f.Fs.Rename(o, n)
+}
+
+func (f *efivarsDirFs) Stat(name string) (os.FileInfo, error) {
+	p, err := f.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Fs.Stat(p)
+}
+
+func (f *efivarsDirFs) Chmod(name string, mode os.FileMode) error {
+	p, err := f.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	return f.Fs.Chmod(p, mode)
+}
+
+func (f *efivarsDirFs) Chown(name string, uid, gid int) error {
+	p, err := f.path("chown", name)
+	if err != nil {
+		return err
+	}
+	return f.Fs.Chown(p, uid, gid)
+}
+
+func (f *efivarsDirFs) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := f.path("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return f.Fs.Chtimes(p, atime, mtime)
+}
+
+// ErrReadOnlyEfivars is returned when writing to read-only EFI variables
+var ErrReadOnlyEfivars = errors.New("EFI variables are read-only")
+
+type readOnlyEfivars struct {
+	efivarfs.EFIVars
+}
+
+func (readOnlyEfivars) WriteVar(e efivar.Efivar, _ efivar.Marshallable) error {
+	return fmt.Errorf("can't write %s: %w", e.Name, ErrReadOnlyEfivars)
+}
+
+// ReadOnlyEfivarfs returns the variables of e, refusing all writes
+func ReadOnlyEfivarfs(e *efivarfs.Efivarfs) *efivarfs.Efivarfs {
+	return efivarfs.Open(readOnlyEfivars{e.EFIVars})
+}
+
+// virtualEfivars does what the firmware would do for variables written to
+// efivarfs. Authenticated variables are stored without the authentication
+// header, but the signatures are not verified.
+type virtualEfivars struct {
+	*efivarfs.EFIFS
+	fs afero.Fs
+}
+
+// NewVirtualEfivarfs opens the variables in vfs, which should be a filesystem
+// returned by NewEfivarsDirFs. The store is in Setup Mode until a PK is
+// written.
+func NewVirtualEfivarfs(vfs afero.Fs) *efivarfs.Efivarfs {
+	w := fswrapper.NewFSWrapper()
+	w.SetFS(vfs)
+	return efivarfs.Open(&virtualEfivars{&efivarfs.EFIFS{FSWrapper: w}, vfs})
+}
+
+// authenticatedData removes the authentication header from the value of a time
+// based authenticated variable and returns the time of the update
+func authenticatedData(e efivar.Efivar, data []byte) ([]byte, util.EFITime) {
+	if e.Attributes&attributes.EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS == 0 {
+		return data, util.EFITime{}
+	}
+	var auth signature.EFIVariableAuthentication2
+	r := bytes.NewBuffer(data)
+	if err := auth.Unmarshal(r); err != nil {
+		return data, util.EFITime{}
+	}
+	return r.Bytes(), auth.Time
+}
+
+func varPath(v efivar.Efivar) string {
+	return filepath.Join(attributes.Efivars, v.Name+"-"+v.GUID.Format())
+}
+
+func (v *virtualEfivars) GetVar(e efivar.Efivar, u efivar.Unmarshallable) error {
+	_, err := v.GetVarWithAttributes(e, u)
+	return err
+}
+
+func (v *virtualEfivars) GetVarWithAttributes(e efivar.Efivar, u efivar.Unmarshallable) (attributes.Attributes, error) {
+	if varPath(e) != varPath(efivar.SetupMode) {
+		return v.EFIFS.GetVarWithAttributes(e, u)
+	}
+	setupMode := byte(1)
+	_, pk, err := v.ReadEfivarsWithGuid(efivar.PK.Name, *efivar.PK.GUID)
+	if err == nil && pk.Len() > 0 {
+		setupMode = 0
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return e.Attributes, u.Unmarshal(bytes.NewBuffer([]byte{setupMode}))
+}
+
+func (v *virtualEfivars) WriteVar(e efivar.Efivar, m efivar.Marshallable) error {
+	var b bytes.Buffer
+	m.Marshal(&b)
+	data, _ := authenticatedData(e, b.Bytes())
+	if e.Attributes&attributes.EFI_VARIABLE_APPEND_WRITE != 0 {
+		_, old, err := v.ReadEfivarsWithGuid(e.Name, *e.GUID)
+		if err == nil {
+			data = append(old.Bytes(), data...)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// The variable is replaced, or deleted when the new value is empty
+	if err := v.fs.Remove(varPath(e)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return v.WriteEfivarsWithGuid(e.Name, e.Attributes&^attributes.EFI_VARIABLE_APPEND_WRITE, data, *e.GUID)
+}
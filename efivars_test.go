@@ -0,0 +1,94 @@
+package sbctl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestVirtualEfivarfs(t *testing.T) {
+	dir := t.TempDir()
+	vfs := NewEfivarsDirFs(dir)
+	efivars := NewVirtualEfivarfs(vfs)
+
+	if _, err := vfs.Stat("/etc/passwd"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("path outside of efivarfs is accessible: %v", err)
+	}
+	if ok, err := efivars.GetSetupMode(); err != nil || !ok {
+		t.Fatalf("empty variable store is not in setup mode: %v", err)
+	}
+
+	state := &config.State{Fs: afero.NewMemMapFs(), Config: config.DefaultConfig()}
+	kh, err := backend.CreateKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := signature.NewSignatureDatabase()
+	if err := pk.Append(signature.CERT_X509_GUID, eventlogGUID, kh.PK.CertificateBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := efivars.WriteSignedUpdate(efivar.PK, pk, kh.PK.Signer(), kh.PK.Certificate()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "PK-8be4df61-93ca-11d2-aa0d-00e098032b8c")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := efivars.GetSetupMode(); err != nil || ok {
+		t.Fatalf("variable store with a PK is in setup mode: %v", err)
+	}
+	got, err := efivars.GetPK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*got) != 1 || len((*got)[0].Signatures) != 1 {
+		t.Fatalf("authentication header was not removed from PK: %+v", got)
+	}
+
+	// Appended signatures are added to the existing ones
+	db := efivar.Db
+	db.Attributes |= attributes.EFI_VARIABLE_APPEND_WRITE
+	for i := range 2 {
+		sigdb := signature.NewSignatureDatabase()
+		if err := sigdb.Append(signature.CERT_SHA256_GUID, eventlogGUID, []byte{byte(i), 31: 0}); err != nil {
+			t.Fatal(err)
+		}
+		if err := efivars.WriteSignedUpdate(db, sigdb, kh.KEK.Signer(), kh.KEK.Certificate()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := efivars.Getdb(); err != nil || len(signatureEntries(got)) != 2 {
+		t.Fatalf("expected 2 entries in db: %v", err)
+	}
+
+	// An empty PK deletes the variable and enters setup mode
+	if err := efivars.WriteSignedUpdate(efivar.PK, signature.NewSignatureDatabase(), kh.PK.Signer(), kh.PK.Certificate()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := efivars.GetSetupMode(); err != nil || !ok {
+		t.Fatalf("variable store without a PK is not in setup mode: %v", err)
+	}
+}
+
+func TestReadOnlyEfivarfs(t *testing.T) {
+	dir := t.TempDir()
+	efivars := ReadOnlyEfivarfs(NewVirtualEfivarfs(NewEfivarsDirFs(dir)))
+
+	if ok, err := efivars.GetSetupMode(); err != nil || !ok {
+		t.Fatalf("variables can't be read: %v", err)
+	}
+	err := efivars.WriteVar(efivar.PK, signature.NewSignatureDatabase())
+	if !errors.Is(err, ErrReadOnlyEfivars) {
+		t.Fatalf("expected ErrReadOnlyEfivars, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("variables were written: %v", entries)
+	}
+}
@@ -0,0 +1,375 @@
+package sbctl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+// Discovery of the EFI system partition and the extended boot loader
+// partition from the mount table, sysfs and the udev database.
+// https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+
+const (
+	ESPPartType      = "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+	XBOOTLDRPartType = "bc13c2ff-59e6-4262-a352-b275fd6f7172"
+)
+
+// Where a boot partition was found
+const (
+	SourceConfig    = "config"
+	SourceEnv       = "env"
+	SourceMountinfo = "mountinfo"
+)
+
+var (
+	mountinfoPath = "/proc/self/mountinfo"
+	sysBlockDir   = "/sys/dev/block"
+	udevDataDir   = "/run/udev/data"
+	devDir        = "/dev"
+)
+
+var espLocations = []string{
+	"/efi",
+	"/boot",
+	"/boot/efi",
+}
+
+var ErrNoESP = errors.New("failed to find EFI system partition")
+
+type BootPartition struct {
+	Mountpoint string `json:"mountpoint"`
+	Device     string `json:"device,omitempty"`
+	PartType   string `json:"parttype,omitempty"`
+	PartUUID   string `json:"partuuid,omitempty"`
+	Source     string `json:"source"`
+	// The firmware booted from this partition according to
+	// LoaderDevicePartUUID
+	Booted    bool       `json:"booted"`
+	Partition *Partition `json:"-"`
+}
+
+type BootPartitions struct {
+	// All ESPs, the booted one first
+	ESP      []*BootPartition `json:"esp"`
+	XBOOTLDR *BootPartition   `json:"xbootldr,omitempty"`
+}
+
+// Primary returns the ESP sbctl uses when only one is needed
+func (b *BootPartitions) Primary() *BootPartition {
+	if len(b.ESP) == 0 {
+		return nil
+	}
+	return b.ESP[0]
+}
+
+type mountEntry struct {
+	device     string
+	mountpoint string
+	fstype     string
+}
+
+// unescapeMountinfo replaces the octal escapes of spaces and other special
+// characters in mountinfo
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func readMountinfo(vfs afero.Fs) ([]mountEntry, error) {
+	b, err := afero.ReadFile(vfs, mountinfoPath)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(pre)
+		fs := strings.Fields(post)
+		if len(fields) < 5 || len(fs) < 1 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			device:     fields[2],
+			mountpoint: unescapeMountinfo(fields[4]),
+			fstype:     fs[0],
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// readKeyValues reads files like uevent and the udev database, where every
+// line is a KEY=value pair, optionally behind a prefix like E:
+func readKeyValues(vfs afero.Fs, path, prefix string) map[string]string {
+	values := map[string]string{}
+	b, err := afero.ReadFile(vfs, path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line, ok := strings.CutPrefix(line, prefix)
+		if !ok {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+func readSysfsUint(vfs afero.Fs, path string) uint64 {
+	b, err := afero.ReadFile(vfs, path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return n
+}
+
+// readGPTEntry reads the type and unique GUID of a partition from the GPT of
+// the disk. This is used when the udev database is not available.
+func readGPTEntry(vfs afero.Fs, disk string, partn, sectorSize uint64) (string, string, error) {
+	f, err := vfs.Open(disk)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	header := make([]byte, 92)
+	if _, err := f.ReadAt(header, int64(sectorSize)); err != nil {
+		return "", "", err
+	}
+	if string(header[:8]) != "EFI PART" {
+		return "", "", fmt.Errorf("%s has no GPT", disk)
+	}
+	entriesLBA := binary.LittleEndian.Uint64(header[72:])
+	count := binary.LittleEndian.Uint32(header[80:])
+	size := binary.LittleEndian.Uint32(header[84:])
+	if partn == 0 || partn > uint64(count) || size < 128 {
+		return "", "", fmt.Errorf("partition %d is not in the GPT of %s", partn, disk)
+	}
+	entry := make([]byte, 32)
+	if _, err := f.ReadAt(entry, int64(entriesLBA*sectorSize+(partn-1)*uint64(size))); err != nil {
+		return "", "", err
+	}
+	return formatGUID(entry[0:16]), formatGUID(entry[16:32]), nil
+}
+
+// partitionInfo fills in the partition of the block device major:minor from
+// sysfs and the udev database
+func partitionInfo(vfs afero.Fs, device string) *BootPartition {
+	// The sysfs entry is a symlink to the partition in the directory of the
+	// disk
+	sys := filepath.Join(sysBlockDir, device)
+	if lr, ok := vfs.(afero.LinkReader); ok {
+		if target, err := lr.ReadlinkIfPossible(sys); err == nil {
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(sys), target)
+			}
+			sys = target
+		}
+	}
+	disk := filepath.Dir(sys)
+	uevent := readKeyValues(vfs, filepath.Join(sys, "uevent"), "")
+	if uevent["DEVTYPE"] != "partition" {
+		return nil
+	}
+	sectorSize := readSysfsUint(vfs, filepath.Join(disk, "queue/logical_block_size"))
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	b := &BootPartition{
+		Device: filepath.Join(devDir, uevent["DEVNAME"]),
+		Partition: &Partition{
+			Number: uint32(readSysfsUint(vfs, filepath.Join(sys, "partition"))),
+			// sysfs reports the start and size in 512 byte sectors
+			Start:      readSysfsUint(vfs, filepath.Join(sys, "start")) * 512,
+			Size:       readSysfsUint(vfs, filepath.Join(sys, "size")) * 512,
+			SectorSize: sectorSize,
+		},
+	}
+	udev := readKeyValues(vfs, filepath.Join(udevDataDir, "b"+device), "E:")
+	b.PartType = strings.ToLower(udev["ID_PART_ENTRY_TYPE"])
+	b.PartUUID = strings.ToLower(udev["ID_PART_ENTRY_UUID"])
+	if b.PartType == "" {
+		diskEvent := readKeyValues(vfs, filepath.Join(disk, "uevent"), "")
+		parttype, partuuid, err := readGPTEntry(vfs, filepath.Join(devDir, diskEvent["DEVNAME"]), uint64(b.Partition.Number), sectorSize)
+		if err != nil {
+			return nil
+		}
+		b.PartType, b.PartUUID = parttype, partuuid
+	}
+	b.Partition.UUID = b.PartUUID
+	return b
+}
+
+// mountedBootPartitions returns all mounted ESP and XBOOTLDR partitions
+func mountedBootPartitions(vfs afero.Fs) ([]*BootPartition, error) {
+	mounts, err := readMountinfo(vfs)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*BootPartition
+	seen := map[string]*BootPartition{}
+	for _, m := range mounts {
+		if p, ok := seen[m.device]; ok {
+			// Prefer the well known locations for bind mounted partitions
+			if p != nil && slices.Contains(espLocations, m.mountpoint) && !slices.Contains(espLocations, p.Mountpoint) {
+				p.Mountpoint = m.mountpoint
+			}
+			continue
+		}
+		p := partitionInfo(vfs, m.device)
+		if p == nil || (p.PartType != ESPPartType && p.PartType != XBOOTLDRPartType) {
+			seen[m.device] = nil
+			continue
+		}
+		// The ESP is always FAT
+		if p.PartType == ESPPartType && m.fstype != "vfat" {
+			seen[m.device] = nil
+			continue
+		}
+		p.Mountpoint = m.mountpoint
+		p.Source = SourceMountinfo
+		seen[m.device] = p
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// explicitPartition returns the mounted partition at path, or a partition
+// without any device information
+func explicitPartition(mounted []*BootPartition, path, source string) *BootPartition {
+	path = filepath.Clean(path)
+	for _, p := range mounted {
+		if p.Mountpoint == path {
+			p.Source = source
+			return p
+		}
+	}
+	return &BootPartition{Mountpoint: path, Source: source}
+}
+
+// DiscoverBootPartitions finds the ESPs and the XBOOTLDR partition. The ESP
+// paths from the environment and the esp list take precedence over the
+// mounted partitions. efivars is used to find the ESP the system booted from,
+// and may be nil.
+func DiscoverBootPartitions(vfs afero.Fs, efivars *efivarfs.Efivarfs, esp, xbootldr []string) (*BootPartitions, error) {
+	for _, location := range slices.Concat(espLocations, esp, xbootldr) {
+		// "Read" a file inside all candiadate locations to trigger an
+		// automount if there's an automount partition.
+		_, _ = vfs.Stat(fmt.Sprintf("%s/does-not-exist", location))
+	}
+
+	mounted, err := mountedBootPartitions(vfs)
+	if err != nil && len(esp) == 0 {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	parts := &BootPartitions{}
+	for _, env := range []string{"SYSTEMD_ESP_PATH", "ESP_PATH"} {
+		if path, ok := os.LookupEnv(env); ok {
+			parts.ESP = []*BootPartition{explicitPartition(mounted, path, SourceEnv)}
+			break
+		}
+	}
+	if len(parts.ESP) == 0 {
+		for _, path := range esp {
+			parts.ESP = append(parts.ESP, explicitPartition(mounted, path, SourceConfig))
+		}
+	}
+	if len(parts.ESP) == 0 {
+		for _, p := range mounted {
+			if p.PartType == ESPPartType {
+				parts.ESP = append(parts.ESP, p)
+			}
+		}
+	}
+
+	if path, ok := os.LookupEnv("SYSTEMD_XBOOTLDR_PATH"); ok {
+		parts.XBOOTLDR = explicitPartition(mounted, path, SourceEnv)
+	} else if len(xbootldr) > 0 {
+		parts.XBOOTLDR = explicitPartition(mounted, xbootldr[0], SourceConfig)
+	} else {
+		for _, p := range mounted {
+			if p.PartType == XBOOTLDRPartType {
+				parts.XBOOTLDR = p
+				break
+			}
+		}
+	}
+
+	if efivars != nil {
+		var loader efivar.Efistring
+		if err := efivars.GetVar(efivar.LoaderDevicePartUUID, &loader); err == nil {
+			for _, p := range parts.ESP {
+				p.Booted = p.PartUUID != "" && strings.EqualFold(p.PartUUID, string(loader))
+			}
+		}
+	}
+
+	// The booted ESP first, followed by the well known locations
+	rank := func(p *BootPartition) int {
+		if p.Booted {
+			return -1
+		}
+		if i := slices.Index(espLocations, p.Mountpoint); i != -1 {
+			return i
+		}
+		return len(espLocations)
+	}
+	// Explicitly configured ESPs keep their order
+	if len(parts.ESP) > 0 && parts.ESP[0].Source == SourceMountinfo {
+		slices.SortStableFunc(parts.ESP, func(a, b *BootPartition) int {
+			return rank(a) - rank(b)
+		})
+	}
+
+	if len(parts.ESP) == 0 {
+		return nil, ErrNoESP
+	}
+	return parts, nil
+}
+
+// FindBootPartitions finds the boot partitions with the configuration of
+// state
+func FindBootPartitions(state *config.State) (*BootPartitions, error) {
+	return DiscoverBootPartitions(state.Fs, state.Efivarfs, state.Config.ESP, state.Config.XBOOTLDR)
+}
+
+// FindESP returns the mountpoint of the primary ESP with the configuration of
+// state
+func FindESP(state *config.State) (string, error) {
+	parts, err := FindBootPartitions(state)
+	if err != nil {
+		return "", err
+	}
+	return parts.Primary().Mountpoint, nil
+}
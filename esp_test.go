@@ -0,0 +1,132 @@
+package sbctl
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivarfs/testfs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+const testMountinfo = `22 1 0:21 / / rw,relatime shared:1 - btrfs /dev/mapper/root rw
+35 22 259:1 / /efi rw,relatime shared:2 - vfat /dev/nvme0n1p1 rw
+36 22 8:2 / /mnt/second\040esp rw,relatime shared:3 - vfat /dev/sda2 rw
+37 22 259:3 / /boot rw,relatime shared:4 - vfat /dev/nvme0n1p3 rw
+38 22 259:4 / /home rw,relatime shared:5 - ext4 /dev/nvme0n1p4 rw
+`
+
+// testGPT returns a disk with a GPT where the second partition is an ESP
+func testGPT(t *testing.T, partuuid string) []byte {
+	disk := make([]byte, 512*4)
+	copy(disk[512:], "EFI PART")
+	disk[512+72] = 2   // entries LBA
+	disk[512+80] = 128 // number of entries
+	disk[512+84] = 128 // entry size
+	for i, guid := range []string{ESPPartType, partuuid} {
+		b, err := parseGUID(guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(disk[1024+128+i*16:], b)
+	}
+	return disk
+}
+
+func testBootPartitionsFs(t *testing.T) afero.Fs {
+	vfs := afero.NewMemMapFs()
+	for f, data := range map[string]string{
+		"/proc/self/mountinfo": testMountinfo,
+		// Partitions are symlinked into the directory of the disk, which
+		// is sysBlockDir in the in-memory filesystem
+		"/sys/dev/block/259:1/uevent":    "DEVTYPE=partition\nDEVNAME=nvme0n1p1\n",
+		"/sys/dev/block/259:1/partition": "1\n",
+		"/sys/dev/block/259:1/start":     "2048\n",
+		"/sys/dev/block/259:1/size":      "1048576\n",
+		"/sys/dev/block/259:3/uevent":    "DEVTYPE=partition\nDEVNAME=nvme0n1p3\n",
+		"/sys/dev/block/259:3/partition": "3\n",
+		"/sys/dev/block/259:4/uevent":    "DEVTYPE=partition\nDEVNAME=nvme0n1p4\n",
+		"/sys/dev/block/8:2/uevent":      "DEVTYPE=partition\nDEVNAME=sda2\n",
+		"/sys/dev/block/8:2/partition":   "2\n",
+		"/sys/dev/block/uevent":          "DEVTYPE=disk\nDEVNAME=sda\n",
+		"/run/udev/data/b259:1":          "E:ID_PART_ENTRY_TYPE=C12A7328-F81F-11D2-BA4B-00A0C93EC93B\nE:ID_PART_ENTRY_UUID=11111111-2222-3333-4444-555555555555\n",
+		"/run/udev/data/b259:3":          "E:ID_PART_ENTRY_TYPE=" + XBOOTLDRPartType + "\nE:ID_PART_ENTRY_UUID=33333333-2222-3333-4444-555555555555\n",
+		"/run/udev/data/b259:4":          "E:ID_PART_ENTRY_TYPE=0fc63daf-8483-4772-8e79-3d69d8477de4\n",
+		"/dev/sda":                       string(testGPT(t, "22222222-2222-3333-4444-555555555555")),
+	} {
+		if err := afero.WriteFile(vfs, f, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return vfs
+}
+
+func TestFindESP(t *testing.T) {
+	vfs := testBootPartitionsFs(t)
+
+	parts, err := DiscoverBootPartitions(vfs, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts.ESP) != 2 {
+		t.Fatalf("expected 2 ESPs, got %d", len(parts.ESP))
+	}
+	esp := parts.Primary()
+	if esp.Mountpoint != "/efi" || esp.Device != "/dev/nvme0n1p1" || esp.PartUUID != "11111111-2222-3333-4444-555555555555" {
+		t.Fatalf("unexpected ESP %+v", esp)
+	}
+	want := Partition{Number: 1, Start: 1048576, Size: 536870912, UUID: esp.PartUUID, SectorSize: 512}
+	if *esp.Partition != want {
+		t.Fatalf("expected %+v, got %+v", want, *esp.Partition)
+	}
+	if second := parts.ESP[1]; second.Mountpoint != "/mnt/second esp" || second.PartUUID != "22222222-2222-3333-4444-555555555555" {
+		t.Fatalf("unexpected second ESP %+v", second)
+	}
+	if parts.XBOOTLDR == nil || parts.XBOOTLDR.Mountpoint != "/boot" {
+		t.Fatalf("unexpected XBOOTLDR %+v", parts.XBOOTLDR)
+	}
+
+	// The ESP the firmware booted from comes first
+	efivars := testfs.NewTestFS().With(fstest.MapFS{
+		"/sys/firmware/efi/efivars/LoaderDevicePartUUID-4a67b082-0a4c-41cf-b6c7-440b29bb8c4f": {
+			Data: append([]byte{0x06, 0x00, 0x00, 0x00}, util.MarshalUtf16Var("22222222-2222-3333-4444-555555555555")...),
+		},
+	}).Open()
+	parts, err = DiscoverBootPartitions(vfs, efivars, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esp := parts.Primary(); esp.Mountpoint != "/mnt/second esp" || !esp.Booted {
+		t.Fatalf("expected the booted ESP first, got %+v", esp)
+	}
+
+	// Explicitly configured ESPs take precedence
+	parts, err = DiscoverBootPartitions(vfs, nil, []string{"/mnt/second esp", "/srv/esp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts.ESP) != 2 || parts.ESP[0].Source != SourceConfig || parts.ESP[0].Partition == nil || parts.ESP[1].Mountpoint != "/srv/esp" {
+		t.Fatalf("unexpected configured ESPs %+v", parts.ESP)
+	}
+
+	// Bundles default to the configured ESP
+	state := &config.State{Fs: vfs, Config: config.DefaultConfig()}
+	state.Config.ESP = []string{"/srv/esp"}
+	bundle, err := NewBundle(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.ESP != "/srv/esp" {
+		t.Fatalf("expected /srv/esp, got %s", bundle.ESP)
+	}
+
+	t.Setenv("SYSTEMD_ESP_PATH", "/efi")
+	esp1, err := FindESP(&config.State{Fs: vfs, Config: config.DefaultConfig()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esp1 != "/efi" {
+		t.Fatalf("expected /efi, got %s", esp1)
+	}
+}
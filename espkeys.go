@@ -0,0 +1,148 @@
+package sbctl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+// The signed EFI variables can be written to the ESP to be enrolled from the
+// firmware setup or an enrollment tool like KeyTool when writing to efivarfs
+// fails. The directory is the one systemd-boot looks for keys to enroll in.
+
+var (
+	ESPKeysDir      = "loader/keys/sbctl"
+	ESPKeysManifest = "sbctl-manifest.json"
+
+	ErrESPKeysModified = errors.New("file has been modified since it was exported")
+)
+
+// ESPKeysFile is an authenticated variable written to the ESP
+type ESPKeysFile struct {
+	Name     string `json:"name"`
+	Variable string `json:"variable"`
+	SignedBy string `json:"signed_by"`
+	Size     int    `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// ESPKeys is the manifest of the exported variables. The files are listed in
+// the order they should be enrolled, the PK last as enrolling it ends Setup
+// Mode.
+type ESPKeys struct {
+	Created time.Time     `json:"created"`
+	GUID    string        `json:"guid"`
+	Files   []ESPKeysFile `json:"files"`
+}
+
+// ESPKeysPayload is the signed value of a variable
+type ESPKeysPayload struct {
+	Variable string
+	SignedBy string
+	Data     []byte
+}
+
+func espKeysFileName(variable string) string {
+	return variable + ".auth"
+}
+
+// WriteESPKeys writes the payloads and the manifest into dir
+func WriteESPKeys(vfs afero.Fs, dir, guid string, payloads []ESPKeysPayload) (*ESPKeys, error) {
+	if err := vfs.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	m := &ESPKeys{
+		Created: time.Now().UTC(),
+		GUID:    guid,
+		Files:   []ESPKeysFile{},
+	}
+	for _, p := range payloads {
+		name := espKeysFileName(p.Variable)
+		if err := fs.WriteFile(vfs, filepath.Join(dir, name), p.Data, 0o644); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(p.Data)
+		m.Files = append(m.Files, ESPKeysFile{
+			Name:     name,
+			Variable: p.Variable,
+			SignedBy: p.SignedBy,
+			Size:     len(p.Data),
+			SHA256:   hex.EncodeToString(sum[:]),
+		})
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.WriteFile(vfs, filepath.Join(dir, ESPKeysManifest), b, 0o644); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func ReadESPKeys(vfs afero.Fs, dir string) (*ESPKeys, error) {
+	b, err := fs.ReadFile(vfs, filepath.Join(dir, ESPKeysManifest))
+	if err != nil {
+		return nil, err
+	}
+	var m ESPKeys
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// RemoveESPKeys removes the files listed in the manifest of dir, the manifest
+// and dir if it is empty afterwards. Files which have been modified since they
+// were written are kept unless force is set. The removed files are returned.
+func RemoveESPKeys(vfs afero.Fs, dir string, force bool) ([]string, error) {
+	m, err := ReadESPKeys(vfs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var errs []error
+	for _, f := range m.Files {
+		path := filepath.Join(dir, filepath.Base(f.Name))
+		b, err := fs.ReadFile(vfs, path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sum := sha256.Sum256(b)
+		if !force && hex.EncodeToString(sum[:]) != f.SHA256 {
+			errs = append(errs, fmt.Errorf("%s: %w", path, ErrESPKeysModified))
+			continue
+		}
+		if err := vfs.Remove(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+	// Keep the manifest as long as files it lists are left
+	if len(errs) > 0 {
+		return removed, errors.Join(errs...)
+	}
+	manifest := filepath.Join(dir, ESPKeysManifest)
+	if err := vfs.Remove(manifest); err != nil {
+		return removed, err
+	}
+	removed = append(removed, manifest)
+	if entries, err := afero.ReadDir(vfs, dir); err == nil && len(entries) == 0 {
+		if err := vfs.Remove(dir); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
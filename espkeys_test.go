@@ -0,0 +1,54 @@
+package sbctl
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+func TestESPKeys(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	dir := filepath.Join("/efi", ESPKeysDir)
+
+	payloads := []ESPKeysPayload{
+		{Variable: "db", SignedBy: "KEK", Data: []byte("db")},
+		{Variable: "dbx", SignedBy: "KEK", Data: []byte("dbx")},
+		{Variable: "KEK", SignedBy: "PK", Data: []byte("KEK")},
+		{Variable: "PK", SignedBy: "PK", Data: []byte("PK")},
+	}
+	if _, err := WriteESPKeys(vfs, dir, "guid", payloads); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadESPKeys(vfs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 4 || m.Files[3].Name != "PK.auth" || m.Files[1].Name != "dbx.auth" {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	// Modified files are kept together with the manifest
+	if err := fs.WriteFile(vfs, filepath.Join(dir, "db.auth"), []byte("other"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := RemoveESPKeys(vfs, dir, false)
+	if !errors.Is(err, ErrESPKeysModified) {
+		t.Fatalf("expected ErrESPKeysModified, got %v", err)
+	}
+	if len(removed) != 3 {
+		t.Fatalf("unexpected removed files %v", removed)
+	}
+	if _, err := ReadESPKeys(vfs, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RemoveESPKeys(vfs, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := afero.Exists(vfs, dir); ok {
+		t.Fatalf("%s was not removed", dir)
+	}
+}
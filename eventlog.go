@@ -0,0 +1,254 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/google/go-attestation/attest"
+	"github.com/spf13/afero"
+)
+
+// Event types of images loaded by the firmware
+const (
+	evEFIVariableAuthority     = "EV_EFI_VARIABLE_AUTHORITY"
+	evEFIBootServicesDriver    = "EV_EFI_BOOT_SERVICES_DRIVER"
+	evEFIBootServicesApp       = "EV_EFI_BOOT_SERVICES_APPLICATION"
+	evEFIRuntimeServicesDriver = "EV_EFI_RUNTIME_SERVICES_DRIVER"
+)
+
+// Recommendations for enrolling keys on systems with option ROMs
+const (
+	RecommendNothing     = "none"
+	RecommendMicrosoft   = "microsoft"
+	RecommendTPMEventlog = "tpm-eventlog"
+)
+
+// EventlogAuthority is a db entry the firmware verified an image with
+type EventlogAuthority struct {
+	Owner   string `json:"owner"`
+	Subject string `json:"subject,omitempty"`
+	Vendor  string `json:"vendor,omitempty"`
+	// Enrolled is unset when the db is not known
+	Enrolled *bool `json:"enrolled,omitempty"`
+	data     []byte
+}
+
+func (a *EventlogAuthority) String() string {
+	name := a.Subject
+	if name == "" {
+		name = a.Owner
+	}
+	var notes []string
+	if a.Vendor != "" {
+		notes = append(notes, a.Vendor)
+	}
+	switch {
+	case a.Enrolled == nil:
+	case *a.Enrolled:
+		notes = append(notes, "enrolled")
+	default:
+		notes = append(notes, "not enrolled")
+	}
+	if len(notes) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, strings.Join(notes, ", "))
+}
+
+// EventlogImage is a driver or application loaded by the firmware
+type EventlogImage struct {
+	PCR        int                `json:"pcr"`
+	Type       string             `json:"type"`
+	DevicePath string             `json:"device_path"`
+	Digests    map[string]string  `json:"digests"`
+	OptionROM  bool               `json:"option_rom"`
+	Authority  *EventlogAuthority `json:"authority,omitempty"`
+	// AuthorityUnknown is set when an authority was measured earlier, but
+	// not for this image
+	AuthorityUnknown bool `json:"authority_unknown,omitempty"`
+}
+
+type EventlogReport struct {
+	Banks          []string         `json:"banks"`
+	Images         []*EventlogImage `json:"images"`
+	OptionROMs     int              `json:"option_roms"`
+	Recommendation string           `json:"recommendation"`
+}
+
+// ParseEventlog reads a TPM eventlog
+func ParseEventlog(vfs afero.Fs, eventlog string) (*attest.EventLog, error) {
+	b, err := fs.ReadFile(vfs, eventlog)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoEventlog
+	} else if err != nil {
+		return nil, err
+	}
+	return attest.ParseEventLog(b)
+}
+
+// imageLoadDevicePath returns the device path of an UEFI_IMAGE_LOAD_EVENT
+func imageLoadDevicePath(data []byte) []byte {
+	// ImageLocationInMemory, ImageLengthInMemory, ImageLinkTimeAddress and
+	// LengthOfDevicePath are all 64 bit
+	if len(data) < 32 {
+		return nil
+	}
+	n := binary.LittleEndian.Uint64(data[24:])
+	if n > uint64(len(data)-32) {
+		return nil
+	}
+	return data[32 : 32+n]
+}
+
+// parseVariableData parses an UEFI_VARIABLE_DATA event and returns the
+// variable name and data
+func parseVariableData(data []byte) (string, []byte, error) {
+	// VariableName GUID, UnicodeNameLength and VariableDataLength
+	if len(data) < 32 {
+		return "", nil, errors.New("short variable event")
+	}
+	nameLen := binary.LittleEndian.Uint64(data[16:])
+	dataLen := binary.LittleEndian.Uint64(data[24:])
+	if nameLen > uint64(len(data)-32)/2 || dataLen > uint64(len(data)-32)-nameLen*2 {
+		return "", nil, errors.New("invalid variable event")
+	}
+	name := make([]uint16, nameLen)
+	for i := range name {
+		name[i] = binary.LittleEndian.Uint16(data[32+i*2:])
+	}
+	return string(utf16.Decode(name)), data[32+nameLen*2 : 32+nameLen*2+dataLen], nil
+}
+
+// parseAuthority parses the UEFI_VARIABLE_DATA of an authority event, which
+// holds the EFI_SIGNATURE_DATA of the db entry
+func parseAuthority(data []byte) (*EventlogAuthority, error) {
+	_, sig, err := parseVariableData(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) < 16 {
+		return nil, errors.New("short authority signature data")
+	}
+	var owner util.EFIGUID
+	if err := binary.Read(bytes.NewReader(sig), binary.LittleEndian, &owner); err != nil {
+		return nil, err
+	}
+	a := &EventlogAuthority{Owner: owner.Format(), data: sig[16:]}
+	if cert, err := x509.ParseCertificate(a.data); err == nil {
+		a.Subject = cert.Subject.CommonName
+	}
+
+	sigdb := signature.NewSignatureDatabase()
+	if err := sigdb.Append(signature.CERT_X509_GUID, owner, a.data); err == nil {
+		if vendors := certs.DetectVendorCerts(sigdb); len(vendors) > 0 {
+			a.Vendor = vendors[0]
+		}
+	}
+	if a.Vendor == "" && isMicrosoftCert(a.data) {
+		a.Vendor = "microsoft"
+	}
+	return a, nil
+}
+
+func isMicrosoftCert(data []byte) bool {
+	db, err := certs.GetOEMCerts("microsoft", "db")
+	if err != nil {
+		return false
+	}
+	for _, l := range *db {
+		for _, sig := range l.Signatures {
+			if bytes.Equal(sig.Data, data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AnalyzeEventlog lists all images loaded by the firmware with their digests
+// in every bank. An image is only attributed to an authority measured directly
+// before it, without any other image loaded in between. The firmware measures
+// an authority only the first time it is used, so the authority of the later
+// images is unknown. The db is used to tell if the authorities are still
+// enrolled, and can be nil.
+func AnalyzeEventlog(log *attest.EventLog, db *signature.SignatureDatabase) (*EventlogReport, error) {
+	report := &EventlogReport{Banks: []string{}, Images: []*EventlogImage{}}
+	var banks [][]attest.Event
+	for _, alg := range log.Algs {
+		report.Banks = append(report.Banks, strings.ToLower(alg.String()))
+		banks = append(banks, log.Events(alg))
+	}
+	if len(banks) == 0 {
+		return report, nil
+	}
+
+	// authority is measured for the next image, events of the other PCRs can
+	// be logged in between
+	var authority *EventlogAuthority
+	var measured bool
+	for i, event := range banks[0] {
+		switch event.Type.String() {
+		case evEFIVariableAuthority:
+			a, err := parseAuthority(event.Data)
+			if err != nil {
+				return nil, err
+			}
+			if db != nil {
+				enrolled := db.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{
+					Owner: *util.StringToGUID(a.Owner),
+					Data:  a.data,
+				})
+				a.Enrolled = &enrolled
+			}
+			authority = a
+			measured = true
+		case evEFIBootServicesDriver, evEFIBootServicesApp, evEFIRuntimeServicesDriver:
+			image := &EventlogImage{
+				PCR:        event.Index,
+				Type:       event.Type.String(),
+				DevicePath: FormatDevicePath(imageLoadDevicePath(event.Data)),
+				Digests:    map[string]string{},
+				OptionROM:  event.Type.String() == evEFIBootServicesDriver,
+				Authority:  authority,
+			}
+			image.AuthorityUnknown = authority == nil && measured
+			authority = nil
+			for j, bank := range banks {
+				if d := bank[i].Digest; len(d) > 0 {
+					image.Digests[report.Banks[j]] = hex.EncodeToString(d)
+				}
+			}
+			if image.OptionROM {
+				report.OptionROMs++
+			}
+			report.Images = append(report.Images, image)
+		}
+	}
+
+	report.Recommendation = RecommendNothing
+	for _, image := range report.Images {
+		if !image.OptionROM {
+			continue
+		}
+		// Without an authority Secure Boot was disabled, or the option ROM
+		// was verified by its hash. An unknown authority might not be
+		// Microsoft either.
+		if image.Authority == nil || image.Authority.Vendor != "microsoft" {
+			report.Recommendation = RecommendTPMEventlog
+			break
+		}
+		report.Recommendation = RecommendMicrosoft
+	}
+	return report, nil
+}
@@ -0,0 +1,57 @@
+package sbctl
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestAnalyzeEventlog(t *testing.T) {
+	for _, test := range []struct {
+		File           string
+		Images         int
+		OptionROMs     int
+		Recommendation string
+	}{
+		{"tests/tpm_eventlogs/t480s_eventlog", 3, 0, RecommendNothing},
+		{"tests/tpm_eventlogs/t14s_eventlog", 14, 11, RecommendTPMEventlog},
+		{"tests/tpm_eventlogs/t14_eventlog", 10, 7, RecommendTPMEventlog},
+	} {
+		log, err := ParseEventlog(afero.NewOsFs(), test.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := AnalyzeEventlog(log, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Images) != test.Images || report.OptionROMs != test.OptionROMs || report.Recommendation != test.Recommendation {
+			t.Fatalf("%s: unexpected report: %d images, %d option roms, %s", test.File, len(report.Images), report.OptionROMs, report.Recommendation)
+		}
+		if len(report.Banks) != 2 || len(report.Images[0].Digests) != 2 {
+			t.Fatalf("%s: expected sha1 and sha256 digests", test.File)
+		}
+	}
+
+	log, err := ParseEventlog(afero.NewOsFs(), "tests/tpm_eventlogs/t480s_eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := AnalyzeEventlog(log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := report.Images[1]
+	if image.DevicePath != `PciRoot(0x0)/Pci(0x1d,0x0)/Pci(0x0,0x0)/NVMe(0x1,00-25-38-86-81-B2-E0-F4)/HD(1,GPT,d78d8c94-d277-4635-a73c-a68cd6ddb6ab,0x800,0xff801)/File(\EFI\systemd\systemd-bootx64.efi)` {
+		t.Fatalf("unexpected device path %s", image.DevicePath)
+	}
+	// The authority is only measured for the first image it verified
+	if first := report.Images[0]; first.Authority == nil || first.Authority.Subject != "Database Key" || first.AuthorityUnknown {
+		t.Fatalf("unexpected authority %v", first.Authority)
+	}
+	for _, image := range report.Images[1:] {
+		if image.Authority != nil || !image.AuthorityUnknown {
+			t.Fatalf("%s: expected an unknown authority, got %v", image.DevicePath, image.Authority)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+var journalSocket = "/run/systemd/journal/socket"
+
+// JournalHandler is a slog.Handler sending records to the systemd journal
+// with the native journal protocol. Attributes become journal fields.
+type JournalHandler struct {
+	conn   *net.UnixConn
+	attrs  []slog.Attr
+	prefix string
+}
+
+func NewJournalHandler() (*JournalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournalHandler{conn: conn}, nil
+}
+
+func (h *JournalHandler) Close() error {
+	return h.conn.Close()
+}
+
+func (h *JournalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+// journalField converts an attribute key to a valid journal field name
+func journalField(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, key)
+}
+
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	// Values with newlines are prefixed with their length
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+func (h *JournalHandler) appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		for _, g := range a.Value.Group() {
+			h.appendAttr(buf, prefix+a.Key+"_", g)
+		}
+		return
+	}
+	writeJournalField(buf, journalField(prefix+a.Key), a.Value.String())
+}
+
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	priority := 6
+	switch {
+	case r.Level >= slog.LevelError:
+		priority = 3
+	case r.Level >= slog.LevelWarn:
+		priority = 4
+	case r.Level < slog.LevelInfo:
+		priority = 7
+	}
+	writeJournalField(&buf, "MESSAGE", r.Message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(priority))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", "sbctl")
+	for _, a := range h.attrs {
+		h.appendAttr(&buf, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		h.appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		c.attrs = append(c.attrs, a)
+	}
+	return &c
+}
+
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.prefix += name + "_"
+	return &c
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 
 	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/quirks"
 	"github.com/landlock-lsm/go-landlock/landlock"
 
 	ll "github.com/landlock-lsm/go-landlock/landlock/syscall"
@@ -26,6 +27,7 @@ func LandlockRulesFromConfig(conf *config.Config) {
 		landlock.RODirs(
 			"/sys/devices/virtual/dmi/id/",
 		).IgnoreIfMissing(),
+		landlock.RODirs(quirks.Dirs...).IgnoreIfMissing(),
 		landlock.RWDirs(
 			filepath.Dir(conf.Keydir),
 			// It seems to me that RWFiles should work on efivars, but it doesn't.
@@ -47,6 +49,10 @@ func LandlockRulesFromConfig(conf *config.Config) {
 			"/dev/tpm0", "/dev/tpmrm0",
 		).IgnoreIfMissing(),
 	)
+	if conf.AuditLog != "" {
+		// The audit log is created on the first audited command
+		rules = append(rules, landlock.RWDirs(filepath.Dir(conf.AuditLog)).IgnoreIfMissing())
+	}
 }
 
 func RestrictAdditionalPaths(r ...landlock.Rule) {
@@ -0,0 +1,311 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+)
+
+// Option ROMs are read from the expansion ROM of the PCI devices in sysfs.
+// The EFI images are located through the PCI expansion ROM headers as
+// described in the PCI Firmware Specification and UEFI 2.10 section 14.4.2.
+
+var (
+	pciDevicesDir = "/sys/bus/pci/devices"
+	pciOpromGUID  = *util.StringToGUID("a3b7c07a-6d1e-4b8e-9f2f-5c0e3d2a9b41")
+
+	ErrNoOptionROMs = errors.New("no option roms found")
+)
+
+// Code types of PCI expansion ROM images
+var romCodeTypes = map[uint8]string{
+	0x00: "legacy",
+	0x01: "open-firmware",
+	0x02: "hp-pa-risc",
+	0x03: "efi",
+}
+
+var romMachineTypes = map[uint16]string{
+	0x014c: "ia32",
+	0x0200: "ia64",
+	0x0ebc: "ebc",
+	0x8664: "x64",
+	0xaa64: "aa64",
+	0x5064: "riscv64",
+	0x6264: "loongarch64",
+}
+
+const (
+	romSignature    = 0xaa55
+	romEFISignature = 0x0ef1
+	romCodeTypeEFI  = 0x03
+	romLastImage    = 0x80
+	romBlockSize    = 512
+)
+
+// OptionROMImage is one image of a PCI expansion ROM
+type OptionROMImage struct {
+	Offset     int      `json:"offset"`
+	VendorID   string   `json:"vendor_id"`
+	DeviceID   string   `json:"device_id"`
+	CodeType   string   `json:"code_type"`
+	Machine    string   `json:"machine,omitempty"`
+	Compressed bool     `json:"compressed,omitempty"`
+	Digest     string   `json:"sha256,omitempty"`
+	Signers    []string `json:"signers,omitempty"`
+	// Authority is the known certificate which issued a signer
+	Authority string `json:"authority,omitempty"`
+	Vendor    string `json:"vendor,omitempty"`
+	digest    []byte
+}
+
+// EFI reports whether the image is an EFI driver
+func (i *OptionROMImage) EFI() bool {
+	return i.CodeType == romCodeTypes[romCodeTypeEFI]
+}
+
+// OptionROM is the expansion ROM of a PCI device
+type OptionROM struct {
+	Device string            `json:"device"`
+	Class  string            `json:"class,omitempty"`
+	Images []*OptionROMImage `json:"images"`
+}
+
+// ParseOptionROM parses the images of a PCI expansion ROM. The Authenticode
+// hash is calculated for uncompressed EFI images.
+func ParseOptionROM(rom []byte) ([]*OptionROMImage, error) {
+	var images []*OptionROMImage
+	for off := 0; off+0x1a <= len(rom); {
+		if binary.LittleEndian.Uint16(rom[off:]) != romSignature {
+			if off == 0 {
+				return nil, fmt.Errorf("invalid option rom signature")
+			}
+			break
+		}
+		pcir := off + int(binary.LittleEndian.Uint16(rom[off+0x18:]))
+		if pcir+0x18 > len(rom) || string(rom[pcir:pcir+4]) != "PCIR" {
+			return images, fmt.Errorf("invalid pci data structure at offset 0x%x", off)
+		}
+		length := int(binary.LittleEndian.Uint16(rom[pcir+0x10:])) * romBlockSize
+		codeType := rom[pcir+0x14]
+		image := &OptionROMImage{
+			Offset:   off,
+			VendorID: fmt.Sprintf("%04x", binary.LittleEndian.Uint16(rom[pcir+0x04:])),
+			DeviceID: fmt.Sprintf("%04x", binary.LittleEndian.Uint16(rom[pcir+0x06:])),
+			CodeType: romCodeTypes[codeType],
+		}
+		if image.CodeType == "" {
+			image.CodeType = fmt.Sprintf("0x%02x", codeType)
+		}
+		end := min(off+length, len(rom))
+
+		if codeType == romCodeTypeEFI && binary.LittleEndian.Uint32(rom[off+0x04:]) == romEFISignature {
+			machine := binary.LittleEndian.Uint16(rom[off+0x0a:])
+			image.Machine = romMachineTypes[machine]
+			if image.Machine == "" {
+				image.Machine = fmt.Sprintf("0x%04x", machine)
+			}
+			image.Compressed = binary.LittleEndian.Uint16(rom[off+0x0c:]) != 0
+			if !image.Compressed {
+				initSize := int(binary.LittleEndian.Uint16(rom[off+0x02:])) * romBlockSize
+				start := off + int(binary.LittleEndian.Uint16(rom[off+0x16:]))
+				if start > end || off+initSize < start {
+					return images, fmt.Errorf("invalid efi image offset at offset 0x%x", off)
+				}
+				if err := image.parsePE(rom[start:min(off+initSize, end)]); err != nil {
+					return images, fmt.Errorf("efi image at offset 0x%x: %w", off, err)
+				}
+			}
+		}
+		images = append(images, image)
+
+		if rom[pcir+0x15]&romLastImage != 0 || length == 0 {
+			break
+		}
+		off += length
+	}
+	return images, nil
+}
+
+// parsePE calculates the Authenticode hash of the EFI driver and finds the
+// certificates it is signed with
+func (i *OptionROMImage) parsePE(pe []byte) error {
+	peBinary, err := authenticode.Parse(bytes.NewReader(pe))
+	if err != nil {
+		return err
+	}
+	i.digest = peBinary.Hash(crypto.SHA256)
+	i.Digest = hex.EncodeToString(i.digest)
+
+	sigs, err := peBinary.Signatures()
+	if err != nil {
+		return err
+	}
+	for _, sig := range sigs {
+		if sig.CertType != signature.WIN_CERT_TYPE_PKCS_SIGNED_DATA {
+			continue
+		}
+		a, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			return err
+		}
+		for _, cert := range a.Pkcs.Certs {
+			if !a.Pkcs.HasCertificate(cert) {
+				continue
+			}
+			i.Signers = append(i.Signers, cert.Subject.CommonName)
+			if i.Authority == "" {
+				i.Authority, i.Vendor = findAuthority(cert)
+			}
+		}
+	}
+	return nil
+}
+
+// findAuthority returns the vendor certificate which issued cert
+func findAuthority(cert *x509.Certificate) (string, string) {
+	for _, vendor := range certs.GetVendors() {
+		db, err := certs.GetOEMCerts(vendor, "db")
+		if err != nil {
+			continue
+		}
+		for _, l := range *db {
+			for _, sig := range l.Signatures {
+				ca, err := x509.ParseCertificate(sig.Data)
+				if err != nil {
+					continue
+				}
+				if cert.CheckSignatureFrom(ca) == nil || bytes.Equal(cert.Raw, ca.Raw) {
+					return ca.Subject.CommonName, vendor
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// OptionROMLandlockRules allows enabling and reading the expansion ROMs. The
+// device links in pciDevicesDir resolve to /sys/devices, only the rom and class
+// files of the devices are allowed.
+func OptionROMLandlockRules() []landlock.Rule {
+	rules := []landlock.Rule{
+		landlock.RODirs(pciDevicesDir).IgnoreIfMissing(),
+	}
+	devices, _ := filepath.Glob(filepath.Join(pciDevicesDir, "*"))
+	for _, device := range devices {
+		dir, err := filepath.EvalSymlinks(device)
+		if err != nil {
+			continue
+		}
+		rules = append(rules,
+			landlock.RWFiles(filepath.Join(dir, "rom")).IgnoreIfMissing(),
+			landlock.ROFiles(filepath.Join(dir, "class")).IgnoreIfMissing(),
+		)
+	}
+	return rules
+}
+
+// readPCIROM reads the expansion ROM of a PCI device. The ROM needs to be
+// enabled before it can be read.
+func readPCIROM(vfs afero.Fs, path string) ([]byte, error) {
+	f, err := vfs.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("1")); err != nil {
+		return nil, err
+	}
+	defer f.WriteAt([]byte("0"), 0)
+	return io.ReadAll(io.NewSectionReader(f, 0, 1<<24))
+}
+
+func readSysfsString(vfs afero.Fs, path string) string {
+	b, err := afero.ReadFile(vfs, path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(b)), "0x")
+}
+
+// GetOptionROMs reads the option ROMs of all PCI devices with an expansion
+// ROM
+func GetOptionROMs(vfs afero.Fs) ([]*OptionROM, error) {
+	devices, err := afero.ReadDir(vfs, pciDevicesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoOptionROMs
+	} else if err != nil {
+		return nil, err
+	}
+	var roms []*OptionROM
+	for _, device := range devices {
+		dir := filepath.Join(pciDevicesDir, device.Name())
+		path := filepath.Join(dir, "rom")
+		if _, err := vfs.Stat(path); err != nil {
+			continue
+		}
+		b, err := readPCIROM(vfs, path)
+		// Devices without a ROM fail to read
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		images, err := ParseOptionROM(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", device.Name(), err)
+		}
+		roms = append(roms, &OptionROM{
+			Device: device.Name(),
+			Class:  readSysfsString(vfs, filepath.Join(dir, "class")),
+			Images: images,
+		})
+	}
+	if len(roms) == 0 {
+		return nil, ErrNoOptionROMs
+	}
+	return roms, nil
+}
+
+// GetOptionROMChecksums returns the Authenticode hashes of the EFI drivers in
+// the option ROMs of the PCI devices, for enrollment into db
+func GetOptionROMChecksums(vfs afero.Fs) (*signature.SignatureDatabase, error) {
+	roms, err := GetOptionROMs(vfs)
+	if err != nil {
+		return nil, err
+	}
+	sigdb := signature.NewSignatureDatabase()
+	for _, rom := range roms {
+		for _, image := range rom.Images {
+			if !image.EFI() {
+				continue
+			}
+			// The checksum of compressed images can't be calculated
+			if image.Compressed {
+				logging.Warn("%s: skipping the compressed EFI image at offset 0x%x", rom.Device, image.Offset)
+				continue
+			}
+			if sigdb.BytesExists(signature.CERT_SHA256_GUID, pciOpromGUID, image.digest) {
+				continue
+			}
+			if err := sigdb.Append(signature.CERT_SHA256_GUID, pciOpromGUID, image.digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sigdb, nil
+}
@@ -0,0 +1,144 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/spf13/afero"
+)
+
+// romImage builds a PCI expansion ROM image with the PCI data structure at
+// 0x1c, and an EFI image header when pe is set
+func romImage(codeType uint8, pe []byte, compressed, last bool) []byte {
+	const peOffset = 0x40
+	size := (peOffset + len(pe) + romBlockSize - 1) / romBlockSize * romBlockSize
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint16(b[0x00:], romSignature)
+	binary.LittleEndian.PutUint16(b[0x18:], 0x1c)
+	if codeType == romCodeTypeEFI {
+		binary.LittleEndian.PutUint16(b[0x02:], uint16(size/romBlockSize))
+		binary.LittleEndian.PutUint32(b[0x04:], romEFISignature)
+		binary.LittleEndian.PutUint16(b[0x08:], 11)
+		binary.LittleEndian.PutUint16(b[0x0a:], 0x8664)
+		if compressed {
+			binary.LittleEndian.PutUint16(b[0x0c:], 1)
+		}
+		binary.LittleEndian.PutUint16(b[0x16:], peOffset)
+		copy(b[peOffset:], pe)
+	}
+	pcir := b[0x1c:]
+	copy(pcir, "PCIR")
+	binary.LittleEndian.PutUint16(pcir[0x04:], 0x8086)
+	binary.LittleEndian.PutUint16(pcir[0x06:], 0x1533)
+	binary.LittleEndian.PutUint16(pcir[0x10:], uint16(size/romBlockSize))
+	pcir[0x14] = codeType
+	if last {
+		pcir[0x15] = romLastImage
+	}
+	return b
+}
+
+// sysfsROM ignores writes to the rom files, which enable and disable the
+// expansion ROM in sysfs
+type sysfsROM struct{ afero.Fs }
+
+type romFile struct{ afero.File }
+
+func (f romFile) Write(b []byte) (int, error)            { return len(b), nil }
+func (f romFile) WriteAt(b []byte, _ int64) (int, error) { return len(b), nil }
+
+func (s sysfsROM) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := s.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return romFile{f}, nil
+}
+
+func TestOptionROM(t *testing.T) {
+	pe, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rom []byte
+	rom = append(rom, romImage(0x00, nil, false, false)...)
+	rom = append(rom, romImage(romCodeTypeEFI, pe, false, true)...)
+
+	// The firmware loads, and hashes, the image padded to the
+	// initialization size
+	peBinary, err := authenticode.Parse(bytes.NewReader(rom[romBlockSize+0x40:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := peBinary.Hash(crypto.SHA256)
+
+	images, err := ParseOptionROM(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	if images[0].CodeType != "legacy" || images[0].EFI() {
+		t.Fatalf("unexpected legacy image %+v", images[0])
+	}
+	efi := images[1]
+	if !efi.EFI() || efi.Offset != romBlockSize || efi.Machine != "x64" || efi.VendorID != "8086" || efi.DeviceID != "1533" {
+		t.Fatalf("unexpected efi image %+v", efi)
+	}
+	if efi.Digest != hex.EncodeToString(digest) {
+		t.Fatalf("unexpected digest %s, expected %x", efi.Digest, digest)
+	}
+
+	vfs := sysfsROM{afero.NewMemMapFs()}
+	if err := afero.WriteFile(vfs.Fs, pciDevicesDir+"/0000:00:1f.6/rom", rom, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(vfs, pciDevicesDir+"/0000:00:1f.6/class", []byte("0x020000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Devices without a ROM are skipped
+	if err := vfs.MkdirAll(pciDevicesDir+"/0000:00:00.0", 0755); err != nil {
+		t.Fatal(err)
+	}
+	sigdb, err := GetOptionROMChecksums(vfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sigdb.BytesExists(signature.CERT_SHA256_GUID, pciOpromGUID, digest) {
+		t.Fatalf("option rom checksum is missing from the database")
+	}
+
+	compressed := romImage(romCodeTypeEFI, pe, true, true)
+	images, err = ParseOptionROM(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !images[0].Compressed || images[0].Digest != "" {
+		t.Fatalf("compressed image was hashed %+v", images[0])
+	}
+	// Compressed images are skipped, the other images are still enrolled
+	if err := afero.WriteFile(vfs.Fs, pciDevicesDir+"/0000:01:00.0/rom", compressed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sigdb, err = GetOptionROMChecksums(vfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := signatureEntries(sigdb); len(entries) != 1 || !sigdb.BytesExists(signature.CERT_SHA256_GUID, pciOpromGUID, digest) {
+		t.Fatalf("unexpected option rom checksums %v", entries)
+	}
+
+	// An initialization size ending before the EFI image is rejected
+	truncated := romImage(romCodeTypeEFI, pe, false, true)
+	binary.LittleEndian.PutUint16(truncated[0x02:], 0)
+	if _, err := ParseOptionROM(truncated); err == nil {
+		t.Fatalf("truncated image was parsed")
+	}
+}
@@ -0,0 +1,332 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+// OVMF and other EDK2 firmware keep the non-volatile variables in a firmware
+// volume, which is the OVMF_VARS.fd file given to QEMU. The volume starts with
+// a variable store of authenticated variables, followed by the regions used
+// for fault tolerant writes which are left untouched.
+
+var (
+	ErrOVMFVarStore     = errors.New("not an EDK2 variable store")
+	ErrOVMFVarStoreFull = errors.New("variables do not fit into the variable store")
+
+	systemNvDataFvGUID     = *util.StringToGUID("fff12b8d-7696-4c8b-a985-2747075b4f50")
+	authenticatedVarsGUID  = *util.StringToGUID("aaf32c78-947b-439a-a180-2e144ec37792")
+	fvSignature            = [4]byte{'_', 'F', 'V', 'H'}
+	varStoreFormatted      = uint8(0x5a)
+	varStoreHealthy        = uint8(0xfe)
+	varStartID             = uint16(0x55aa)
+	varAdded               = uint8(0x3f)
+	varInDeletedTransition = uint8(0xfe)
+)
+
+type fvHeader struct {
+	ZeroVector      [16]byte
+	FileSystemGUID  util.EFIGUID
+	FvLength        uint64
+	Signature       [4]byte
+	Attributes      uint32
+	HeaderLength    uint16
+	Checksum        uint16
+	ExtHeaderOffset uint16
+	Reserved        uint8
+	Revision        uint8
+}
+
+type varStoreHeader struct {
+	Signature util.EFIGUID
+	Size      uint32
+	Format    uint8
+	State     uint8
+	Reserved  uint16
+	Reserved1 uint32
+}
+
+type authVarHeader struct {
+	StartID        uint16
+	State          uint8
+	Reserved       uint8
+	Attributes     attributes.Attributes
+	MonotonicCount uint64
+	TimeStamp      util.EFITime
+	PubKeyIndex    uint32
+	NameSize       uint32
+	DataSize       uint32
+	VendorGUID     util.EFIGUID
+}
+
+var (
+	sizeofVarStoreHeader = binary.Size(varStoreHeader{})
+	sizeofAuthVarHeader  = binary.Size(authVarHeader{})
+)
+
+type OVMFVariable struct {
+	Name           string
+	GUID           util.EFIGUID
+	Attributes     attributes.Attributes
+	Time           util.EFITime
+	MonotonicCount uint64
+	PubKeyIndex    uint32
+	Data           []byte
+}
+
+func (v *OVMFVariable) name() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, utf16.Encode([]rune(v.Name+"\x00")))
+	return b.Bytes()
+}
+
+// OVMFVarStore is an EDK2 variable store read into memory
+type OVMFVarStore struct {
+	raw        []byte
+	start, end int
+	Variables  []*OVMFVariable
+}
+
+// padding returns the number of bytes needed to align n to 4 bytes
+func padding(n int) int {
+	return (4 - n%4) % 4
+}
+
+func ParseOVMFVarStore(b []byte) (*OVMFVarStore, error) {
+	var fv fvHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &fv); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOVMFVarStore, err)
+	}
+	if fv.Signature != fvSignature || fv.FileSystemGUID != systemNvDataFvGUID {
+		return nil, ErrOVMFVarStore
+	}
+	start := int(fv.HeaderLength)
+	if start+sizeofVarStoreHeader > len(b) {
+		return nil, fmt.Errorf("%w: truncated firmware volume", ErrOVMFVarStore)
+	}
+	var vs varStoreHeader
+	if err := binary.Read(bytes.NewReader(b[start:]), binary.LittleEndian, &vs); err != nil {
+		return nil, err
+	}
+	if vs.Signature != authenticatedVarsGUID {
+		return nil, fmt.Errorf("%w: unsupported variable store %s", ErrOVMFVarStore, vs.Signature.Format())
+	}
+	if vs.Format != varStoreFormatted || vs.State != varStoreHealthy {
+		return nil, fmt.Errorf("%w: variable store is not formatted", ErrOVMFVarStore)
+	}
+	end := start + int(vs.Size)
+	if end > len(b) {
+		return nil, fmt.Errorf("%w: truncated variable store", ErrOVMFVarStore)
+	}
+
+	s := &OVMFVarStore{raw: b, start: start, end: end}
+	off := start + sizeofVarStoreHeader
+	for off+sizeofAuthVarHeader <= end {
+		var h authVarHeader
+		if err := binary.Read(bytes.NewReader(b[off:]), binary.LittleEndian, &h); err != nil {
+			return nil, err
+		}
+		if h.StartID != varStartID {
+			break
+		}
+		name := off + sizeofAuthVarHeader
+		data := name + int(h.NameSize) + padding(int(h.NameSize))
+		next := data + int(h.DataSize) + padding(int(h.DataSize))
+		if int(h.NameSize) > end || int(h.DataSize) > end || next > end {
+			return nil, fmt.Errorf("%w: variable at %#x is truncated", ErrOVMFVarStore, off)
+		}
+		// Variables are deleted by clearing bits of the state
+		if h.State == varAdded || h.State == varAdded&varInDeletedTransition {
+			u := make([]uint16, h.NameSize/2)
+			binary.Read(bytes.NewReader(b[name:name+int(h.NameSize)]), binary.LittleEndian, u)
+			if len(u) > 0 && u[len(u)-1] == 0 {
+				u = u[:len(u)-1]
+			}
+			s.SetVariable(&OVMFVariable{
+				Name:           string(utf16.Decode(u)),
+				GUID:           h.VendorGUID,
+				Attributes:     h.Attributes,
+				Time:           h.TimeStamp,
+				MonotonicCount: h.MonotonicCount,
+				PubKeyIndex:    h.PubKeyIndex,
+				Data:           bytes.Clone(b[data : data+int(h.DataSize)]),
+			})
+		}
+		off = next
+	}
+	return s, nil
+}
+
+func ReadOVMFVarStore(vfs afero.Fs, path string) (*OVMFVarStore, error) {
+	b, err := fs.ReadFile(vfs, path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseOVMFVarStore(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Bytes returns the firmware volume with the variables written to the store.
+// Deleted variables are removed.
+func (s *OVMFVarStore) Bytes() ([]byte, error) {
+	b := bytes.Clone(s.raw)
+	store := b[s.start+sizeofVarStoreHeader : s.end]
+	for i := range store {
+		store[i] = 0xff
+	}
+	off := 0
+	for _, v := range s.Variables {
+		name := v.name()
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, authVarHeader{
+			StartID:        varStartID,
+			State:          varAdded,
+			Attributes:     v.Attributes,
+			MonotonicCount: v.MonotonicCount,
+			TimeStamp:      v.Time,
+			PubKeyIndex:    v.PubKeyIndex,
+			NameSize:       uint32(len(name)),
+			DataSize:       uint32(len(v.Data)),
+			VendorGUID:     v.GUID,
+		})
+		buf.Write(name)
+		buf.Write(bytes.Repeat([]byte{0xff}, padding(len(name))))
+		buf.Write(v.Data)
+		buf.Write(bytes.Repeat([]byte{0xff}, padding(len(v.Data))))
+		if off+buf.Len() > len(store) {
+			return nil, ErrOVMFVarStoreFull
+		}
+		off += copy(store[off:], buf.Bytes())
+	}
+	return b, nil
+}
+
+// WriteFile replaces the variable store file
+func (s *OVMFVarStore) WriteFile(vfs afero.Fs, path string) error {
+	b, err := s.Bytes()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := fs.WriteFile(vfs, tmp, b, 0o644); err != nil {
+		return err
+	}
+	return vfs.Rename(tmp, path)
+}
+
+func (s *OVMFVarStore) Variable(name string, guid util.EFIGUID) *OVMFVariable {
+	for _, v := range s.Variables {
+		if v.Name == name && v.GUID == guid {
+			return v
+		}
+	}
+	return nil
+}
+
+// SetVariable adds the variable, or replaces the variable with the same name
+func (s *OVMFVarStore) SetVariable(v *OVMFVariable) {
+	for i, o := range s.Variables {
+		if o.Name == v.Name && o.GUID == v.GUID {
+			s.Variables[i] = v
+			return
+		}
+	}
+	s.Variables = append(s.Variables, v)
+}
+
+func (s *OVMFVarStore) DeleteVariable(name string, guid util.EFIGUID) {
+	for i, v := range s.Variables {
+		if v.Name == name && v.GUID == guid {
+			s.Variables = append(s.Variables[:i], s.Variables[i+1:]...)
+			return
+		}
+	}
+}
+
+// Efivarfs returns the variable store as efivarfs. Writes change the store in
+// memory the way the firmware would, without verifying the signatures. The
+// store is in Setup Mode until a PK is written.
+func (s *OVMFVarStore) Efivarfs() *efivarfs.Efivarfs {
+	return efivarfs.Open(&ovmfEfivars{s})
+}
+
+type ovmfEfivars struct {
+	store *OVMFVarStore
+}
+
+func (o *ovmfEfivars) GetVar(e efivar.Efivar, u efivar.Unmarshallable) error {
+	_, err := o.GetVarWithAttributes(e, u)
+	return err
+}
+
+func (o *ovmfEfivars) GetVarWithAttributes(e efivar.Efivar, u efivar.Unmarshallable) (attributes.Attributes, error) {
+	if varPath(e) == varPath(efivar.SetupMode) {
+		setupMode := byte(1)
+		if pk := o.store.Variable(efivar.PK.Name, *efivar.PK.GUID); pk != nil && len(pk.Data) > 0 {
+			setupMode = 0
+		}
+		return e.Attributes, u.Unmarshal(bytes.NewBuffer([]byte{setupMode}))
+	}
+	v := o.store.Variable(e.Name, *e.GUID)
+	if v == nil {
+		return 0, &os.PathError{Op: "open", Path: varPath(e), Err: os.ErrNotExist}
+	}
+	if !e.Attributes.Equal(v.Attributes) {
+		return v.Attributes, efivarfs.ErrIncorrectAttributes
+	}
+	return v.Attributes, u.Unmarshal(bytes.NewBuffer(bytes.Clone(v.Data)))
+}
+
+func (o *ovmfEfivars) GetVarTimestamp(e efivar.Efivar) (util.EFITime, error) {
+	v := o.store.Variable(e.Name, *e.GUID)
+	if v == nil {
+		return util.EFITime{}, &os.PathError{Op: "open", Path: varPath(e), Err: os.ErrNotExist}
+	}
+	return v.Time, nil
+}
+
+func (o *ovmfEfivars) WriteVar(e efivar.Efivar, m efivar.Marshallable) error {
+	var b bytes.Buffer
+	m.Marshal(&b)
+	data, t := authenticatedData(e, b.Bytes())
+	old := o.store.Variable(e.Name, *e.GUID)
+	if e.Attributes&attributes.EFI_VARIABLE_APPEND_WRITE != 0 {
+		if old != nil {
+			data = append(bytes.Clone(old.Data), data...)
+			// Appending keeps the later of the two timestamps
+			if CompareEFITime(old.Time, t) > 0 {
+				t = old.Time
+			}
+		}
+	} else if old != nil && e.Attributes&attributes.EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS != 0 && CompareEFITime(t, old.Time) <= 0 {
+		// The firmware rejects updates which are not newer than the variable
+		return &os.PathError{Op: "write", Path: varPath(e), Err: syscall.EACCES}
+	}
+	if len(data) == 0 {
+		o.store.DeleteVariable(e.Name, *e.GUID)
+		return nil
+	}
+	o.store.SetVariable(&OVMFVariable{
+		Name:       e.Name,
+		GUID:       *e.GUID,
+		Attributes: e.Attributes &^ attributes.EFI_VARIABLE_APPEND_WRITE,
+		Time:       t,
+		Data:       data,
+	})
+	return nil
+}
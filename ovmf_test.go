@@ -0,0 +1,128 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+// newOVMFVars returns an empty firmware volume with a variable store of size
+func newOVMFVars(size int) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, fvHeader{
+		FileSystemGUID: systemNvDataFvGUID,
+		FvLength:       uint64(0x48 + size + 0x1000),
+		Signature:      fvSignature,
+		HeaderLength:   0x48,
+		Revision:       2,
+	})
+	// Block map
+	binary.Write(&b, binary.LittleEndian, []uint32{uint32(0x48+size+0x1000) / 0x1000, 0x1000, 0, 0})
+	binary.Write(&b, binary.LittleEndian, varStoreHeader{
+		Signature: authenticatedVarsGUID,
+		Size:      uint32(size),
+		Format:    varStoreFormatted,
+		State:     varStoreHealthy,
+	})
+	b.Write(bytes.Repeat([]byte{0xff}, size-sizeofVarStoreHeader))
+	// Fault tolerant write regions
+	b.Write(bytes.Repeat([]byte{0xaa}, 0x1000))
+	return b.Bytes()
+}
+
+func TestOVMFVarStore(t *testing.T) {
+	if _, err := ParseOVMFVarStore(make([]byte, 4096)); !errors.Is(err, ErrOVMFVarStore) {
+		t.Fatalf("parsed an invalid variable store: %v", err)
+	}
+
+	raw := newOVMFVars(0x4000)
+	store, err := ParseOVMFVarStore(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	efivars := store.Efivarfs()
+	if ok, err := efivars.GetSetupMode(); err != nil || !ok {
+		t.Fatalf("empty variable store is not in setup mode: %v", err)
+	}
+
+	state := &config.State{Fs: afero.NewMemMapFs(), Config: config.DefaultConfig()}
+	kh, err := backend.CreateKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	efistate := NewEFIVariables(efivars)
+	for _, e := range []struct {
+		sigdb *signature.SignatureDatabase
+		cert  []byte
+	}{
+		{efistate.PK, kh.PK.CertificateBytes()},
+		{efistate.KEK, kh.KEK.CertificateBytes()},
+		{efistate.Db, kh.Db.CertificateBytes()},
+	} {
+		if err := e.sigdb.Append(signature.CERT_X509_GUID, eventlogGUID, e.cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := efistate.Dbx.Append(signature.CERT_SHA256_GUID, eventlogGUID, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := efistate.EnrollAllKeys(kh); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := store.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != len(raw) || !bytes.Equal(b[len(b)-0x1000:], raw[len(raw)-0x1000:]) {
+		t.Fatal("regions outside of the variable store were changed")
+	}
+	store, err = ParseOVMFVarStore(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Variables) != 4 {
+		t.Fatalf("expected 4 variables, got %d", len(store.Variables))
+	}
+	efivars = store.Efivarfs()
+	if ok, err := efivars.GetSetupMode(); err != nil || ok {
+		t.Fatalf("variable store with a PK is in setup mode: %v", err)
+	}
+	for name, get := range map[string]func() (*signature.SignatureDatabase, error){
+		"PK": efivars.GetPK, "KEK": efivars.GetKEK, "db": efivars.Getdb, "dbx": efivars.Getdbx,
+	} {
+		sigdb, err := get()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(signatureEntries(sigdb)) != 1 {
+			t.Fatalf("%s: expected one signature: %+v", name, sigdb)
+		}
+	}
+	if pk := store.Variable("PK", *efivar.PK.GUID); pk == nil || pk.Time.Year < 2000 {
+		t.Fatalf("PK was written without the time of the update: %+v", pk)
+	}
+
+	// Deleted variables are skipped
+	b[0x48+sizeofVarStoreHeader+2] = varAdded & 0xfd
+	if store, err = ParseOVMFVarStore(b); err != nil || len(store.Variables) != 3 {
+		t.Fatalf("deleted variable was read: %v", err)
+	}
+
+	full, err := ParseOVMFVarStore(newOVMFVars(0x400))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.SetVariable(store.Variable("PK", *efivar.PK.GUID))
+	full.SetVariable(store.Variable("KEK", *efivar.KEK.GUID))
+	if _, err := full.Bytes(); !errors.Is(err, ErrOVMFVarStoreFull) {
+		t.Fatalf("variables larger than the variable store were written: %v", err)
+	}
+}
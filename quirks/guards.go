@@ -0,0 +1,123 @@
+package quirks
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Operations which are guarded by quirks
+const (
+	OpEnrollKeys = "enroll-keys"
+	OpReset      = "reset"
+	OpRotateKeys = "rotate-keys"
+)
+
+// Guard actions
+const (
+	// GuardConfirm requires the quirk to be accepted explicitly
+	GuardConfirm = "confirm"
+	// GuardRefuse refuses the operation unless it is forced
+	GuardRefuse = "refuse"
+	// GuardKeepMicrosoftKeys keeps the Microsoft keys in KEK and db, e.g. for
+	// boards which need them for the option ROM of the GPU
+	GuardKeepMicrosoftKeys = "keep_microsoft_keys"
+)
+
+// Decisions taken by a guard
+const (
+	DecisionAllowed  = "allowed"
+	DecisionAdjusted = "adjusted"
+	DecisionRefused  = "refused"
+)
+
+var ErrRefused = errors.New("refused because of firmware quirks")
+
+// Guard restricts operations on systems affected by a quirk
+type Guard struct {
+	Operations []string `json:"operations"`
+	Action     string   `json:"action"`
+	Message    string   `json:"message,omitempty"`
+}
+
+func (g Guard) validate() error {
+	switch g.Action {
+	case GuardConfirm, GuardRefuse, GuardKeepMicrosoftKeys:
+	default:
+		return fmt.Errorf("unknown guard action %q", g.Action)
+	}
+	for _, op := range g.Operations {
+		switch op {
+		case OpEnrollKeys, OpReset, OpRotateKeys:
+		default:
+			return fmt.Errorf("unknown guarded operation %q", op)
+		}
+	}
+	return nil
+}
+
+type Decision struct {
+	Quirk     string `json:"quirk"`
+	Operation string `json:"operation"`
+	Action    string `json:"action"`
+	Decision  string `json:"decision"`
+	Reason    string `json:"reason"`
+}
+
+// Operation describes what a command is about to do
+type Operation struct {
+	Name string
+	// RemovesMicrosoftKeys is set when the Microsoft keys are not kept in KEK
+	// and db
+	RemovesMicrosoftKeys bool
+	// KeepMicrosoftKeys changes the operation to keep the Microsoft keys. When
+	// nil the operation is refused instead.
+	KeepMicrosoftKeys func()
+	// Accepted are the IDs of the quirks the user has accepted
+	Accepted []string
+	// Force allows the operation regardless of any quirk
+	Force bool
+}
+
+// Check decides on the operation for every guard of the quirks. An error
+// wrapping ErrRefused is returned when any guard refuses the operation.
+func (op *Operation) Check(quirks []Quirk) ([]Decision, error) {
+	decisions := []Decision{}
+	var refused []string
+	for _, q := range quirks {
+		for _, g := range q.Guards {
+			if !slices.Contains(g.Operations, op.Name) {
+				continue
+			}
+			if g.Action == GuardKeepMicrosoftKeys && !op.RemovesMicrosoftKeys {
+				continue
+			}
+			d := Decision{Quirk: q.ID, Operation: op.Name, Action: g.Action, Reason: g.Message}
+			if d.Reason == "" {
+				d.Reason = q.Name
+			}
+			switch {
+			case op.Force:
+				d.Decision = DecisionAllowed
+				d.Reason = "forced: " + d.Reason
+			case slices.Contains(op.Accepted, q.ID):
+				d.Decision = DecisionAllowed
+				d.Reason = "accepted: " + d.Reason
+			case g.Action == GuardKeepMicrosoftKeys && op.KeepMicrosoftKeys != nil:
+				op.KeepMicrosoftKeys()
+				op.RemovesMicrosoftKeys = false
+				d.Decision = DecisionAdjusted
+				d.Reason = "keeping the Microsoft keys: " + d.Reason
+			default:
+				d.Decision = DecisionRefused
+				refused = append(refused, q.ID)
+			}
+			decisions = append(decisions, d)
+		}
+	}
+	if len(refused) > 0 {
+		return decisions, fmt.Errorf("%s %w %s", op.Name, ErrRefused, strings.Join(slices.Compact(refused), ", "))
+	}
+	return decisions, nil
+}
@@ -1,81 +1,279 @@
 package quirks
 
 import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/dmi"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+// The quirks shipped with sbctl. Definitions in Dirs replace these when they
+// have the same ID and a revision at least as high.
+//
+//go:embed data/*
+var content embed.FS
+
+var (
+	// Dirs are read in order for additional quirk definitions
+	Dirs = []string{
+		"/usr/share/sbctl/quirks",
+		"/etc/sbctl/quirks",
+	}
+
+	// The highest definition format version we understand
+	FormatVersion = 1
+
+	ErrUnsupportedVersion = errors.New("unsupported quirk format version")
 )
 
 type Quirk struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Link     string `json:"link"`
-	Severity string `json:"severity"`
-	Method   string `json:"method"`
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Link        string  `json:"link"`
+	Severity    string  `json:"severity"`
+	Remediation string  `json:"remediation,omitempty"`
+	Method      string  `json:"method"`
+	Guards      []Guard `json:"guards,omitempty"`
 }
 
-type affectedDevice struct {
-	Name       string
-	NameSrc    *string
-	NameStrict bool
-	DateFrom   time.Time
-	DateTo     time.Time
+// Definition is a quirk as written in a YAML or JSON data file. A system is
+// affected when it matches Match, none of the Unaffected rules and one of the
+// Affected rules. The method of the first matching Affected rule is reported.
+type Definition struct {
+	Version     int     `json:"version"`
+	ID          string  `json:"id"`
+	Revision    int     `json:"revision"`
+	Name        string  `json:"name"`
+	Link        string  `json:"link,omitempty"`
+	Severity    string  `json:"severity"`
+	Remediation string  `json:"remediation,omitempty"`
+	Match       Rule    `json:"match"`
+	Unaffected  []Rule  `json:"unaffected,omitempty"`
+	Affected    []Rule  `json:"affected,omitempty"`
+	Guards      []Guard `json:"guards,omitempty"`
 }
 
-type unaffectedVersion struct {
-	Name       string
-	NameSrc    *string
-	NameStrict bool
-	Version    string
-	VersionSrc *string
+// Rule matches when all the given fields and the firmware date match. Fields
+// are keyed by the JSON names of dmi.DMI.
+type Rule struct {
+	Method       string                 `json:"method,omitempty"`
+	Fields       map[string]StringMatch `json:"fields,omitempty"`
+	FirmwareDate *DateRange             `json:"firmware_date,omitempty"`
 }
 
-type affectedDateRange struct {
-	From time.Time
-	To   time.Time
+// StringMatch matches a value equal to one of Equals, or containing one of
+// Contains. A plain string or list in the data file is read as Equals.
+type StringMatch struct {
+	Equals   []string `json:"equals,omitempty"`
+	Contains []string `json:"contains,omitempty"`
 }
 
-func isUnaffectedVersion(list []unaffectedVersion) bool {
-	for _, item := range list {
-		if (item.NameStrict && item.Name == *item.NameSrc || !item.NameStrict && strings.Contains(*item.NameSrc, item.Name)) &&
-			item.Version == *item.VersionSrc {
+func (s *StringMatch) UnmarshalYAML(b []byte) error {
+	var value string
+	if err := yaml.Unmarshal(b, &value); err == nil {
+		s.Equals = []string{value}
+		return nil
+	}
+	var values []string
+	if err := yaml.Unmarshal(b, &values); err == nil {
+		s.Equals = values
+		return nil
+	}
+	type stringMatch StringMatch
+	return yaml.Unmarshal(b, (*stringMatch)(s))
+}
+
+func (s StringMatch) Matches(value string) bool {
+	if slices.Contains(s.Equals, value) {
+		return true
+	}
+	for _, c := range s.Contains {
+		if strings.Contains(value, c) {
 			return true
 		}
 	}
 	return false
 }
 
-func isAffectedDate(list []affectedDateRange) bool {
-	for _, item := range list {
-		if (item.From.IsZero() || !dmi.Table.FirmwareDate.Before(item.From)) && (item.To.IsZero() || !dmi.Table.FirmwareDate.After(item.To)) {
-			return true
+// Date is a day written as YYYY-MM-DD
+type Date struct {
+	time.Time
+}
+
+func (d *Date) UnmarshalYAML(b []byte) error {
+	var s string
+	if err := yaml.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return err
+	}
+	d.Time = t
+	return nil
+}
+
+// DateRange is inclusive, and open when either end is unset
+type DateRange struct {
+	From Date `json:"from,omitempty"`
+	To   Date `json:"to,omitempty"`
+}
+
+func (r DateRange) Contains(t time.Time) bool {
+	return (r.From.IsZero() || !t.Before(r.From.Time)) && (r.To.IsZero() || !t.After(r.To.Time))
+}
+
+func (r Rule) Matches(table dmi.DMI) bool {
+	for name, m := range r.Fields {
+		value, ok := table.Field(name)
+		if !ok || !m.Matches(value) {
+			return false
 		}
 	}
-	return false
+	if r.FirmwareDate != nil && !r.FirmwareDate.Contains(table.FirmwareDate) {
+		return false
+	}
+	return true
 }
 
-func isAffectedDevice(list []affectedDevice) bool {
-	for _, item := range list {
-		if (item.NameStrict && item.Name == *item.NameSrc || !item.NameStrict && strings.Contains(*item.NameSrc, item.Name)) &&
-			(item.DateFrom.IsZero() || !dmi.Table.FirmwareDate.Before(item.DateFrom)) && (item.DateTo.IsZero() || !dmi.Table.FirmwareDate.After(item.DateTo)) {
-			return true
+// Evaluate returns the quirk when the system described by table is affected
+func (d *Definition) Evaluate(table dmi.DMI) (Quirk, bool) {
+	quirk := Quirk{
+		ID:          d.ID,
+		Name:        d.Name,
+		Link:        d.Link,
+		Severity:    d.Severity,
+		Remediation: strings.TrimSpace(d.Remediation),
+		Guards:      d.Guards,
+	}
+	if quirk.Link == "" {
+		quirk.Link = "https://github.com/Foxboron/sbctl/wiki/" + d.ID
+	}
+	if !d.Match.Matches(table) {
+		return quirk, false
+	}
+	for _, r := range d.Unaffected {
+		if r.Matches(table) {
+			return quirk, false
 		}
 	}
+	if len(d.Affected) == 0 {
+		return quirk, true
+	}
+	for _, r := range d.Affected {
+		if r.Matches(table) {
+			quirk.Method = r.Method
+			return quirk, true
+		}
+	}
+	return quirk, false
+}
+
+// ParseDefinition parses a quirk definition in YAML or JSON
+func ParseDefinition(b []byte) (*Definition, error) {
+	var d Definition
+	if err := yaml.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	if d.Version < 1 || d.Version > FormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, d.Version)
+	}
+	if d.ID == "" {
+		return nil, errors.New("missing quirk id")
+	}
+	for _, r := range slices.Concat([]Rule{d.Match}, d.Unaffected, d.Affected) {
+		for name := range r.Fields {
+			if _, ok := (dmi.DMI{}).Field(name); !ok {
+				return nil, fmt.Errorf("unknown DMI field %q", name)
+			}
+		}
+	}
+	for _, g := range d.Guards {
+		if err := g.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &d, nil
+}
+
+func isDefinitionFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
 	return false
 }
 
+// LoadDefinitions reads the shipped quirks and the ones found in Dirs. Invalid
+// files are skipped with a warning.
+func LoadDefinitions(vfs afero.Fs) []*Definition {
+	var defs []*Definition
+	add := func(path string, b []byte) {
+		d, err := ParseDefinition(b)
+		if err != nil {
+			logging.Warn("Ignoring quirk definition %s: %v", path, err)
+			return
+		}
+		idx := slices.IndexFunc(defs, func(def *Definition) bool { return def.ID == d.ID })
+		switch {
+		case idx == -1:
+			defs = append(defs, d)
+		case d.Revision >= defs[idx].Revision:
+			defs[idx] = d
+		}
+	}
+
+	files, _ := fs.ReadDir(content, "data")
+	for _, f := range files {
+		b, err := content.ReadFile(filepath.Join("data", f.Name()))
+		if err != nil {
+			continue
+		}
+		add(f.Name(), b)
+	}
+	for _, dir := range Dirs {
+		files, err := afero.ReadDir(vfs, dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() || !isDefinitionFile(f.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			b, err := afero.ReadFile(vfs, path)
+			if err != nil {
+				logging.Warn("Ignoring quirk definition %s: %v", path, err)
+				continue
+			}
+			add(path, b)
+		}
+	}
+	slices.SortFunc(defs, func(a, b *Definition) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return defs
+}
+
 func CheckFirmwareQuirks(state *config.State) []Quirk {
 	dmi.Table = dmi.ParseDMI(state)
 	quirks := []Quirk{}
 
-	if HasFQ0001() {
-		quirks = append(quirks, FQ0001)
-	}
-
-	for i := range quirks {
-		quirks[i].Link = "https://github.com/Foxboron/sbctl/wiki/" + quirks[i].ID
+	for _, d := range LoadDefinitions(state.Fs) {
+		if quirk, ok := d.Evaluate(dmi.Table); ok {
+			quirks = append(quirks, quirk)
+		}
 	}
 
 	return quirks
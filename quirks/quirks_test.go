@@ -0,0 +1,77 @@
+package quirks
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxboron/sbctl/dmi"
+	"github.com/spf13/afero"
+)
+
+func TestLoadDefinitions(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for f, data := range map[string]string{
+		// Replaces the shipped FQ0001
+		"/etc/sbctl/quirks/FQ0001.json": `{"version": 1, "id": "FQ0001", "revision": 2, "name": "Test",
+			"match": {"fields": {"board_vendor": "Vendor"}},
+			"affected": [{"method": "version", "fields": {"firmware_version": ["1.0", "1.1"]}, "firmware_date": {"to": "2024-01-01"}}]}`,
+		"/etc/sbctl/quirks/FQ9999.yaml": "version: 2\nid: FQ9999\n",
+		"/etc/sbctl/quirks/README":      "not a quirk",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defs := LoadDefinitions(vfs)
+	if len(defs) != 1 || defs[0].Name != "Test" {
+		t.Fatalf("unexpected definitions %+v", defs)
+	}
+
+	table := dmi.DMI{BoardVendor: "Vendor", FirmwareVersion: "1.1", FirmwareDate: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	quirk, ok := defs[0].Evaluate(table)
+	if !ok || quirk.Method != "version" || quirk.Link != "https://github.com/Foxboron/sbctl/wiki/FQ0001" {
+		t.Fatalf("unexpected quirk %+v", quirk)
+	}
+	table.FirmwareDate = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	if _, ok := defs[0].Evaluate(table); ok {
+		t.Fatalf("quirk matched outside of the date range")
+	}
+}
+
+func TestOperationCheck(t *testing.T) {
+	quirks := []Quirk{
+		{ID: "FQ0001", Guards: []Guard{{Operations: []string{OpEnrollKeys}, Action: GuardConfirm}}},
+		{ID: "FQ0002", Guards: []Guard{{Operations: []string{OpEnrollKeys, OpReset}, Action: GuardKeepMicrosoftKeys}}},
+	}
+
+	op := &Operation{Name: OpEnrollKeys, RemovesMicrosoftKeys: true}
+	decisions, err := op.Check(quirks)
+	if !errors.Is(err, ErrRefused) {
+		t.Fatalf("expected the operation to be refused: %v", err)
+	}
+	if len(decisions) != 2 || decisions[0].Decision != DecisionRefused || decisions[1].Decision != DecisionRefused {
+		t.Fatalf("unexpected decisions %+v", decisions)
+	}
+
+	kept := false
+	op = &Operation{
+		Name:                 OpEnrollKeys,
+		RemovesMicrosoftKeys: true,
+		KeepMicrosoftKeys:    func() { kept = true },
+		Accepted:             []string{"FQ0001"},
+	}
+	decisions, err = op.Check(quirks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kept || decisions[0].Decision != DecisionAllowed || decisions[1].Decision != DecisionAdjusted {
+		t.Fatalf("unexpected decisions %+v", decisions)
+	}
+
+	op = &Operation{Name: OpRotateKeys}
+	if decisions, err := op.Check(quirks); err != nil || len(decisions) != 0 {
+		t.Fatalf("unexpected decisions %+v: %v", decisions, err)
+	}
+}
@@ -0,0 +1,284 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+)
+
+// Replicas are copies of the primary ESP on other disks, like in RAID1
+// setups. Files written to the primary ESP are mirrored to all replicas.
+type Replicas struct {
+	Primary  string
+	Replicas []string
+}
+
+// Divergence kinds of a replica
+const (
+	ReplicaMissing = "missing"
+	ReplicaDiffers = "differs"
+	ReplicaExtra   = "extra"
+)
+
+type ReplicaDivergence struct {
+	File    string `json:"file"`
+	Replica string `json:"replica"`
+	Kind    string `json:"kind"`
+}
+
+// FindReplicas returns the replicas when more than one ESP is listed in the
+// configuration file. Discovered ESPs are never mirrored. A nil *Replicas is
+// valid and mirrors nothing.
+func FindReplicas(state *config.State) (*Replicas, error) {
+	if len(state.Config.ESP) < 2 {
+		return nil, nil
+	}
+	parts, err := FindBootPartitions(state)
+	if err != nil {
+		return nil, err
+	}
+	// The environment overrides the configured ESPs
+	if parts.Primary().Source != SourceConfig {
+		return nil, nil
+	}
+	r := &Replicas{Primary: parts.Primary().Mountpoint}
+	for _, p := range parts.ESP[1:] {
+		r.Replicas = append(r.Replicas, p.Mountpoint)
+	}
+	return r, nil
+}
+
+// Paths returns the paths of file in all replicas, or nothing if the file is
+// not located in the primary ESP
+func (r *Replicas) Paths(file string) []string {
+	if r == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(r.Primary, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil
+	}
+	var paths []string
+	for _, replica := range r.Replicas {
+		paths = append(paths, filepath.Join(replica, rel))
+	}
+	return paths
+}
+
+// LandlockRules returns the rules needed to write to the replicas
+func (r *Replicas) LandlockRules() []landlock.Rule {
+	if r == nil {
+		return nil
+	}
+	return []landlock.Rule{landlock.RWDirs(r.Replicas...).IgnoreIfMissing()}
+}
+
+func checksumFile(vfs afero.Fs, file string) ([]byte, error) {
+	f, err := vfs.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sameFile reports whether both files exist and have the same content
+func sameFile(vfs afero.Fs, a, b string) (bool, error) {
+	ha, err := checksumFile(vfs, a)
+	if err != nil {
+		return false, err
+	}
+	hb, err := checksumFile(vfs, b)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ha, hb), nil
+}
+
+// Mirror copies file from the primary ESP to all replicas where it differs.
+// The copies are moved into place so a replica never holds a partial file.
+// The written paths are returned.
+func (r *Replicas) Mirror(vfs afero.Fs, file string) ([]string, error) {
+	var written []string
+	for _, dst := range r.Paths(file) {
+		if ok, err := sameFile(vfs, file, dst); err != nil {
+			return written, err
+		} else if ok {
+			continue
+		}
+		if err := vfs.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return written, err
+		}
+		tmp, err := afero.TempFile(vfs, filepath.Dir(dst), "."+filepath.Base(dst)+"-")
+		if err != nil {
+			return written, err
+		}
+		tmp.Close()
+		if err := CopyFile(vfs, file, tmp.Name()); err != nil {
+			vfs.Remove(tmp.Name())
+			return written, fmt.Errorf("failed mirroring %s: %w", file, err)
+		}
+		if err := vfs.Rename(tmp.Name(), dst); err != nil {
+			vfs.Remove(tmp.Name())
+			return written, fmt.Errorf("failed mirroring %s: %w", file, err)
+		}
+		written = append(written, dst)
+	}
+	return written, nil
+}
+
+// Remove removes the copies of file from all replicas
+func (r *Replicas) Remove(vfs afero.Fs, file string) error {
+	for _, dst := range r.Paths(file) {
+		if err := vfs.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveBundle removes an output of a bundle from all replicas, and its boot
+// entries when the bundle writes them
+func (r *Replicas) RemoveBundle(vfs afero.Fs, b *Bundle, output string) error {
+	for i, dst := range r.Paths(output) {
+		if err := vfs.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if !b.BootEntry {
+			continue
+		}
+		if err := RemoveBootEntry(vfs, r.Replicas[i], dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MirrorBundle mirrors a generated bundle, its fallback copy and its boot
+// entry. Copies with a different boot counter are removed from the replicas.
+func (r *Replicas) MirrorBundle(vfs afero.Fs, b *Bundle, entry *BootEntry) ([]string, error) {
+	if r == nil {
+		return nil, nil
+	}
+	files := []string{b.InstallPath()}
+	if b.KeepPrevious {
+		files = append(files, b.PreviousPath())
+	}
+	if entry != nil {
+		files = append(files, entry.Path, filepath.Join(r.Primary, loaderConf))
+	}
+
+	// Remove the copies with a boot counter which was replaced
+	installs := r.Paths(b.InstallPath())
+	for i, output := range r.Paths(b.Output) {
+		installed, err := installedBundles(vfs, output)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range installed {
+			if f == installs[i] {
+				continue
+			}
+			if err := vfs.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		if entry == nil {
+			continue
+		}
+		if entries := r.Paths(entry.Path); len(entries) > 0 {
+			if err := removeBootEntries(vfs, r.Replicas[i], b.Output, entries[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var written []string
+	for _, f := range files {
+		if ok, _ := afero.Exists(vfs, f); !ok {
+			continue
+		}
+		w, err := r.Mirror(vfs, f)
+		written = append(written, w...)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func walkFiles(vfs afero.Fs, root string) (map[string]bool, error) {
+	files := map[string]bool{}
+	err := afero.Walk(vfs, root, func(path string, info os.FileInfo, err error) error {
+		// A missing replica has all files missing
+		if errors.Is(err, os.ErrNotExist) && path == root {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = true
+		return nil
+	})
+	return files, err
+}
+
+// Compare compares the content of all replicas with the primary ESP
+func (r *Replicas) Compare(vfs afero.Fs) ([]ReplicaDivergence, error) {
+	if r == nil {
+		return nil, nil
+	}
+	primary, err := walkFiles(vfs, r.Primary)
+	if err != nil {
+		return nil, err
+	}
+	var divergences []ReplicaDivergence
+	for _, replica := range r.Replicas {
+		files, err := walkFiles(vfs, replica)
+		if err != nil {
+			return nil, err
+		}
+		for rel := range primary {
+			dst := filepath.Join(replica, rel)
+			switch ok, err := sameFile(vfs, filepath.Join(r.Primary, rel), dst); {
+			case err != nil:
+				return nil, err
+			case !files[rel]:
+				divergences = append(divergences, ReplicaDivergence{File: dst, Replica: replica, Kind: ReplicaMissing})
+			case !ok:
+				divergences = append(divergences, ReplicaDivergence{File: dst, Replica: replica, Kind: ReplicaDiffers})
+			}
+		}
+		for rel := range files {
+			if !primary[rel] {
+				divergences = append(divergences, ReplicaDivergence{File: filepath.Join(replica, rel), Replica: replica, Kind: ReplicaExtra})
+			}
+		}
+	}
+	slices.SortFunc(divergences, func(a, b ReplicaDivergence) int {
+		return strings.Compare(a.File, b.File)
+	})
+	return divergences, nil
+}
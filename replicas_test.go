@@ -0,0 +1,82 @@
+package sbctl
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestReplicas(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for f, data := range map[string]string{
+		"/efi/EFI/BOOT/BOOTX64.EFI":       "signed",
+		"/efi/EFI/Linux/arch.efi":         "bundle",
+		"/efi2/EFI/Linux/arch.efi":        "old bundle",
+		"/efi2/EFI/Linux/arch+2-1.efi":    "counted bundle",
+		"/efi2/loader/entries/arch.conf":  "entry",
+		"/efi2/EFI/systemd/systemd-x.efi": "extra",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &Replicas{Primary: "/efi", Replicas: []string{"/efi2"}}
+
+	if paths := r.Paths("/boot/vmlinuz-linux"); len(paths) != 0 {
+		t.Fatalf("file outside the ESP has replicas: %v", paths)
+	}
+
+	written, err := r.Mirror(vfs, "/efi/EFI/BOOT/BOOTX64.EFI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(written, []string{"/efi2/EFI/BOOT/BOOTX64.EFI"}) {
+		t.Fatalf("unexpected mirrored files %v", written)
+	}
+	if written, _ := r.Mirror(vfs, "/efi/EFI/BOOT/BOOTX64.EFI"); len(written) != 0 {
+		t.Fatalf("identical file was mirrored again")
+	}
+
+	divergences, err := r.Compare(vfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReplicaDivergence{
+		{File: "/efi2/EFI/Linux/arch+2-1.efi", Replica: "/efi2", Kind: ReplicaExtra},
+		{File: "/efi2/EFI/Linux/arch.efi", Replica: "/efi2", Kind: ReplicaDiffers},
+		{File: "/efi2/EFI/systemd/systemd-x.efi", Replica: "/efi2", Kind: ReplicaExtra},
+		{File: "/efi2/loader/entries/arch.conf", Replica: "/efi2", Kind: ReplicaExtra},
+	}
+	if !slices.Equal(divergences, want) {
+		t.Fatalf("unexpected divergences %v", divergences)
+	}
+
+	bundle := &Bundle{Output: "/efi/EFI/Linux/arch.efi", ESP: "/efi"}
+	if _, err := r.MirrorBundle(vfs, bundle, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := afero.Exists(vfs, "/efi2/EFI/Linux/arch+2-1.efi"); ok {
+		t.Fatalf("bundle with a boot counter was not removed from the replica")
+	}
+	if b, _ := afero.ReadFile(vfs, "/efi2/EFI/Linux/arch.efi"); string(b) != "bundle" {
+		t.Fatalf("bundle was not mirrored: %s", b)
+	}
+
+	// Boot entries are only removed for bundles writing them
+	if err := r.RemoveBundle(vfs, bundle, bundle.Output); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := afero.Exists(vfs, "/efi2/loader/entries/arch.conf"); !ok {
+		t.Fatalf("boot entry of a bundle without boot entries was removed")
+	}
+	bundle.BootEntry = true
+	if err := r.RemoveBundle(vfs, bundle, bundle.Output); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"/efi2/EFI/Linux/arch.efi", "/efi2/loader/entries/arch.conf"} {
+		if ok, _ := afero.Exists(vfs, f); ok {
+			t.Fatalf("%s was not removed from the replica", f)
+		}
+	}
+}
@@ -1,14 +1,11 @@
 package sbctl
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"slices"
 
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
@@ -25,107 +22,6 @@ var (
 
 // Functions that doesn't fit anywhere else
 
-type LsblkEntry struct {
-	Parttype    string        `json:"parttype"`
-	Mountpoint  string        `json:"mountpoint"`
-	Mountpoints []string      `json:"mountpoints"`
-	Pttype      string        `json:"pttype"`
-	Fstype      string        `json:"fstype"`
-	Children    []*LsblkEntry `json:"children"`
-}
-
-type LsblkRoot struct {
-	Blockdevices []*LsblkEntry `json:"blockdevices"`
-}
-
-var espLocations = []string{
-	"/efi",
-	"/boot",
-	"/boot/efi",
-}
-var ErrNoESP = errors.New("failed to find EFI system partition")
-
-func findESP(b []byte) (string, error) {
-	var lsblkRoot LsblkRoot
-
-	if err := json.Unmarshal(b, &lsblkRoot); err != nil {
-		return "", fmt.Errorf("failed to parse json: %v", err)
-	}
-
-	for _, lsblkEntry := range lsblkRoot.Blockdevices {
-		// This is our check function, that also checks mountpoints
-		checkDev := func(e *LsblkEntry, pttype string) *LsblkEntry {
-			if e.Pttype != "gpt" && (e.Pttype != "" && pttype != "gpt") {
-				return nil
-			}
-
-			if e.Fstype != "vfat" {
-				return nil
-			}
-
-			if e.Parttype != "c12a7328-f81f-11d2-ba4b-00a0c93ec93b" {
-				return nil
-			}
-
-			if slices.Contains(espLocations, e.Mountpoint) {
-				return e
-			}
-
-			for _, esp := range espLocations {
-				n := slices.Index(e.Mountpoints, esp)
-				if n == -1 {
-					continue
-				}
-				// Replace the top-level Mountpoint with a valid one from mountpoints
-				e.Mountpoint = e.Mountpoints[n]
-				return e
-			}
-			return nil
-		}
-
-		// First check top-level devices
-		p := checkDev(lsblkEntry, "")
-		if p != nil {
-			return p.Mountpoint, nil
-		}
-
-		// Check children, this is not recursive.
-		for _, ce := range lsblkEntry.Children {
-			p := checkDev(ce, lsblkEntry.Pttype)
-			if p != nil {
-				return p.Mountpoint, nil
-			}
-		}
-	}
-	return "", ErrNoESP
-}
-
-// Slightly more advanced check
-func GetESP(vfs afero.Fs) (string, error) {
-	for _, env := range []string{"SYSTEMD_ESP_PATH", "ESP_PATH"} {
-		envEspPath, found := os.LookupEnv(env)
-		if found {
-			return envEspPath, nil
-		}
-	}
-
-	for _, location := range espLocations {
-		// "Read" a file inside all candiadate locations to trigger an
-		// automount if there's an automount partition.
-		_, _ = vfs.Stat(fmt.Sprintf("%s/does-not-exist", location))
-	}
-
-	out, err := exec.Command(
-		"lsblk",
-		"--json",
-		"--tree",
-		"--output", "PARTTYPE,MOUNTPOINT,PTTYPE,FSTYPE").Output()
-	if err != nil {
-		return "", err
-	}
-	return findESP(out)
-}
-
 func Sign(state *config.State, keys *backend.KeyHierarchy, file, output string, enroll bool) error {
 	file, err := filepath.Abs(file)
 	if err != nil {
@@ -215,7 +111,11 @@ func CombineFiles(vfs afero.Fs, microcode, initramfs string) (afero.File, error)
 	return tmpFile, nil
 }
 
-func CreateBundle(state *config.State, bundle Bundle) error {
+// CreateBundle generates the bundle into a temporary file next to the output
+// and moves it into place once it is complete, so a failure never leaves a
+// partially written bundle behind. sign is called on the temporary file
+// before it is moved, if given.
+func CreateBundle(state *config.State, bundle Bundle, sign func(file string) error) error {
 	var microcode string
 	make_bundle := false
 
@@ -236,13 +136,67 @@ func CreateBundle(state *config.State, bundle Bundle) error {
 		bundle.Initramfs = tmpFile.Name()
 	}
 
+	output := bundle.Output
+	if err := state.Fs.MkdirAll(filepath.Dir(output), os.ModePerm); err != nil {
+		return err
+	}
+	tmpFile, err := afero.TempFile(state.Fs, filepath.Dir(output), "."+filepath.Base(output)+"-")
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+	// Removing the file fails once it has been renamed, which is fine
+	defer state.Fs.Remove(tmpFile.Name())
+	bundle.Output = tmpFile.Name()
+
 	out, err := GenerateBundle(state.Fs, &bundle)
 	if err != nil {
 		return err
 	}
 	if !out {
-		return fmt.Errorf("failed to generate bundle %s", bundle.Output)
+		return fmt.Errorf("failed to generate bundle %s", output)
+	}
+
+	if sign != nil {
+		if err := sign(bundle.Output); err != nil {
+			return err
+		}
+	}
+
+	bundle.Output = output
+	return installBundle(state.Fs, &bundle, tmpFile.Name())
+}
+
+// installBundle moves a generated bundle into place. Other copies of the
+// bundle with a different boot counter are removed, and the currently
+// installed bundle is kept as a fallback if requested.
+func installBundle(vfs afero.Fs, bundle *Bundle, file string) error {
+	installed, err := installedBundles(vfs, bundle.Output)
+	if err != nil {
+		return err
 	}
 
+	if bundle.KeepPrevious && len(installed) > 0 {
+		if err := CopyFile(vfs, installed[0], bundle.PreviousPath()); err != nil {
+			return fmt.Errorf("failed to keep previous bundle: %w", err)
+		}
+	}
+
+	if err := vfs.Chmod(file, 0644); err != nil {
+		return err
+	}
+	dst := bundle.InstallPath()
+	if err := vfs.Rename(file, dst); err != nil {
+		return err
+	}
+
+	for _, f := range installed {
+		if f == dst {
+			continue
+		}
+		if err := vfs.Remove(f); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
 	"github.com/foxboron/go-uefi/efivar"
 	"github.com/foxboron/go-uefi/efivarfs"
 	"github.com/foxboron/sbctl/backend"
@@ -16,6 +17,9 @@ type EFIVariables struct {
 	KEK *signature.SignatureDatabase
 	Db  *signature.SignatureDatabase
 	Dbx *signature.SignatureDatabase
+	// Timestamp dates the signed updates, the current time is used when it
+	// is zero
+	Timestamp util.EFITime
 }
 
 func (e *EFIVariables) GetSiglist(ev efivar.Efivar) *signature.SignatureDatabase {
@@ -33,24 +37,33 @@ func (e *EFIVariables) GetSiglist(ev efivar.Efivar) *signature.SignatureDatabase
 }
 
 func (e *EFIVariables) EnrollKey(ev efivar.Efivar, hier *backend.KeyHierarchy) error {
-	// Ensure we are using the correct signer for the backend
-	var signer backend.KeyBackend
-	switch ev {
-	case efivar.PK:
-		signer = hier.GetKeyBackend(efivar.PK)
-	case efivar.KEK:
-		signer = hier.GetKeyBackend(efivar.PK)
-	case efivar.Db:
-		signer = hier.GetKeyBackend(efivar.KEK)
+	t := e.Timestamp
+	if t == (util.EFITime{}) {
+		t = NextEFITime()
+	}
+	if err := CheckTimestamp(e.fs, ev, t); err != nil {
+		return err
 	}
-	// fmt.Printf("%s is signed by %s\n", ev.Name, signer.Certificate().SerialNumber.String())
-	return e.fs.WriteSignedUpdate(ev, e.GetSiglist(ev), signer.Signer(), signer.Certificate())
+	b, err := SignVariable(ev, e.GetSiglist(ev), hier, t)
+	if err != nil {
+		return err
+	}
+	if err := e.fs.WriteVar(ev, signedUpdate(b)); err != nil {
+		return rejectedUpdate(ev, t, err)
+	}
+	return nil
 }
 
 func (e *EFIVariables) EnrollAllKeys(hier *backend.KeyHierarchy) error {
 	if err := e.EnrollKey(efivar.Db, hier); err != nil {
 		return err
 	}
+	// dbx is only written when there are revocations to enroll
+	if len(*e.Dbx) > 0 {
+		if err := e.EnrollKey(efivar.Dbx, hier); err != nil {
+			return err
+		}
+	}
 	if err := e.EnrollKey(efivar.KEK, hier); err != nil {
 		return err
 	}
@@ -1,13 +1,17 @@
 package sbctl
 
 import (
+	"crypto"
 	"errors"
-	"os"
+	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/foxboron/go-uefi/efi/signature"
 	"github.com/foxboron/go-uefi/efi/util"
-	"github.com/foxboron/sbctl/fs"
 	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
 	"github.com/spf13/afero"
 )
 
@@ -20,22 +24,133 @@ var (
 	eventlogGUID = *util.StringToGUID("4f52704f-494d-41736e-6e6f79696e6721")
 )
 
-func GetEventlogEvents(vfs afero.Fs, eventlog string) ([]attest.Event, error) {
-	if _, err := vfs.Stat(eventlog); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil, ErrNoEventlog
-		}
-		return nil, err
+var (
+	ErrNoSHA256Bank   = errors.New("eventlog has no sha256 digests")
+	ErrEventlogReplay = errors.New("eventlog does not match the PCR values")
+)
+
+// firmwarePCRs are the PCRs measured by the firmware. The OS extends the other
+// PCRs without logging to the firmware eventlog.
+var firmwarePCRs = []uint{0, 1, 2, 3, 4, 5, 6, 7}
+
+var tpmHashAlgs = map[attest.HashAlg]struct {
+	alg  tpm2.TPMAlgID
+	hash crypto.Hash
+}{
+	attest.HashSHA1:   {tpm2.TPMAlgSHA1, crypto.SHA1},
+	attest.HashSHA256: {tpm2.TPMAlgSHA256, crypto.SHA256},
+}
+
+// EventlogReplay is the result of replaying one bank of the eventlog
+type EventlogReplay struct {
+	Bank        string `json:"bank"`
+	InvalidPCRs []int  `json:"invalid_pcrs,omitempty"`
+}
+
+func (r EventlogReplay) Valid() bool {
+	return len(r.InvalidPCRs) == 0
+}
+
+func (r EventlogReplay) String() string {
+	if r.Valid() {
+		return r.Bank
+	}
+	pcrs := make([]string, len(r.InvalidPCRs))
+	for i, pcr := range r.InvalidPCRs {
+		pcrs[i] = fmt.Sprint(pcr)
+	}
+	return fmt.Sprintf("%s PCR %s", r.Bank, strings.Join(pcrs, ", "))
+}
+
+// ReadPCRs reads the given PCRs of a bank. At most 8 PCRs can be read at once.
+func ReadPCRs(tpm transport.TPM, alg attest.HashAlg, pcrs []uint) ([]attest.PCR, error) {
+	h, ok := tpmHashAlgs[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", alg)
 	}
-	b, err := fs.ReadFile(vfs, eventlog)
+	rsp, err := tpm2.PCRRead{
+		PCRSelectionIn: tpm2.TPMLPCRSelection{
+			PCRSelections: []tpm2.TPMSPCRSelection{{
+				Hash:      h.alg,
+				PCRSelect: tpm2.PCClientCompatible.PCRs(pcrs...),
+			}},
+		},
+	}.Execute(tpm)
 	if err != nil {
 		return nil, err
 	}
-	log, err := attest.ParseEventLog(b)
+	// An unallocated bank is returned without any digests
+	if len(rsp.PCRValues.Digests) != len(pcrs) {
+		return nil, fmt.Errorf("the tpm has no %s bank", alg)
+	}
+	// The digests are returned in the order of the PCR indexes
+	sorted := slices.Sorted(slices.Values(pcrs))
+	values := make([]attest.PCR, len(sorted))
+	for i, pcr := range sorted {
+		values[i] = attest.PCR{
+			Index:     int(pcr),
+			Digest:    rsp.PCRValues.Digests[i].Buffer,
+			DigestAlg: h.hash,
+		}
+	}
+	return values, nil
+}
+
+// ReplayEventlog replays every bank of the eventlog and compares the result
+// against the PCR values of the TPM
+func ReplayEventlog(log *attest.EventLog, tpm transport.TPM) ([]EventlogReplay, error) {
+	var replays []EventlogReplay
+	for _, alg := range log.Algs {
+		pcrs, err := ReadPCRs(tpm, alg, firmwarePCRs)
+		if err != nil {
+			return nil, err
+		}
+		replay := EventlogReplay{Bank: strings.ToLower(alg.String())}
+		var rerr attest.ReplayError
+		if _, err := log.Verify(pcrs); errors.As(err, &rerr) {
+			replay.InvalidPCRs = rerr.InvalidPCRs
+			slices.Sort(replay.InvalidPCRs)
+		} else if err != nil {
+			return nil, err
+		}
+		replays = append(replays, replay)
+	}
+	return replays, nil
+}
+
+// VerifyEventlog returns ErrEventlogReplay when any bank of the eventlog does
+// not match the PCR values of the TPM
+func VerifyEventlog(log *attest.EventLog, tpm transport.TPM) error {
+	replays, err := ReplayEventlog(log, tpm)
+	if err != nil {
+		return err
+	}
+	var invalid []string
+	for _, r := range replays {
+		if !r.Valid() {
+			invalid = append(invalid, r.String())
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%w: %s", ErrEventlogReplay, strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// GetEventlogEvents returns the events of the SHA-256 bank, which is the only
+// digest usable in db
+func GetEventlogEvents(vfs afero.Fs, eventlog string) ([]attest.Event, error) {
+	log, err := ParseEventlog(vfs, eventlog)
 	if err != nil {
 		return nil, err
 	}
-	// TODO: Hardcoded. Should probably make this dynamic
+	return sha256Events(log)
+}
+
+func sha256Events(log *attest.EventLog) ([]attest.Event, error) {
+	if !slices.Contains(log.Algs, attest.HashSHA256) {
+		return nil, ErrNoSHA256Bank
+	}
 	return log.Events(attest.HashSHA256), nil
 }
 
@@ -53,8 +168,20 @@ func CheckEventlogOprom(vfs afero.Fs, eventlog string) error {
 	return nil
 }
 
-func GetEventlogChecksums(vfs afero.Fs, eventlog string) (*signature.SignatureDatabase, error) {
-	events, err := GetEventlogEvents(vfs, eventlog)
+// GetEventlogChecksums returns the checksums of the option ROMs in the
+// eventlog. When tpm is not nil the eventlog is only trusted if it replays to
+// the PCR values.
+func GetEventlogChecksums(vfs afero.Fs, eventlog string, tpm transport.TPM) (*signature.SignatureDatabase, error) {
+	log, err := ParseEventlog(vfs, eventlog)
+	if err != nil {
+		return nil, err
+	}
+	if tpm != nil {
+		if err := VerifyEventlog(log, tpm); err != nil {
+			return nil, err
+		}
+	}
+	events, err := sha256Events(log)
 	if err != nil {
 		return nil, err
 	}
@@ -2,8 +2,13 @@ package sbctl
 
 import (
 	"errors"
+	"slices"
 	"testing"
 
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
 	"github.com/spf13/afero"
 )
 
@@ -47,7 +52,7 @@ func TestParseEventlog(t *testing.T) {
 
 func TestEventlogChecksums(t *testing.T) {
 	for _, test := range tests {
-		digests, err := GetEventlogChecksums(afero.NewOsFs(), test.File)
+		digests, err := GetEventlogChecksums(afero.NewOsFs(), test.File, nil)
 		if err != nil {
 			continue
 		}
@@ -59,3 +64,80 @@ func TestEventlogChecksums(t *testing.T) {
 		}
 	}
 }
+
+// extendEventlog extends the simulator PCRs with the firmware events
+func extendEventlog(t *testing.T, tpm transport.TPM, log *attest.EventLog) {
+	for _, alg := range log.Algs {
+		h := tpmHashAlgs[alg]
+		for _, event := range log.Events(alg) {
+			if event.Index > 7 || event.Type.String() == "EV_NO_ACTION" {
+				continue
+			}
+			_, err := tpm2.PCRExtend{
+				PCRHandle: tpm2.AuthHandle{Handle: tpm2.TPMHandle(event.Index), Auth: tpm2.PasswordAuth(nil)},
+				Digests: tpm2.TPMLDigestValues{
+					Digests: []tpm2.TPMTHA{{HashAlg: h.alg, Digest: event.Digest}},
+				},
+			}.Execute(tpm)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReplayEventlog(t *testing.T) {
+	rwc, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+
+	log, err := ParseEventlog(afero.NewOsFs(), "tests/tpm_eventlogs/t14_eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyEventlog(log, rwc); !errors.Is(err, ErrEventlogReplay) {
+		t.Fatalf("eventlog replayed to empty PCRs: %v", err)
+	}
+
+	extendEventlog(t, rwc, log)
+	replays, err := ReplayEventlog(log, rwc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range replays {
+		if !r.Valid() {
+			t.Fatalf("eventlog does not replay: %s", r)
+		}
+	}
+	if _, err := GetEventlogChecksums(afero.NewOsFs(), "tests/tpm_eventlogs/t14_eventlog", rwc); err != nil {
+		t.Fatal(err)
+	}
+
+	// An event missing from the eventlog
+	_, err = tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{Handle: tpm2.TPMHandle(2), Auth: tpm2.PasswordAuth(nil)},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: make([]byte, 32)}},
+		},
+	}.Execute(rwc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replays, err = ReplayEventlog(log, rwc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range replays {
+		if r.Bank == "sha256" && !slices.Equal(r.InvalidPCRs, []int{2}) {
+			t.Fatalf("unexpected invalid PCRs %s", r)
+		}
+		if r.Bank != "sha256" && !r.Valid() {
+			t.Fatalf("eventlog does not replay: %s", r)
+		}
+	}
+	if _, err := GetEventlogChecksums(afero.NewOsFs(), "tests/tpm_eventlogs/t14_eventlog", rwc); !errors.Is(err, ErrEventlogReplay) {
+		t.Fatalf("checksums of a mismatching eventlog were trusted: %v", err)
+	}
+}
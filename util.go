@@ -73,6 +73,17 @@ var ErrNotImmutable = errors.New("file is not immutable")
 
 var Immutable = false
 
+// RealPath returns the path of a file on the host, for files which are passed
+// to other programs
+func RealPath(vfs afero.Fs, name string) string {
+	if b, ok := vfs.(*afero.BasePathFs); ok {
+		if p, err := b.RealPath(name); err == nil {
+			return p
+		}
+	}
+	return name
+}
+
 // Check if a given file has the immutable bit set
 func IsImmutable(vfs afero.Fs, file string) error {
 	// We can't actually do the syscall check. Implemented a workaround to test stuff instead